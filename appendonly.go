@@ -0,0 +1,240 @@
+package pitreos
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
+)
+
+// DefaultAppendonlySampledChunks is how many chunks of the previous backup
+// of a file, besides its last one, are checked before detecting it as
+// append-only, by default.
+const DefaultAppendonlySampledChunks = 3
+
+// Reasons of AppendonlyCheck.
+const (
+	AppendonlyReasonConfigured = "configured"
+	AppendonlyReasonAuto       = "auto"
+)
+
+// AppendonlyCheck records why a file was backed up as append-only, reusing
+// the chunks of its previous backup instead of reading them again.
+type AppendonlyCheck struct {
+	// Reason is AppendonlyReasonConfigured for files matching
+	// AppendonlyFiles, and AppendonlyReasonAuto for files detected with
+	// AppendonlyAuto.
+	Reason         string `json:"reason"`
+	PreviousBackup string `json:"previous_backup"`
+	PreviousSize   int64  `json:"previous_size"`
+
+	// VerifiedChunks are the starts of the chunks of the previous backup
+	// found identical in the file.
+	VerifiedChunks []int64 `json:"verified_chunks,omitempty"`
+
+	// Rejected is why a file matching AppendonlyFiles failed its checks,
+	// and was backed up entirely instead.
+	Rejected string `json:"rejected,omitempty"`
+}
+
+// matchAppendonlyFile reports whether `relativePath` matches any of
+// `patterns`, globs on the whole relative path, where `**` matches any
+// number of directories, like `blocks/*.log` or `**/blocks.log`.
+func matchAppendonlyFile(patterns []string, relativePath string) bool {
+	segments := strings.Split(relativePath, "/")
+	for _, pattern := range patterns {
+		if pattern == relativePath || matchSegments(strings.Split(pattern, "/"), segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// previousBackup is the latest backup of a tag, on top of which files can
+// be backed up as append-only, along with the globs of the files
+// configured as such for this backup.
+type previousBackup struct {
+	name            string
+	files           map[string]*FileIndex
+	appendonlyFiles []string
+}
+
+// loadPreviousBackup returns the latest backup of `tag`, when it can be
+// used for append-only files.
+func (p *PITR) loadPreviousBackup(tag string, appendonlyFiles []string) *previousBackup {
+	if len(appendonlyFiles) == 0 && !p.AppendonlyAuto {
+		return nil
+	}
+
+	name, err := p.GetLatestBackup(tag)
+	if err != nil || name == "" {
+		zlog.Debug("no previous backup for append-only files", zap.String("tag", tag), zap.Error(err))
+		return nil
+	}
+
+	bm, err := p.downloadBackupIndex(name)
+	if err != nil {
+		zlog.Warn("cannot read previous backup, append-only files will be read entirely", zap.String("backup_name", name), zap.Error(err))
+		return nil
+	}
+	zlog.Debug("previous backup index", zap.String("version", bm.Version), zap.String("filemeta_version", p.filemetaVersion))
+	if bm.Version != p.filemetaVersion || bm.ChunkSize != p.chunkSize {
+		return nil
+	}
+
+	previous := &previousBackup{name: name, files: make(map[string]*FileIndex), appendonlyFiles: appendonlyFiles}
+	for _, file := range bm.Files {
+		previous.files[file.FileName] = file
+	}
+	return previous
+}
+
+// appendonlyPreviousFile returns the previous backup of the file open in
+// `f`, when the file is to be backed up as append-only, along with the
+// checks made. Files matching AppendonlyFiles are checked like detected
+// ones when VerifyAppendonly is set, and backed up entirely when they
+// fail.
+func (p *PITR) appendonlyPreviousFile(f *FileOps, fileMeta *FileIndex, previous *previousBackup) (*FileIndex, *AppendonlyCheck, error) {
+	if previous == nil || previous.files[fileMeta.FileName] == nil {
+		return nil, nil, nil
+	}
+
+	previousFile := previous.files[fileMeta.FileName]
+	check := &AppendonlyCheck{
+		Reason:         AppendonlyReasonAuto,
+		PreviousBackup: previous.name,
+		PreviousSize:   previousFile.TotalSize,
+	}
+	configured := matchAppendonlyFile(previous.appendonlyFiles, fileMeta.FileName)
+	if configured {
+		check.Reason = AppendonlyReasonConfigured
+		if !p.VerifyAppendonly {
+			return previousFile, check, nil
+		}
+	} else if !p.AppendonlyAuto || previousFile.TotalSize == 0 {
+		return nil, nil, nil
+	}
+
+	reject := func(reason string) (*FileIndex, *AppendonlyCheck, error) {
+		if !configured {
+			zlog.Debug("file not append-only", zap.String("file_name", fileMeta.FileName), zap.String("reason", reason))
+			return nil, nil, nil
+		}
+
+		zlog.Warn("append-only file failed its checks, backing it up entirely", zap.String("file_name", fileMeta.FileName), zap.String("reason", reason))
+		check.Rejected = reason
+		return nil, check, nil
+	}
+
+	if previousFile.TotalSize > fileMeta.TotalSize {
+		return reject(fmt.Sprintf("file shrank from %d to %d bytes", previousFile.TotalSize, fileMeta.TotalSize))
+	}
+
+	verified, mismatch, err := verifyAppendonlyChunks(f, previousFile.Chunks, p.AppendonlySampledChunks)
+	check.VerifiedChunks = verified
+	if err != nil {
+		return nil, nil, err
+	}
+	if mismatch != nil {
+		return reject(fmt.Sprintf("chunk at %d changed", mismatch.Start))
+	}
+
+	if !configured {
+		zlog.Info("file detected as append-only", zap.String("file_name", fileMeta.FileName), zap.Int("verified_chunks", len(verified)))
+	}
+	return previousFile, check, nil
+}
+
+// verifyAppendonlyChunks checks that the last of `chunks`, and `samples`
+// others, are still in the file open in `f`. It returns the starts of the
+// chunks found identical, and the first one differing.
+func verifyAppendonlyChunks(f *FileOps, chunks []*ChunkDef, samples int) (verified []int64, mismatch *ChunkDef, err error) {
+	for _, chunk := range sampleChunks(chunks, samples) {
+		same, err := localChunkMatches(f, chunk)
+		if err != nil {
+			return verified, nil, err
+		}
+		if !same {
+			return verified, chunk, nil
+		}
+		verified = append(verified, chunk.Start)
+	}
+	return verified, nil, nil
+}
+
+// sampleChunks returns the last chunk of `chunks`, followed by `samples`
+// others picked at random, or all of them when `samples` is negative.
+func sampleChunks(chunks []*ChunkDef, samples int) []*ChunkDef {
+	sorted := make([]*ChunkDef, len(chunks))
+	copy(sorted, chunks)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start > sorted[j].Start })
+	if len(sorted) == 0 {
+		return nil
+	}
+
+	others := sorted[1:]
+	if samples < 0 || samples >= len(others) {
+		return sorted
+	}
+
+	out := []*ChunkDef{sorted[0]}
+	for _, i := range rand.Perm(len(others))[:samples] {
+		out = append(out, others[i])
+	}
+	return out
+}
+
+// localChunkMatches reports whether the content of `chunk`, from a
+// previous backup, is still in the file open in `f`.
+func localChunkMatches(f *FileOps, chunk *ChunkDef) (bool, error) {
+	data, empty, err := f.getLocalChunk(chunk.Start, chunk.End-chunk.Start+1)
+	if err != nil {
+		return false, fmt.Errorf("reading chunk at %d: %s", chunk.Start, err)
+	}
+	if chunk.IsEmpty || empty {
+		return chunk.IsEmpty && empty, nil
+	}
+	return fmt.Sprintf("%x", sha3.Sum256(data)) == chunk.ContentSHA, nil
+}
+
+// chunkRange is a range of a file, `end` included, to read into a new
+// chunk.
+type chunkRange struct {
+	start, end int64
+}
+
+// planChunks splits a file of `size` bytes into chunks of `chunkSize`
+// bytes, on top of the chunks of its `previous` backup when it is
+// append-only: those are reused as they are, and the rest is read into
+// new chunks ending on multiples of `chunkSize`.
+//
+// When the previous backup ended with a partial chunk, the bytes appended
+// after it, up to the end of its `chunkSize` region, are a chunk of their
+// own: the growing tail of a file is never read, nor stored, twice.
+func planChunks(size, chunkSize int64, previous []*ChunkDef) (reused []*ChunkDef, ranges []chunkRange) {
+	sorted := make([]*ChunkDef, len(previous))
+	copy(sorted, previous)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	var offset int64
+	for _, chunk := range sorted {
+		if chunk.Start != offset || chunk.End >= size {
+			break
+		}
+		reused = append(reused, chunk)
+		offset = chunk.End + 1
+	}
+
+	for offset < size {
+		end := (offset/chunkSize + 1) * chunkSize
+		if end > size {
+			end = size
+		}
+		ranges = append(ranges, chunkRange{start: offset, end: end - 1})
+		offset = end
+	}
+	return reused, ranges
+}
@@ -0,0 +1,325 @@
+package pitreos
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchAppendonlyFile(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		in       string
+		expected bool
+	}{
+		{[]string{"blocks/blocks.log"}, "blocks/blocks.log", true},
+		{[]string{"blocks/blocks.log"}, "blocks/blocks.index", false},
+		{[]string{"blocks/*"}, "blocks/blocks.index", true},
+		{[]string{"blocks/*"}, "blocks/reversible/shared_memory.bin", false},
+		{[]string{"*.log"}, "blocks/blocks.log", false},
+		{[]string{"**/*.log"}, "blocks/blocks.log", true},
+		{[]string{"**/*.log"}, "blocks.log", true},
+		{[]string{"state/*", "blocks/blocks.[li]*"}, "blocks/blocks.index", true},
+		{nil, "blocks/blocks.log", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, matchAppendonlyFile(test.patterns, test.in), "%v on %q", test.patterns, test.in)
+	}
+}
+
+func TestSampleChunks(t *testing.T) {
+	chunks := []*ChunkDef{{Start: 0}, {Start: 300}, {Start: 100}, {Start: 200}}
+
+	sampled := sampleChunks(chunks, 0)
+	require.Len(t, sampled, 1)
+	assert.Equal(t, int64(300), sampled[0].Start)
+
+	sampled = sampleChunks(chunks, 2)
+	require.Len(t, sampled, 3)
+	assert.Equal(t, int64(300), sampled[0].Start)
+	assert.NotEqual(t, sampled[1].Start, sampled[2].Start)
+
+	assert.Len(t, sampleChunks(chunks, -1), 4)
+	assert.Len(t, sampleChunks(chunks, 10), 4)
+	assert.Len(t, sampleChunks(nil, 3), 0)
+}
+
+func TestPITR_GenerateBackup_AppendonlyAuto(t *testing.T) {
+	const mib = 1024 * 1024
+	initial := testContent(3*mib+mib/2, 1)
+	source := newTestSourceDir(t, map[string][]byte{
+		"blocks.log": initial,
+		"state.bin":  initial,
+		"other.log":  initial,
+	})
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.VerifyAppendonly = true
+	pitr.AppendonlyFiles = []string{"*.log"}
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	// Appended to, but also changed in its last chunk
+	appended := append(append([]byte{}, initial...), testContent(mib, 2)...)
+	for _, name := range []string{"blocks.log", "other.log"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(source, name), appended, 0644))
+	}
+	changed := append([]byte{}, appended...)
+	changed[3*mib+10]++
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "state.bin"), changed, 0644))
+
+	// Backup names have a one second resolution
+	time.Sleep(time.Second)
+	pitr.AppendonlyFiles = []string{"other.log"}
+	pitr.AppendonlyAuto = true
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	latest, err := pitr.GetLatestBackup("dev")
+	require.NoError(t, err)
+	bm, err := pitr.downloadBackupIndex(latest)
+	require.NoError(t, err)
+
+	byName := make(map[string]*FileIndex)
+	for _, file := range bm.Files {
+		byName[file.FileName] = file
+	}
+	require.NotNil(t, byName["blocks.log"].Appendonly)
+	assert.Equal(t, AppendonlyReasonAuto, byName["blocks.log"].Appendonly.Reason)
+	assert.Equal(t, int64(len(initial)), byName["blocks.log"].Appendonly.PreviousSize)
+	assert.Len(t, byName["blocks.log"].Appendonly.VerifiedChunks, 4)
+	assert.Contains(t, byName["blocks.log"].Appendonly.VerifiedChunks, int64(3*mib))
+
+	require.NotNil(t, byName["other.log"].Appendonly)
+	assert.Equal(t, AppendonlyReasonConfigured, byName["other.log"].Appendonly.Reason)
+	assert.Len(t, byName["other.log"].Appendonly.VerifiedChunks, 4)
+	assert.Empty(t, byName["other.log"].Appendonly.Rejected)
+
+	assert.Nil(t, byName["state.bin"].Appendonly)
+
+	dest, err := ioutil.TempDir("", "pitreos-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	require.NoError(t, pitr.RestoreFromBackup(dest, latest, AllFileFilter))
+	assertSameFiles(t, source, dest, "blocks.log", "state.bin", "other.log")
+}
+
+func TestPITR_GenerateBackup_AppendonlyVerify(t *testing.T) {
+	const mib = 1024 * 1024
+	initial := testContent(3*mib, 1)
+	source := newTestSourceDir(t, map[string][]byte{"blocks.log": initial, "trusted.log": initial})
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.VerifyAppendonly = true
+	pitr.AppendonlyFiles = []string{"*.log"}
+	pitr.AppendonlySampledChunks = -1
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	// Rewritten in its first chunk, not only appended to
+	rewritten := append(append([]byte{}, initial...), testContent(mib, 2)...)
+	rewritten[10]++
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "blocks.log"), rewritten, 0644))
+
+	time.Sleep(time.Second)
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	latest, err := pitr.GetLatestBackup("dev")
+	require.NoError(t, err)
+	bm, err := pitr.downloadBackupIndex(latest)
+	require.NoError(t, err)
+	file, err := bm.findFileIndex("blocks.log")
+	require.NoError(t, err)
+	require.NotNil(t, file.Appendonly)
+	assert.Equal(t, AppendonlyReasonConfigured, file.Appendonly.Reason)
+	assert.Equal(t, "chunk at 0 changed", file.Appendonly.Rejected)
+
+	dest, err := ioutil.TempDir("", "pitreos-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	require.NoError(t, pitr.RestoreFromBackup(dest, latest, AllFileFilter))
+	assertSameFiles(t, source, dest, "blocks.log")
+
+	// Trusted as is without verification
+	rewritten[11]++
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "trusted.log"), rewritten, 0644))
+	time.Sleep(time.Second)
+	pitr.VerifyAppendonly = false
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	latest, err = pitr.GetLatestBackup("dev")
+	require.NoError(t, err)
+	bm, err = pitr.downloadBackupIndex(latest)
+	require.NoError(t, err)
+	file, err = bm.findFileIndex("trusted.log")
+	require.NoError(t, err)
+	require.NotNil(t, file.Appendonly)
+	assert.Empty(t, file.Appendonly.Rejected)
+	assert.Empty(t, file.Appendonly.VerifiedChunks)
+}
+
+func TestPITR_RestoreFromBackup_AppendonlyVerify(t *testing.T) {
+	const mib = 1024 * 1024
+	content := testContent(3*mib, 1)
+	source := newTestSourceDir(t, map[string][]byte{"blocks.log": content})
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.VerifyAppendonly = true
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+	latest, err := pitr.GetLatestBackup("dev")
+	require.NoError(t, err)
+
+	corrupted := append([]byte{}, content...)
+	corrupted[mib+10]++
+
+	dest, err := ioutil.TempDir("", "pitreos-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	destFile := filepath.Join(dest, "blocks.log")
+
+	pitr.AppendonlyFiles = []string{"blocks.log"}
+	pitr.AppendonlySampledChunks = -1
+	require.NoError(t, ioutil.WriteFile(destFile, corrupted, 0644))
+	require.NoError(t, pitr.RestoreFromBackup(dest, latest, AllFileFilter))
+	assertSameFiles(t, source, dest, "blocks.log")
+
+	// Trusted as is without verification
+	pitr.VerifyAppendonly = false
+	require.NoError(t, ioutil.WriteFile(destFile, corrupted, 0644))
+	require.NoError(t, pitr.RestoreFromBackup(dest, latest, AllFileFilter))
+	restored, err := ioutil.ReadFile(destFile)
+	require.NoError(t, err)
+	assert.Equal(t, corrupted, restored)
+}
+
+func TestPITR_RestoreFromBackup_AppendonlyAuto(t *testing.T) {
+	const mib = 1024 * 1024
+	initial := testContent(2*mib, 1)
+	source := newTestSourceDir(t, map[string][]byte{"blocks.log": initial})
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.AppendonlyAuto = true
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	content := append(append([]byte{}, initial...), testContent(mib, 2)...)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "blocks.log"), content, 0644))
+	time.Sleep(time.Second)
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+	latest, err := pitr.GetLatestBackup("dev")
+	require.NoError(t, err)
+
+	dest, err := ioutil.TempDir("", "pitreos-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	destFile := filepath.Join(dest, "blocks.log")
+
+	// Detected as append-only when backed up, so trusted without being
+	// listed in AppendonlyFiles
+	local := append(append([]byte{}, content...), testContent(mib, 3)...)
+	local[10]++
+	require.NoError(t, ioutil.WriteFile(destFile, local, 0644))
+	pitr = New(1, 2, time.Minute, storage)
+	require.NoError(t, pitr.RestoreFromBackup(dest, latest, AllFileFilter))
+	restored, err := ioutil.ReadFile(destFile)
+	require.NoError(t, err)
+	assert.Equal(t, local[:len(content)], restored)
+}
+
+func TestPlanChunks(t *testing.T) {
+	chunk := func(start, end int64) *ChunkDef { return &ChunkDef{Start: start, End: end} }
+
+	tests := []struct {
+		name           string
+		size           int64
+		previous       []*ChunkDef
+		expectedReused int
+		expectedRanges []chunkRange
+	}{
+		{"no previous", 250, nil, 0, []chunkRange{{0, 99}, {100, 199}, {200, 249}}},
+		{"empty file", 0, nil, 0, nil},
+		{"aligned previous", 250, []*ChunkDef{chunk(0, 99), chunk(100, 199)}, 2, []chunkRange{{200, 249}}},
+		{"partial last chunk", 250, []*ChunkDef{chunk(100, 149), chunk(0, 99)}, 2, []chunkRange{{150, 199}, {200, 249}}},
+		{"growing within the chunk", 170, []*ChunkDef{chunk(0, 99), chunk(100, 149)}, 2, []chunkRange{{150, 169}}},
+		{"tail pieces", 200, []*ChunkDef{chunk(0, 99), chunk(100, 149), chunk(150, 169)}, 3, []chunkRange{{170, 199}}},
+		{"unchanged size", 150, []*ChunkDef{chunk(0, 99), chunk(100, 149)}, 2, nil},
+		{"shrank", 120, []*ChunkDef{chunk(0, 99), chunk(100, 149)}, 1, []chunkRange{{100, 119}}},
+		{"gap", 250, []*ChunkDef{chunk(0, 99), chunk(150, 199)}, 1, []chunkRange{{100, 199}, {200, 249}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reused, ranges := planChunks(test.size, 100, test.previous)
+			assert.Len(t, reused, test.expectedReused)
+			assert.Equal(t, test.expectedRanges, ranges)
+		})
+	}
+}
+
+// writeCountingStorage counts the bytes of the chunks written to it.
+type writeCountingStorage struct {
+	*DStoreStorage
+	written int
+}
+
+func (s *writeCountingStorage) WriteChunk(hash string, content []byte) error {
+	s.written += len(content)
+	return s.DStoreStorage.WriteChunk(hash, content)
+}
+
+func TestPITR_GenerateBackup_AppendonlyTail(t *testing.T) {
+	const mib = 1024 * 1024
+	content := testContent(2*mib+mib/2, 1)
+	source := newTestSourceDir(t, map[string][]byte{"blocks.log": content[:mib+mib/2]})
+	filePath := filepath.Join(source, "blocks.log")
+
+	storage := &writeCountingStorage{DStoreStorage: newTestLocalStorage(t)}
+	pitr := New(1, 1, time.Minute, storage)
+	pitr.AppendonlyFiles = []string{"blocks.log"}
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	for _, size := range []int{mib + 3*mib/4, 2*mib + mib/2} {
+		require.NoError(t, ioutil.WriteFile(filePath, content[:size], 0644))
+		storage.written = 0
+		time.Sleep(time.Second)
+		require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+	}
+	// Only the bytes appended since the previous backup were stored
+	assert.Equal(t, 3*mib/4, storage.written)
+
+	latest, err := pitr.GetLatestBackup("dev")
+	require.NoError(t, err)
+	bm, err := pitr.downloadBackupIndex(latest)
+	require.NoError(t, err)
+	file, err := bm.findFileIndex("blocks.log")
+	require.NoError(t, err)
+
+	var ranges []chunkRange
+	for _, chunk := range file.Chunks {
+		ranges = append(ranges, chunkRange{chunk.Start, chunk.End})
+	}
+	assert.ElementsMatch(t, []chunkRange{
+		{0, mib - 1},
+		{mib, mib + mib/2 - 1},
+		{mib + mib/2, mib + 3*mib/4 - 1},
+		{mib + 3*mib/4, 2*mib - 1},
+		{2 * mib, 2*mib + mib/2 - 1},
+	}, ranges)
+
+	dest, err := ioutil.TempDir("", "pitreos-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	require.NoError(t, pitr.RestoreFromBackup(dest, latest, AllFileFilter))
+	assertSameFiles(t, source, dest, "blocks.log")
+
+	// Restoring over the previous version only writes the appended bytes
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "blocks.log"), content[:mib+3*mib/4], 0644))
+	require.NoError(t, pitr.RestoreFromBackup(dest, latest, AllFileFilter))
+	assertSameFiles(t, source, dest, "blocks.log")
+}
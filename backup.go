@@ -2,7 +2,7 @@ package pitreos
 
 import (
 	"fmt"
-	"math"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
@@ -14,33 +14,144 @@ import (
 	"github.com/ghodss/yaml"
 )
 
+// GenerateBackup backs up the files of `source` matching `filter`. Files
+// excluded by the rules of a `.pitreosignore` file at the root of
+// `source` (see RuleFilter) are skipped.
 func (p *PITR) GenerateBackup(source string, tag string, metadata map[string]interface{}, filter Filter) error {
+	return p.generateBackup([]Root{{Path: source}}, tag, metadata, filter, nil)
+}
+
+// GenerateBackupFromRoots backs up several named source directories
+// together, in a single backup. Files are recorded, and matched against
+// `filter`, as `{root name}/{relative path}`. Each root can have its own
+// `.pitreosignore` file.
+func (p *PITR) GenerateBackupFromRoots(roots []Root, tag string, metadata map[string]interface{}, filter Filter) error {
+	if err := validateRoots(roots); err != nil {
+		return err
+	}
+	return p.generateBackup(roots, tag, metadata, filter, nil)
+}
+
+// generateBackup backs up `roots`, with `appendonlyFiles` as append-only
+// on top of AppendonlyFiles.
+func (p *PITR) generateBackup(roots []Root, tag string, metadata map[string]interface{}, filter Filter, appendonlyFiles []string) (err error) {
 	now := time.Now()
 	backupName := makeBackupName(now, tag)
+	env := hookEnv{"OPERATION": "backup", "BACKUP_NAME": backupName, "TAG": tag, "SOURCE": rootsString(roots)}
+	defer func() {
+		if err != nil {
+			p.Hooks.runFailureHook(env, err)
+		}
+	}()
+
+	// Concurrent backups of a tag would race on its previous backup, read
+	// for append-only files
+	var lease *Lease
+	if p.LockTTL > 0 {
+		if lease, err = p.AcquireLock(tag, "backup", p.LockTTL); err != nil {
+			return err
+		}
+		defer func() {
+			if releaseErr := lease.Release(); releaseErr != nil {
+				zlog.Warn("cannot release lock", zap.String("tag", tag), zap.Error(releaseErr))
+			}
+		}()
+	}
+
+	hookMeta, err := runHook("pre-backup", p.Hooks.PreBackup, env)
+	if err != nil {
+		return err
+	}
+	if len(hookMeta) > 0 {
+		merged := make(map[string]interface{}, len(metadata)+len(hookMeta))
+		for k, v := range metadata {
+			merged[k] = v
+		}
+		for k, v := range hookMeta {
+			merged[k] = v
+		}
+		metadata = merged
+	}
+
 	bm := &BackupIndex{
 		ChunkSize: p.chunkSize,
 		Date:      now.UTC(),
 		Version:   p.filemetaVersion,
+		Tag:       tag,
 		Meta:      metadata,
 	}
 
-	dirs, err := getDirFiles(source)
-	for _, filePath := range dirs {
-		relName, err := filepath.Rel(source, filePath)
+	previous := p.loadPreviousBackup(tag, append(append([]string{}, p.AppendonlyFiles...), appendonlyFiles...))
+	for _, root := range roots {
+		if root.Name != "" {
+			bm.Roots = append(bm.Roots, root)
+		}
+
+		dirs, err := getDirFiles(root.Path)
+		if err != nil {
+			return fmt.Errorf("listing files of %q: %s", root.Path, err)
+		}
+
+		ignoreRules, err := LoadRuleFilter(filepath.Join(root.Path, IgnoreFileName))
 		if err != nil {
 			return err
 		}
 
-		if !filter.Match(relName) {
-			continue
+		for _, filePath := range dirs {
+			relName, err := filepath.Rel(root.Path, filePath)
+			if err != nil {
+				return err
+			}
+
+			if isSnapshotFile(filePath) {
+				zlog.Debug("skipping left over snapshot", zap.String("file_path", filePath))
+				continue
+			}
+
+			if ignoreRules != nil && !ignoreRules.Match(relName) {
+				zlog.Debug("file ignored", zap.String("relative_file_name", relName), zap.String("root", root.Path))
+				continue
+			}
+			relName = fileNameInRoot(root.Name, relName)
+
+			attrs, mode, err := localFileAttributes(filePath)
+			if err != nil {
+				return err
+			}
+			if !matchFile(filter, relName, attrs) {
+				continue
+			}
+
+			fileMeta, err := p.uploadFileToGSChunks(filePath, relName, now, previous)
+			if err != nil {
+				return fmt.Errorf("upload file to chunks: %s", err)
+			}
+			fileMeta.Root = root.Name
+			fileMeta.ModTime = &attrs.ModTime
+			fileMeta.Mode = mode
+
+			bm.Files = append(bm.Files, fileMeta)
 		}
+	}
 
-		fileMeta, err := p.uploadFileToGSChunks(filePath, relName, now, tag)
-		if err != nil {
-			return fmt.Errorf("upload file to chunks: %s", err)
+	var inconsistent, notSnapshotted []string
+	for _, file := range bm.Files {
+		if file.Inconsistent {
+			inconsistent = append(inconsistent, file.FileName)
 		}
+		if file.notSnapshotted {
+			notSnapshotted = append(notSnapshotted, file.FileName)
+		}
+	}
+	if len(inconsistent) > 0 {
+		zlog.Warn("files changed while being backed up, their backup may be inconsistent", zap.Strings("file_names", inconsistent))
+	}
+	if len(notSnapshotted) > 0 {
+		zlog.Warn("filesystem doesn't support reflinks, files backed up without snapshots", zap.Int("files", len(notSnapshotted)), zap.Strings("file_names", notSnapshotted))
+	}
 
-		bm.Files = append(bm.Files, fileMeta)
+	if err := lease.Err(); err != nil {
+		return err
 	}
 
 	err = p.uploadBackupIndexYamlFile(backupName, bm)
@@ -50,51 +161,77 @@ func (p *PITR) GenerateBackup(source string, tag string, metadata map[string]int
 
 	zlog.Debug("backup index uploaded", zap.String("backup_name", backupName))
 
-	return nil
+	env.setStats(bm.Files, now)
+	_, err = runHook("post-backup", p.Hooks.PostBackup, env)
+	return err
 }
 
-func (p *PITR) uploadFileToGSChunks(localFile, relFileName string, timestamp time.Time, tag string) (*FileIndex, error) {
+// uploadFileToGSChunks backs up a file, reading it again, up to
+// ChangedFileRetries times, when it changed while being read. Each
+// attempt reads and hashes the whole file, but chunks that didn't change
+// are already stored, so only changed ones are uploaded again. A file
+// still changing is marked Inconsistent, or fails the backup with
+// FailOnChangedFiles.
+func (p *PITR) uploadFileToGSChunks(localFile, relFileName string, timestamp time.Time, previous *previousBackup) (*FileIndex, error) {
+	for attempt := 0; ; attempt++ {
+		fileMeta, changed, err := p.uploadFileChunks(localFile, relFileName, timestamp, previous)
+		if err != nil || !changed {
+			return fileMeta, err
+		}
+
+		if attempt < p.ChangedFileRetries {
+			zlog.Warn("file changed while being backed up, reading it again", zap.String("file_name", relFileName), zap.Int("attempt", attempt+1))
+			continue
+		}
+		if p.FailOnChangedFiles {
+			return nil, fmt.Errorf("file %q changed while being backed up", relFileName)
+		}
+
+		zlog.Warn("file changed while being backed up, marking it inconsistent", zap.String("file_name", relFileName))
+		fileMeta.Inconsistent = true
+		return fileMeta, nil
+	}
+}
+
+// uploadFileChunks backs up a file once, and reports whether its size,
+// modification or change time differ after reading it. Append-only files
+// reuse the chunks of their `previous` backup.
+func (p *PITR) uploadFileChunks(localFile, relFileName string, timestamp time.Time, previous *previousBackup) (fileMeta *FileIndex, changed bool, err error) {
 	f := NewFileOps(localFile, false)
-	if err := f.Open(); err != nil {
-		return nil, fmt.Errorf("open file: %s", err)
+	cloned, err := f.OpenSnapshot(p.Snapshot)
+	if err != nil {
+		return nil, false, fmt.Errorf("open file: %s", err)
 	}
 	defer f.Close()
 
-	fileInfo, _ := f.file.Stat()
-	fileMeta := &FileIndex{
-		FileName:  relFileName,
-		TotalSize: fileInfo.Size(),
-		Date:      timestamp,
-	}
-	totalPartsNum := int64(math.Ceil(float64(fileMeta.TotalSize) / float64(p.chunkSize)))
-
-	var previousFile *FileIndex
-	var previousChunksMap = make(map[int64]*ChunkDef)
-
-	// get previousFile if we can find it perfectly in previous backup
-	// with the same tag
-
-	if stringarrayContains(p.AppendonlyFiles, fileMeta.FileName) {
-		previousBackup, err := p.GetLatestBackup(tag)
-		if err == nil && len(previousBackup) > 0 {
-			previousBM, err := p.downloadBackupIndex(previousBackup)
-			zlog.Debug("previous backup index", zap.String("version", previousBM.Version), zap.String("filemeta_version", p.filemetaVersion))
-			if err == nil && previousBM != nil && previousBM.Version == p.filemetaVersion && previousBM.ChunkSize == p.chunkSize {
-				for _, pf := range previousBM.Files {
-					if pf.FileName == fileMeta.FileName {
-						previousFile = pf
-						f.isAppendOnly = true
-
-						for _, c := range previousFile.Chunks {
-							previousChunksMap[c.Start] = c
-						}
-					}
-				}
-			}
-		}
+	fileInfo, err := f.file.Stat()
+	if err != nil {
+		return nil, false, fmt.Errorf("stat file: %s", err)
+	}
+	before := newFileStamp(fileInfo)
 
+	fileMeta = &FileIndex{
+		FileName:       relFileName,
+		TotalSize:      fileInfo.Size(),
+		Date:           timestamp,
+		notSnapshotted: p.Snapshot == SnapshotAuto && !cloned,
 	}
 
+	previousFile, appendonlyCheck, err := p.appendonlyPreviousFile(f, fileMeta, previous)
+	if err != nil {
+		return nil, false, err
+	}
+	fileMeta.Appendonly = appendonlyCheck
+	var previousChunks []*ChunkDef
+	if previousFile != nil {
+		f.isAppendOnly = true
+		previousChunks = previousFile.Chunks
+	}
+
+	reusedChunks, ranges := planChunks(fileMeta.TotalSize, p.chunkSize, previousChunks)
+	fileMeta.Chunks = append(fileMeta.Chunks, reusedChunks...)
+	totalPartsNum := int64(len(reusedChunks) + len(ranges))
+
 	zlog.Debug("splitting to pieces", zap.String("relative_file_name", relFileName), zap.Int64("total_parts_num", totalPartsNum))
 
 	// setup chunk metadata reader to populate fileMeta
@@ -114,36 +251,29 @@ func (p *PITR) uploadFileToGSChunks(localFile, relFileName string, timestamp tim
 	}()
 
 	alreadyBackedupChunks := 0
-	skippedChunks := 0
+	skippedChunks := len(reusedChunks)
 	emptyChunks := 0
 	// iterate over chunks
 	eg := llerrgroup.New(p.threads)
-	for i := int64(0); i < totalPartsNum; i++ {
+	for i, r := range ranges {
 		if eg.Stop() {
+			// Running uploads still send to chunkCh, closed by cleanup
+			err := eg.Wait()
 			cleanup()
-			return nil, fmt.Errorf("One of the threads failed. Stopping.")
+			if err == nil {
+				err = fmt.Errorf("One of the threads failed. Stopping.")
+			}
+			return nil, false, err
 		}
 
-		partnum := i
+		partnum := int64(len(reusedChunks) + i)
+		r := r
 		eg.Go(func() error {
-
-			partSize := int64(math.Min(float64(p.chunkSize), float64(fileMeta.TotalSize-int64(partnum*p.chunkSize))))
-
 			chunkMeta := &ChunkDef{
-				Start: partnum * p.chunkSize,
-				End:   partnum*p.chunkSize + partSize - 1,
-			}
-
-			skipChunk := false
-			if f.isAppendOnly && previousFile.TotalSize >= chunkMeta.End {
-				skipChunk = true
-				chunkMeta = previousChunksMap[chunkMeta.Start]
-				chunkCh <- chunkMeta
-				counterLock.Lock()
-				skippedChunks++
-				counterLock.Unlock()
-				return nil
+				Start: r.start,
+				End:   r.end,
 			}
+			partSize := r.end - r.start + 1
 
 			partBuffer, blockIsEmpty, err := f.getLocalChunk(chunkMeta.Start, partSize)
 			if err != nil {
@@ -159,7 +289,7 @@ func (p *PITR) uploadFileToGSChunks(localFile, relFileName string, timestamp tim
 				counterLock.Unlock()
 			}
 
-			if !blockIsEmpty && !skipChunk {
+			if !blockIsEmpty {
 				zlog.Info("processing part", zap.Int64("part_num", partnum+1), zap.Int64("total_parts_num", totalPartsNum))
 				chunkMeta.ContentSHA = fmt.Sprintf("%x", sha3.Sum256(partBuffer))
 
@@ -173,23 +303,15 @@ func (p *PITR) uploadFileToGSChunks(localFile, relFileName string, timestamp tim
 					}
 				}
 
-				exists, err := p.storage.ChunkExists(chunkMeta.ContentSHA)
+				exists, err := p.writeChunkIfAbsent(chunkMeta.ContentSHA, partBuffer)
 				if err != nil {
-					errmsg := fmt.Errorf("chunk exists: %s", err)
-					zlog.Error("chunk exists", zap.Error(errmsg))
-					return errmsg
+					zlog.Error("write chunk", zap.Error(err))
+					return err
 				}
 				if exists {
 					counterLock.Lock()
 					alreadyBackedupChunks++
 					counterLock.Unlock()
-				} else {
-					err := p.storage.WriteChunk(chunkMeta.ContentSHA, partBuffer)
-					if err != nil {
-						errmsg := fmt.Errorf("write chunk: %s", err)
-						zlog.Error("write chunk", zap.Error(errmsg))
-						return errmsg
-					}
 				}
 			}
 
@@ -202,7 +324,7 @@ func (p *PITR) uploadFileToGSChunks(localFile, relFileName string, timestamp tim
 
 	if err := eg.Wait(); err != nil {
 		cleanup()
-		zlog.Fatal("waiting for tasks completion", zap.Error(err))
+		return nil, false, err
 	}
 
 	if alreadyBackedupChunks > 0 {
@@ -230,8 +352,56 @@ func (p *PITR) uploadFileToGSChunks(localFile, relFileName string, timestamp tim
 	}
 
 	cleanup()
-	return fileMeta, nil
 
+	fileInfo, err = f.file.Stat()
+	if err != nil {
+		return nil, false, fmt.Errorf("stat file: %s", err)
+	}
+	return fileMeta, !newFileStamp(fileInfo).equal(before), nil
+}
+
+// fileStamp identifies a version of a file's content.
+type fileStamp struct {
+	size       int64
+	modTime    time.Time
+	changeTime time.Time
+}
+
+func newFileStamp(info os.FileInfo) fileStamp {
+	return fileStamp{
+		size:       info.Size(),
+		modTime:    info.ModTime(),
+		changeTime: fileChangeTime(info),
+	}
+}
+
+func (s fileStamp) equal(other fileStamp) bool {
+	return s.size == other.size && s.modTime.Equal(other.modTime) && s.changeTime.Equal(other.changeTime)
+}
+
+// writeChunkIfAbsent uploads the chunk unless the storage already has
+// it, and reports whether it already existed.
+func (p *PITR) writeChunkIfAbsent(hash string, content []byte) (existed bool, err error) {
+	if cw, ok := p.storage.(ConditionalChunkWriter); ok {
+		written, err := cw.WriteChunkIfAbsent(hash, content)
+		if err != nil {
+			return false, fmt.Errorf("write chunk: %s", err)
+		}
+		return !written, nil
+	}
+
+	exists, err := p.storage.ChunkExists(hash)
+	if err != nil {
+		return false, fmt.Errorf("chunk exists: %s", err)
+	}
+	if exists {
+		return true, nil
+	}
+
+	if err := p.storage.WriteChunk(hash, content); err != nil {
+		return false, fmt.Errorf("write chunk: %s", err)
+	}
+	return false, nil
 }
 
 func (p *PITR) uploadBackupIndexYamlFile(name string, bm *BackupIndex) error {
@@ -239,7 +409,20 @@ func (p *PITR) uploadBackupIndexYamlFile(name string, bm *BackupIndex) error {
 	if err != nil {
 		return fmt.Errorf("yaml marshal: %s", err)
 	}
-	return p.storage.WriteBackupIndex(name, d)
+	if err := p.storage.WriteBackupIndex(name, d); err != nil {
+		return err
+	}
+	// The backup is stored by now: without its metadata object, it is
+	// summarized from its index
+	if err := writeBackupMeta(p.storage, name, bm); err != nil {
+		zlog.Warn("cannot write backup meta, listings will read the backup index", zap.String("backup_name", name), zap.Error(err))
+	}
+	// The backup is complete by now, even if "latest" still points to an
+	// older one
+	if err := updateLatestRef(p.storage, name); err != nil {
+		zlog.Warn("cannot update latest ref", zap.String("backup_name", name), zap.Error(err))
+	}
+	return nil
 }
 
 func makeBackupName(now time.Time, tag string) string {
@@ -250,3 +433,20 @@ func makeBackupName(now time.Time, tag string) string {
 	backupName := fmt.Sprintf("%s--%s", dt, tag)
 	return backupName
 }
+
+// ParseBackupName returns the date and tag of a backup, from a name made
+// like `2018-08-28-18-15-45--default`.
+func ParseBackupName(name string) (date time.Time, tag string, err error) {
+	parts := strings.SplitN(name, "--", 2)
+	if len(parts) != 2 {
+		return date, "", fmt.Errorf("invalid backup name %q", name)
+	}
+
+	date, err = time.Parse(backupNameDateLayout, parts[0])
+	if err != nil {
+		return date, "", fmt.Errorf("invalid date in backup name %q", name)
+	}
+	return date, parts[1], nil
+}
+
+const backupNameDateLayout = "2006-01-02-15-04-05"
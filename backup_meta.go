@@ -0,0 +1,490 @@
+package pitreos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abourget/llerrgroup"
+	humanize "github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+// BackupMeta summarizes a backup, without its list of files: what listing
+// and searching backups need. It is written next to the backup index, as
+// `meta/{name}.json`, by storages implementing BackupMetaStorage.
+type BackupMeta struct {
+	Name      string                 `json:"name"`
+	Version   string                 `json:"version"`
+	Tag       string                 `json:"tag"`
+	Date      time.Time              `json:"date"`
+	Meta      map[string]interface{} `json:"meta,omitempty"`
+	Files     int                    `json:"files"`
+	TotalSize int64                  `json:"total_size"`
+	Chunks    int                    `json:"chunks"`
+}
+
+// BackupMetaStorage is implemented by storages able to keep a BackupMeta
+// next to each backup index. Backups stored elsewhere, or made before
+// metadata objects were written, are summarized from their index.
+//
+// SearchBackups also keeps the metadata of all backups it saw in a single
+// object, `meta/_index.json`, so it only fetches that of newer backups.
+// Backups are always listed, so that object is only a cache: backups
+// missing from it are fetched, and deleted ones ignored.
+type BackupMetaStorage interface {
+	OpenBackupMeta(name string) (io.ReadCloser, error)
+	WriteBackupMeta(name string, content []byte) error
+}
+
+func newBackupMeta(name string, bi *BackupIndex) *BackupMeta {
+	meta := &BackupMeta{
+		Name:    name,
+		Version: bi.Version,
+		Tag:     bi.Tag,
+		Date:    bi.Date,
+		Meta:    bi.Meta,
+		Files:   len(bi.Files),
+	}
+	if meta.Tag == "" {
+		meta.Tag = tagFromBackupName(name)
+	}
+
+	for _, file := range bi.Files {
+		meta.TotalSize += file.TotalSize
+		meta.Chunks += len(file.Chunks)
+	}
+	return meta
+}
+
+// tagFromBackupName returns the tag of a backup named by makeBackupName.
+func tagFromBackupName(name string) string {
+	if idx := strings.Index(name, "--"); idx != -1 {
+		return name[idx+2:]
+	}
+	return ""
+}
+
+// writeBackupMeta writes the metadata object of a backup, when `storage`
+// supports it.
+func writeBackupMeta(storage Storage, name string, bi *BackupIndex) error {
+	metaStorage, ok := storage.(BackupMetaStorage)
+	if !ok {
+		return nil
+	}
+
+	content, err := json.Marshal(newBackupMeta(name, bi))
+	if err != nil {
+		return fmt.Errorf("json marshal: %s", err)
+	}
+	if err := metaStorage.WriteBackupMeta(name, content); err != nil {
+		return fmt.Errorf("write backup meta: %s", err)
+	}
+	return nil
+}
+
+// backupMetaIndexName is the name of the metadata object aggregating the
+// metadata of all backups, which makeBackupName never produces.
+const backupMetaIndexName = "_index"
+
+// readBackupMetaIndex returns the aggregated metadata of backups, by
+// name. It is empty when the storage has none, or it can't be read.
+func readBackupMetaIndex(storage BackupMetaStorage) map[string]*BackupMeta {
+	index := make(map[string]*BackupMeta)
+	content, err := readAllAndClose(storage.OpenBackupMeta(backupMetaIndexName))
+	if err != nil {
+		zlog.Debug("no backup meta index", zap.Error(err))
+		return index
+	}
+
+	var metas []*BackupMeta
+	if err := json.Unmarshal(content, &metas); err != nil {
+		zlog.Warn("invalid backup meta index, ignoring it", zap.Error(err))
+		return index
+	}
+	for _, meta := range metas {
+		index[meta.Name] = meta
+	}
+	return index
+}
+
+func writeBackupMetaIndex(storage BackupMetaStorage, index map[string]*BackupMeta) error {
+	metas := make([]*BackupMeta, 0, len(index))
+	for _, meta := range index {
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Name < metas[j].Name })
+
+	content, err := json.Marshal(metas)
+	if err != nil {
+		return fmt.Errorf("json marshal: %s", err)
+	}
+	return storage.WriteBackupMeta(backupMetaIndexName, content)
+}
+
+// GetBackupMeta returns the metadata of a backup, from its metadata
+// object when there is one, or else from its full index.
+func (p *PITR) GetBackupMeta(backupName string) (*BackupMeta, error) {
+	if metaStorage, ok := p.storage.(BackupMetaStorage); ok {
+		content, err := readAllAndClose(metaStorage.OpenBackupMeta(backupName))
+		if err == nil {
+			var meta *BackupMeta
+			if err := json.Unmarshal(content, &meta); err != nil {
+				return nil, fmt.Errorf("unmarshal backup meta %q: %s", backupName, err)
+			}
+			return meta, nil
+		}
+		zlog.Debug("no backup meta, reading backup index", zap.String("backup_name", backupName), zap.Error(err))
+	}
+
+	bi, err := p.downloadBackupIndex(backupName)
+	if err != nil {
+		return nil, err
+	}
+	return newBackupMeta(backupName, bi), nil
+}
+
+// getBackupMetas fetches the metadata of `names` concurrently, keeping
+// their order.
+func (p *PITR) getBackupMetas(names []string) ([]*BackupMeta, error) {
+	out := make([]*BackupMeta, len(names))
+	eg := llerrgroup.New(p.threads)
+	for i, name := range names {
+		if eg.Stop() {
+			break
+		}
+
+		i, name := i, name
+		eg.Go(func() error {
+			meta, err := p.GetBackupMeta(name)
+			if err != nil {
+				return fmt.Errorf("backup %q: %s", name, err)
+			}
+			out[i] = meta
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SearchBackups returns the metadata of backups whose name starts with
+// `prefix` and matching all of `filters`, oldest first. Metadata comes
+// from the aggregated index of BackupMetaStorage when it has it, and is
+// fetched per backup otherwise.
+func (p *PITR) SearchBackups(prefix string, filters ...BackupFilter) ([]*BackupMeta, error) {
+	list, err := p.storage.ListBackups(math.MaxInt32, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	metas, err := p.getIndexedBackupMetas(list, prefix == "")
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*BackupMeta
+	for _, meta := range metas {
+		if matchBackup(filters, meta) {
+			out = append(out, meta)
+		}
+	}
+	return out, nil
+}
+
+// getIndexedBackupMetas is getBackupMetas, reading the aggregated index
+// first. The index is updated with the metadata fetched, and, when
+// `names` lists all backups, cleared of deleted ones.
+func (p *PITR) getIndexedBackupMetas(names []string, allBackups bool) ([]*BackupMeta, error) {
+	metaStorage, ok := p.storage.(BackupMetaStorage)
+	if !ok {
+		return p.getBackupMetas(names)
+	}
+
+	index := readBackupMetaIndex(metaStorage)
+	var missing []string
+	for _, name := range names {
+		if index[name] == nil {
+			missing = append(missing, name)
+		}
+	}
+
+	fetched, err := p.getBackupMetas(missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range fetched {
+		index[meta.Name] = meta
+	}
+
+	stale := 0
+	if allBackups {
+		listed := make(map[string]bool, len(names))
+		for _, name := range names {
+			listed[name] = true
+		}
+		for name := range index {
+			if !listed[name] {
+				delete(index, name)
+				stale++
+			}
+		}
+	}
+
+	if len(fetched) > 0 || stale > 0 {
+		zlog.Debug("updating backup meta index", zap.Int("fetched", len(fetched)), zap.Int("stale", stale))
+		if err := writeBackupMetaIndex(metaStorage, index); err != nil {
+			zlog.Warn("cannot update backup meta index", zap.Error(err))
+		}
+	}
+
+	out := make([]*BackupMeta, len(names))
+	for i, name := range names {
+		out[i] = index[name]
+	}
+	return out, nil
+}
+
+// BackupFilter selects backups on their metadata.
+type BackupFilter func(meta *BackupMeta) bool
+
+func matchBackup(filters []BackupFilter, meta *BackupMeta) bool {
+	for _, filter := range filters {
+		if !filter(meta) {
+			return false
+		}
+	}
+	return true
+}
+
+// BackupTagFilter matches backups with exactly `tag`.
+func BackupTagFilter(tag string) BackupFilter {
+	return func(meta *BackupMeta) bool { return meta.Tag == tag }
+}
+
+// BackupSinceFilter matches backups made at or after `t`.
+func BackupSinceFilter(t time.Time) BackupFilter {
+	return func(meta *BackupMeta) bool { return !meta.Date.Before(t) }
+}
+
+// BackupMetaFilter matches backups whose `key` metadata is `value`.
+// Nested keys are separated by dots, like `chain.blocknum`.
+func BackupMetaFilter(key, value string) BackupFilter {
+	return func(meta *BackupMeta) bool {
+		v, found := lookupMeta(meta.Meta, key)
+		return found && metaValueString(v) == value
+	}
+}
+
+// lookupMeta finds `key` in backup metadata, first as is, then as a path
+// of dot-separated keys in nested objects.
+func lookupMeta(meta map[string]interface{}, key string) (interface{}, bool) {
+	if v, found := meta[key]; found {
+		return v, true
+	}
+
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	switch inner := meta[parts[0]].(type) {
+	case map[string]interface{}:
+		return lookupMeta(inner, parts[1])
+	}
+	return nil, false
+}
+
+// metaValueString formats a metadata value as given on the command line:
+// `1000000` rather than `1e+06`.
+func metaValueString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	cnt, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(cnt)
+}
+
+// ParseBackupExpression parses an expression selecting backups, combining
+// with `and`, `or`, `not` and parentheses conditions on:
+//
+//	name      backup name (=, !=, ~, !~)
+//	tag       backup tag (=, !=, ~, !~)
+//	date      backup date, like `date >= 2025-01-01` (<, <=, >, >=, =, !=)
+//	files     number of files (<, <=, >, >=, =, !=)
+//	size      total size of files, like `size > 10GB` (<, <=, >, >=, =, !=)
+//	meta.KEY  metadata value, compared as numbers when both sides are, like
+//	          `meta.blocknum >= 1000000` (<, <=, >, >=, =, !=, ~, !~)
+func ParseBackupExpression(expression string) (BackupFilter, error) {
+	node, err := parseExpr(expression)
+	if err != nil {
+		return nil, err
+	}
+	return compileBackupExpr(node)
+}
+
+func compileBackupExpr(node exprNode) (BackupFilter, error) {
+	switch n := node.(type) {
+	case exprAnd:
+		left, right, err := compileBackupExprPair(n.left, n.right)
+		if err != nil {
+			return nil, err
+		}
+		return func(meta *BackupMeta) bool { return left(meta) && right(meta) }, nil
+	case exprOr:
+		left, right, err := compileBackupExprPair(n.left, n.right)
+		if err != nil {
+			return nil, err
+		}
+		return func(meta *BackupMeta) bool { return left(meta) || right(meta) }, nil
+	case exprNot:
+		inner, err := compileBackupExpr(n.inner)
+		if err != nil {
+			return nil, err
+		}
+		return func(meta *BackupMeta) bool { return !inner(meta) }, nil
+	case exprCondition:
+		return compileBackupCondition(n)
+	}
+	return nil, fmt.Errorf("invalid expression")
+}
+
+func compileBackupExprPair(left, right exprNode) (BackupFilter, BackupFilter, error) {
+	l, err := compileBackupExpr(left)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := compileBackupExpr(right)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, r, nil
+}
+
+func compileBackupCondition(c exprCondition) (BackupFilter, error) {
+	field := strings.ToLower(c.field)
+	switch {
+	case field == "name":
+		return compileStringCondition(c, func(meta *BackupMeta) (string, bool) { return meta.Name, true })
+
+	case field == "tag":
+		return compileStringCondition(c, func(meta *BackupMeta) (string, bool) { return meta.Tag, true })
+
+	case field == "date":
+		t, err := ParseDate(c.value)
+		if err != nil {
+			return nil, err
+		}
+		cmp, err := compareOp(c.op)
+		if err != nil {
+			return nil, fmt.Errorf("invalid operator %q for %q", c.op, c.field)
+		}
+		return func(meta *BackupMeta) bool { return cmp(compareTime(meta.Date, t)) }, nil
+
+	case field == "files":
+		files, err := strconv.ParseInt(c.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number of files %q", c.value)
+		}
+		cmp, err := compareOp(c.op)
+		if err != nil {
+			return nil, fmt.Errorf("invalid operator %q for %q", c.op, c.field)
+		}
+		return func(meta *BackupMeta) bool { return cmp(compareInt64(int64(meta.Files), files)) }, nil
+
+	case field == "size":
+		size, err := humanize.ParseBytes(c.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q: %s", c.value, err)
+		}
+		cmp, err := compareOp(c.op)
+		if err != nil {
+			return nil, fmt.Errorf("invalid operator %q for %q", c.op, c.field)
+		}
+		return func(meta *BackupMeta) bool { return cmp(compareInt64(meta.TotalSize, int64(size))) }, nil
+
+	case strings.HasPrefix(field, "meta.") && len(field) > len("meta."):
+		key := c.field[len("meta."):]
+		value := func(meta *BackupMeta) (string, bool) {
+			v, found := lookupMeta(meta.Meta, key)
+			return metaValueString(v), found
+		}
+		if c.op == "~" || c.op == "!~" {
+			return compileStringCondition(c, value)
+		}
+
+		cmp, err := compareOp(c.op)
+		if err != nil {
+			return nil, fmt.Errorf("invalid operator %q for %q", c.op, c.field)
+		}
+		return func(meta *BackupMeta) bool {
+			v, found := value(meta)
+			if !found {
+				return c.op == "!="
+			}
+			return cmp(compareMetaValues(v, c.value))
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown field %q, use one of: name, tag, date, files, size, meta.KEY", c.field)
+}
+
+// compileStringCondition compiles equality and regexp conditions on a
+// string. Conditions on missing values only match with `!=` and `!~`.
+func compileStringCondition(c exprCondition, value func(meta *BackupMeta) (string, bool)) (BackupFilter, error) {
+	var match func(s string) bool
+	switch c.op {
+	case "=", "!=":
+		match = func(s string) bool { return s == c.value }
+	case "~", "!~":
+		re, err := regexp.Compile(c.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp %q: %s", c.value, err)
+		}
+		match = re.MatchString
+	default:
+		return nil, fmt.Errorf("invalid operator %q for %q", c.op, c.field)
+	}
+
+	negate := c.op == "!=" || c.op == "!~"
+	return func(meta *BackupMeta) bool {
+		v, found := value(meta)
+		if !found {
+			return negate
+		}
+		return match(v) != negate
+	}, nil
+}
+
+// compareMetaValues compares two metadata values as numbers when both
+// are, and as strings otherwise.
+func compareMetaValues(a, b string) int {
+	af, aErr := strconv.ParseFloat(a, 64)
+	bf, bErr := strconv.ParseFloat(b, 64)
+	if aErr == nil && bErr == nil {
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
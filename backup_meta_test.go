@@ -0,0 +1,226 @@
+package pitreos
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPITR_GetBackupMeta(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{
+		"a": testContent(10, 1),
+		"b": testContent(25, 2),
+	})
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	require.NoError(t, pitr.GenerateBackup(source, "prod", map[string]interface{}{"blocknum": 1000000}, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	content, err := readAllAndClose(storage.OpenBackupMeta(list[0]))
+	require.NoError(t, err)
+	var stored *BackupMeta
+	require.NoError(t, json.Unmarshal(content, &stored))
+
+	assert.Equal(t, list[0], stored.Name)
+	assert.Equal(t, "prod", stored.Tag)
+	assert.Equal(t, 2, stored.Files)
+	assert.Equal(t, int64(35), stored.TotalSize)
+	assert.Equal(t, float64(1000000), stored.Meta["blocknum"])
+
+	meta, err := pitr.GetBackupMeta(list[0])
+	require.NoError(t, err)
+	assert.Equal(t, stored, meta)
+
+	// Backups without a metadata object are summarized from their index
+	bi, err := pitr.downloadBackupIndex(list[0])
+	require.NoError(t, err)
+	bi.Tag = ""
+	index, err := yaml.Marshal(bi)
+	require.NoError(t, err)
+	require.NoError(t, storage.WriteBackupIndex("2020-01-01-00-00-00--old", index))
+
+	meta, err = pitr.GetBackupMeta("2020-01-01-00-00-00--old")
+	require.NoError(t, err)
+	assert.Equal(t, "old", meta.Tag)
+	assert.Equal(t, 2, meta.Files)
+	assert.Equal(t, int64(35), meta.TotalSize)
+}
+
+func TestPITR_SearchBackups(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+
+	for i, blocknum := range []int{100, 200, 300} {
+		name := makeBackupName(time.Date(2025, 1, 1+i, 0, 0, 0, 0, time.UTC), "prod")
+		bi := &BackupIndex{Date: time.Date(2025, 1, 1+i, 0, 0, 0, 0, time.UTC), Tag: "prod", Meta: map[string]interface{}{"blocknum": blocknum}}
+		require.NoError(t, pitr.uploadBackupIndexYamlFile(name, bi))
+	}
+	require.NoError(t, pitr.uploadBackupIndexYamlFile("2025-01-05-00-00-00--dev", &BackupIndex{Tag: "dev"}))
+
+	names := func(metas []*BackupMeta) (out []string) {
+		for _, meta := range metas {
+			out = append(out, meta.Name)
+		}
+		return
+	}
+
+	backups, err := pitr.SearchBackups("", BackupTagFilter("prod"), BackupSinceFilter(time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2025-01-02-00-00-00--prod", "2025-01-03-00-00-00--prod"}, names(backups))
+
+	backups, err = pitr.SearchBackups("", BackupMetaFilter("blocknum", "200"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2025-01-02-00-00-00--prod"}, names(backups))
+
+	filter, err := ParseBackupExpression("meta.blocknum < 200 or tag = dev")
+	require.NoError(t, err)
+	backups, err = pitr.SearchBackups("", filter)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2025-01-01-00-00-00--prod", "2025-01-05-00-00-00--dev"}, names(backups))
+
+	backups, err = pitr.SearchBackups("2025-01-03")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2025-01-03-00-00-00--prod"}, names(backups))
+
+	listed, err := pitr.ListBackups(1, 1, "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []*ListableBackup{{Name: "2025-01-02-00-00-00--prod", Meta: map[string]interface{}{"blocknum": float64(200)}}}, listed)
+}
+
+// countingMetaStorage counts the metadata objects read, and fails writing
+// them when failWrites is set
+type countingMetaStorage struct {
+	*DStoreStorage
+	lock       sync.Mutex
+	reads      map[string]int
+	failWrites bool
+}
+
+func (s *countingMetaStorage) OpenBackupMeta(name string) (io.ReadCloser, error) {
+	s.lock.Lock()
+	s.reads[name]++
+	s.lock.Unlock()
+	return s.DStoreStorage.OpenBackupMeta(name)
+}
+
+func (s *countingMetaStorage) WriteBackupMeta(name string, content []byte) error {
+	if s.failWrites {
+		return errors.New("write failed")
+	}
+	return s.DStoreStorage.WriteBackupMeta(name, content)
+}
+
+func TestPITR_SearchBackups_MetaIndex(t *testing.T) {
+	storage := &countingMetaStorage{DStoreStorage: newTestLocalStorage(t), reads: make(map[string]int)}
+	pitr := New(1, 2, time.Minute, storage)
+
+	for i := 0; i < 3; i++ {
+		name := makeBackupName(time.Date(2025, 1, 1+i, 0, 0, 0, 0, time.UTC), "prod")
+		require.NoError(t, pitr.uploadBackupIndexYamlFile(name, &BackupIndex{Tag: "prod"}))
+	}
+
+	backups, err := pitr.SearchBackups("")
+	require.NoError(t, err)
+	assert.Len(t, backups, 3)
+	assert.Equal(t, 1, storage.reads["2025-01-01-00-00-00--prod"])
+
+	content, err := readAllAndClose(storage.DStoreStorage.OpenBackupMeta(backupMetaIndexName))
+	require.NoError(t, err)
+	var indexed []*BackupMeta
+	require.NoError(t, json.Unmarshal(content, &indexed))
+	assert.Len(t, indexed, 3)
+
+	// Only the newer backup is fetched
+	require.NoError(t, pitr.uploadBackupIndexYamlFile("2025-01-04-00-00-00--prod", &BackupIndex{Tag: "prod"}))
+	backups, err = pitr.SearchBackups("", BackupTagFilter("prod"))
+	require.NoError(t, err)
+	assert.Len(t, backups, 4)
+	assert.Equal(t, 1, storage.reads["2025-01-01-00-00-00--prod"])
+	assert.Equal(t, 1, storage.reads["2025-01-04-00-00-00--prod"])
+
+	// Deleted backups are ignored, then dropped from the index
+	require.NoError(t, storage.store.DeleteObject(storage.ctx, storage.indexPath("2025-01-01-00-00-00--prod")))
+	backups, err = pitr.SearchBackups("")
+	require.NoError(t, err)
+	assert.Len(t, backups, 3)
+	assert.Len(t, readBackupMetaIndex(storage), 3)
+}
+
+func TestPITR_GenerateBackup_MetaWriteFailure(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{"a": testContent(10, 1)})
+	storage := &countingMetaStorage{DStoreStorage: newTestLocalStorage(t), reads: make(map[string]int), failWrites: true}
+	pitr := New(1, 2, time.Minute, storage)
+	require.NoError(t, pitr.GenerateBackup(source, "prod", nil, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	meta, err := pitr.GetBackupMeta(list[0])
+	require.NoError(t, err)
+	assert.Equal(t, "prod", meta.Tag)
+	assert.Equal(t, 1, meta.Files)
+}
+
+func TestParseBackupExpression(t *testing.T) {
+	meta := &BackupMeta{
+		Name:      "2025-01-02-00-00-00--prod",
+		Tag:       "prod",
+		Date:      time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC),
+		Files:     3,
+		TotalSize: 2 * 1000 * 1000 * 1000,
+		Meta: map[string]interface{}{
+			"blocknum": float64(1000000),
+			"version":  "v1.8.2",
+			"chain":    map[string]interface{}{"id": "aca376"},
+			"a.b":      "dotted",
+		},
+	}
+
+	tests := []struct {
+		expression string
+		expected   bool
+	}{
+		{"meta.blocknum >= 1000000", true},
+		{"meta.blocknum > 1e6", false},
+		{"meta.blocknum = 1000000", true},
+		{"meta.blocknum < 999999", false},
+		{"meta.version ~ ^v1\\.8", true},
+		{"meta.version = v1.8.2", true},
+		{"meta.chain.id = aca376", true},
+		{"meta.a.b = dotted", true},
+		{"meta.missing = 1", false},
+		{"meta.missing != 1", true},
+		{"meta.missing !~ x", true},
+		{"tag = prod and date < 2025-01-03", true},
+		{"tag != prod or date >= 2025-01-03", false},
+		{"name ~ --prod$", true},
+		{"files > 2 and size >= 2GB", true},
+		{"not size > 1TB", true},
+		{"META.blocknum >= 1", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			filter, err := ParseBackupExpression(test.expression)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, filter(meta))
+		})
+	}
+
+	for _, invalid := range []string{"", "meta.", "blocknum > 1", "tag < prod", "date > never", "files > many", "name ~ ("} {
+		_, err := ParseBackupExpression(invalid)
+		assert.Error(t, err, "expected %q to be invalid", invalid)
+	}
+}
@@ -0,0 +1,97 @@
+package pitreos
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// changingStorage appends to a file of the backup source the first
+// `changes` times a chunk is checked, like an application writing to the
+// file while it is being backed up.
+type changingStorage struct {
+	*DStoreStorage
+	filePath string
+	changes  int
+	checks   int
+}
+
+func (s *changingStorage) ChunkExists(hash string) (bool, error) {
+	s.checks++
+	if s.checks <= s.changes {
+		f, err := os.OpenFile(s.filePath, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return false, err
+		}
+		_, err = f.Write([]byte{1})
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return s.DStoreStorage.ChunkExists(hash)
+}
+
+func TestPITR_GenerateBackup_ChangedFile(t *testing.T) {
+	tests := []struct {
+		name               string
+		changes            int
+		failOnChanged      bool
+		expectError        bool
+		expectInconsistent bool
+		expectChecks       int
+	}{
+		{"unchanged", 0, false, false, false, 1},
+		{"changed once", 1, false, false, false, 2},
+		{"always changing", 100, false, false, true, 3},
+		{"always changing, strict", 100, true, true, false, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := newTestSourceDir(t, map[string][]byte{"state.bin": testContent(100, 1)})
+			storage := &changingStorage{
+				DStoreStorage: newTestLocalStorage(t),
+				filePath:      filepath.Join(source, "state.bin"),
+				changes:       test.changes,
+			}
+			pitr := New(1, 1, time.Minute, storage)
+			pitr.FailOnChangedFiles = test.failOnChanged
+
+			err := pitr.GenerateBackup(source, "dev", nil, AllFileFilter)
+			assert.Equal(t, test.expectChecks, storage.checks)
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			list, err := storage.ListBackups(10, "")
+			require.NoError(t, err)
+			bm, err := pitr.downloadBackupIndex(list[0])
+			require.NoError(t, err)
+			require.Len(t, bm.Files, 1)
+			assert.Equal(t, test.expectInconsistent, bm.Files[0].Inconsistent)
+			if !test.expectInconsistent {
+				assert.Equal(t, int64(100+test.changes), bm.Files[0].TotalSize)
+			}
+		})
+	}
+}
+
+func TestFileStamp_Equal(t *testing.T) {
+	now := time.Now()
+	stamp := fileStamp{size: 10, modTime: now, changeTime: now}
+
+	// The same instants, in another location, or without monotonic clock
+	assert.True(t, stamp.equal(fileStamp{size: 10, modTime: now.UTC(), changeTime: now.Round(0)}))
+	assert.False(t, stamp.equal(fileStamp{size: 11, modTime: now, changeTime: now}))
+	assert.False(t, stamp.equal(fileStamp{size: 10, modTime: now.Add(time.Nanosecond), changeTime: now}))
+	assert.False(t, stamp.equal(fileStamp{size: 10, modTime: now, changeTime: now.Add(time.Second)}))
+}
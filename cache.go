@@ -0,0 +1,488 @@
+package pitreos
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abourget/llerrgroup"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
+)
+
+var ErrNotInCache = errors.New("chunk not in cache")
+
+// CacheStorage is a local, size-limited chunk cache. It is meant to be
+// used through `PITR.SetCacheStorage`, and only stores chunks: backup
+// indexes always come from the main storage.
+//
+// Chunks are stored gzipped under `{dir}/chunks/{sha3}`, like a
+// `file://` DStoreStorage, so existing caches are picked up as-is. They
+// are written to a temporary file first and renamed in place, so a crash
+// never leaves a partial chunk, and they are verified against their hash
+// when read: a corrupted chunk is evicted and reported as missing.
+//
+// When `maxSize` is exceeded, the least recently used chunks are
+// evicted. Access times are tracked through the files' modification
+// time, so they survive restarts.
+type CacheStorage struct {
+	dir     string
+	maxSize int64
+
+	lock    sync.Mutex
+	loaded  bool
+	entries map[string]*cacheEntry
+	size    int64
+	session CacheCounters
+}
+
+type cacheEntry struct {
+	size       int64
+	lastAccess time.Time
+}
+
+// CacheCounters are cumulated across runs in `{dir}/stats.json`. Hits
+// and misses count chunk reads, not ChunkExists probes.
+type CacheCounters struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Writes    int64 `json:"writes"`
+	Evictions int64 `json:"evictions"`
+	Corrupted int64 `json:"corrupted"`
+}
+
+type CacheStats struct {
+	CacheCounters
+	Chunks  int   `json:"chunks"`
+	Size    int64 `json:"size"`
+	MaxSize int64 `json:"max_size"`
+}
+
+// NewCacheStorage creates a cache in `dir`, holding at most `maxSize`
+// bytes of (compressed) chunks. A `maxSize` of 0 means unlimited.
+func NewCacheStorage(dir string, maxSize int64) (*CacheStorage, error) {
+	dir = strings.TrimPrefix(dir, "file://")
+	if err := os.MkdirAll(filepath.Join(dir, "chunks"), 0755); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %s", err)
+	}
+
+	return &CacheStorage{
+		dir:     dir,
+		maxSize: maxSize,
+	}, nil
+}
+
+func (c *CacheStorage) SetTimeout(timeout time.Duration) {}
+
+func (c *CacheStorage) ListBackups(limit int, prefix string) ([]string, error) {
+	return nil, nil
+}
+
+func (c *CacheStorage) OpenBackupIndex(name string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("backup indexes are not cached")
+}
+
+func (c *CacheStorage) WriteBackupIndex(name string, content []byte) error {
+	return fmt.Errorf("backup indexes are not cached")
+}
+
+func (c *CacheStorage) chunkPath(hash string) string {
+	return filepath.Join(c.dir, "chunks", hash)
+}
+
+func (c *CacheStorage) statsPath() string {
+	return filepath.Join(c.dir, "stats.json")
+}
+
+func (c *CacheStorage) ChunkExists(hash string) (bool, error) {
+	if err := c.load(); err != nil {
+		return false, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, found := c.entries[hash]
+	return found, nil
+}
+
+// OpenChunk returns the content of a cached chunk, after verifying it
+// against its hash. Missing or corrupted chunks yield ErrNotInCache.
+func (c *CacheStorage) OpenChunk(hash string) (io.ReadCloser, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	filePath := c.chunkPath(hash)
+	content, err := readAllAndClose(openGZipFile(filePath))
+	if err != nil {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		if os.IsNotExist(err) {
+			c.forget(hash)
+			c.session.Misses++
+			return nil, ErrNotInCache
+		}
+
+		zlog.Warn("cached chunk unreadable, evicting it", zap.String("hash", hash), zap.Error(err))
+		c.evict(hash)
+		c.session.Corrupted++
+		return nil, ErrNotInCache
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if shasum := fmt.Sprintf("%x", sha3.Sum256(content)); shasum != hash {
+		zlog.Warn("cached chunk corrupted, evicting it", zap.String("hash", hash), zap.String("sha3_sum", shasum))
+		c.evict(hash)
+		c.session.Corrupted++
+		return nil, ErrNotInCache
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(filePath, now, now); err != nil {
+		zlog.Debug("cannot update cached chunk access time", zap.String("hash", hash), zap.Error(err))
+	}
+	if entry, found := c.entries[hash]; found {
+		entry.lastAccess = now
+	}
+	c.session.Hits++
+
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (c *CacheStorage) WriteChunk(hash string, content []byte) error {
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	compressed, err := gzipBytes(content)
+	if err != nil {
+		return err
+	}
+
+	if c.maxSize > 0 && int64(len(compressed)) > c.maxSize {
+		zlog.Debug("chunk larger than the cache, not caching it", zap.String("hash", hash))
+		return nil
+	}
+
+	if err := c.writeFileAtomic(c.chunkPath(hash), compressed); err != nil {
+		return fmt.Errorf("writing cached chunk: %s", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.forget(hash)
+	c.entries[hash] = &cacheEntry{size: int64(len(compressed)), lastAccess: time.Now()}
+	c.size += int64(len(compressed))
+	c.session.Writes++
+
+	c.evictOverflow(hash)
+	return nil
+}
+
+// Stats returns the current content of the cache, and the counters
+// cumulated across runs, including the current one.
+func (c *CacheStorage) Stats() (*CacheStats, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	saved, err := c.readCounters()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return &CacheStats{
+		CacheCounters: addCacheCounters(saved, c.session),
+		Chunks:        len(c.entries),
+		Size:          c.size,
+		MaxSize:       c.maxSize,
+	}, nil
+}
+
+// SaveStats adds the counters of the current run to the ones saved in
+// the cache directory.
+func (c *CacheStorage) SaveStats() error {
+	saved, err := c.readCounters()
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	total := addCacheCounters(saved, c.session)
+	c.session = CacheCounters{}
+	c.lock.Unlock()
+
+	cnt, err := json.Marshal(total)
+	if err != nil {
+		return err
+	}
+	return c.writeFileAtomic(c.statsPath(), cnt)
+}
+
+// Clean removes every cached chunk, and resets the counters.
+func (c *CacheStorage) Clean() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, sub := range []string{"chunks", "tmp"} {
+		if err := os.RemoveAll(filepath.Join(c.dir, sub)); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(c.statsPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(c.dir, "chunks"), 0755); err != nil {
+		return err
+	}
+
+	c.entries = make(map[string]*cacheEntry)
+	c.size = 0
+	c.session = CacheCounters{}
+	c.loaded = true
+	return nil
+}
+
+// load scans the cache directory once, to know its content and size.
+func (c *CacheStorage) load() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.loaded {
+		return nil
+	}
+
+	c.removeStaleTemporaryFiles()
+
+	files, err := ioutil.ReadDir(filepath.Join(c.dir, "chunks"))
+	if err != nil {
+		return fmt.Errorf("reading cache directory: %s", err)
+	}
+
+	c.entries = make(map[string]*cacheEntry, len(files))
+	c.size = 0
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		c.entries[f.Name()] = &cacheEntry{size: f.Size(), lastAccess: f.ModTime()}
+		c.size += f.Size()
+	}
+	c.loaded = true
+
+	zlog.Debug("cache loaded", zap.String("dir", c.dir), zap.Int("chunk_count", len(c.entries)), zap.Int64("size", c.size))
+
+	c.evictOverflow("")
+	return nil
+}
+
+// removeStaleTemporaryFiles removes leftovers of writes interrupted by a
+// crash, old enough not to be in-flight writes of another process.
+func (c *CacheStorage) removeStaleTemporaryFiles() {
+	tmpDir := filepath.Join(c.dir, "tmp")
+	files, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if time.Since(f.ModTime()) > time.Hour {
+			os.Remove(filepath.Join(tmpDir, f.Name()))
+		}
+	}
+}
+
+// evictOverflow removes the least recently used chunks, other than
+// `keep`, until the cache fits in its maximum size. Must be called with
+// the lock held.
+func (c *CacheStorage) evictOverflow(keep string) {
+	if c.maxSize <= 0 || c.size <= c.maxSize {
+		return
+	}
+
+	hashes := make([]string, 0, len(c.entries))
+	for hash := range c.entries {
+		if hash != keep {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return c.entries[hashes[i]].lastAccess.Before(c.entries[hashes[j]].lastAccess)
+	})
+
+	for _, hash := range hashes {
+		if c.size <= c.maxSize {
+			break
+		}
+		c.evict(hash)
+	}
+}
+
+// evict removes a chunk from the cache. Must be called with the lock held.
+func (c *CacheStorage) evict(hash string) {
+	if err := os.Remove(c.chunkPath(hash)); err != nil && !os.IsNotExist(err) {
+		zlog.Warn("cannot remove cached chunk", zap.String("hash", hash), zap.Error(err))
+		return
+	}
+
+	if c.forget(hash) {
+		c.session.Evictions++
+	}
+}
+
+// forget removes a chunk from the in-memory index. Must be called with
+// the lock held.
+func (c *CacheStorage) forget(hash string) bool {
+	entry, found := c.entries[hash]
+	if !found {
+		return false
+	}
+
+	c.size -= entry.size
+	delete(c.entries, hash)
+	return true
+}
+
+func (c *CacheStorage) readCounters() (out CacheCounters, err error) {
+	cnt, err := ioutil.ReadFile(c.statsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		return out, err
+	}
+
+	if err := json.Unmarshal(cnt, &out); err != nil {
+		zlog.Warn("ignoring unreadable cache stats", zap.Error(err))
+		return CacheCounters{}, nil
+	}
+	return out, nil
+}
+
+func addCacheCounters(a, b CacheCounters) CacheCounters {
+	return CacheCounters{
+		Hits:      a.Hits + b.Hits,
+		Misses:    a.Misses + b.Misses,
+		Writes:    a.Writes + b.Writes,
+		Evictions: a.Evictions + b.Evictions,
+		Corrupted: a.Corrupted + b.Corrupted,
+	}
+}
+
+func openGZipFile(filePath string) (io.ReadCloser, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return NewGZipReadCloser(f)
+}
+
+// writeFileAtomic writes `content` to a temporary file, syncs it, and
+// renames it to `filePath`.
+func (c *CacheStorage) writeFileAtomic(filePath string, content []byte) error {
+	tmpDir := filepath.Join(c.dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(tmpDir, filepath.Base(filePath)+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// WarmCache downloads to the cache every chunk of the files matching
+// `filter` in the given backup, that the cache doesn't already have.
+func (p *PITR) WarmCache(backupName string, filter Filter) (fetched, existing int, err error) {
+	if p.cacheStorage == nil {
+		return 0, 0, fmt.Errorf("caching is not enabled")
+	}
+
+	bm, err := p.downloadBackupIndex(backupName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	matchingFiles, err := bm.FindFilesMatching(filter)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	hashes := make(map[string]bool)
+	for _, file := range matchingFiles {
+		for _, chunk := range file.Chunks {
+			if !chunk.IsEmpty && chunk.ContentSHA != "" {
+				hashes[chunk.ContentSHA] = true
+			}
+		}
+	}
+
+	eg := llerrgroup.New(p.threads)
+	for hash := range hashes {
+		if eg.Stop() {
+			break
+		}
+
+		hash := hash
+		eg.Go(func() error {
+			found, err := p.cacheStorage.ChunkExists(hash)
+			if err != nil {
+				return err
+			}
+			if found {
+				counterLock.Lock()
+				existing++
+				counterLock.Unlock()
+				return nil
+			}
+
+			data, err := readVerifiedChunk(p.storage, hash)
+			if err != nil {
+				return err
+			}
+			if err := p.cacheStorage.WriteChunk(hash, data); err != nil {
+				return fmt.Errorf("cache storage writechunk: %s", err)
+			}
+
+			counterLock.Lock()
+			fetched++
+			counterLock.Unlock()
+			return nil
+		})
+	}
+
+	return fetched, existing, eg.Wait()
+}
@@ -0,0 +1,219 @@
+package pitreos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestCacheStorage_WriteChunk_OpenChunk(t *testing.T) {
+	cache, _ := newTestCacheStorage(t, 0)
+
+	content := []byte("some chunk")
+	hash := fmt.Sprintf("%x", sha3.Sum256(content))
+
+	exists, err := cache.ChunkExists(hash)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, cache.WriteChunk(hash, content))
+
+	exists, err = cache.ChunkExists(hash)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	cnt, err := readAllAndClose(cache.OpenChunk(hash))
+	require.NoError(t, err)
+	assert.Equal(t, content, cnt)
+
+	_, err = cache.OpenChunk(fmt.Sprintf("%x", sha3.Sum256([]byte("other chunk"))))
+	assert.Equal(t, ErrNotInCache, err)
+
+	// Probes are not counted
+	stats, err := cache.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Chunks)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(1), stats.Writes)
+}
+
+func TestCacheStorage_CorruptedChunkEvicted(t *testing.T) {
+	cache, dir := newTestCacheStorage(t, 0)
+
+	content := []byte("some chunk")
+	hash := fmt.Sprintf("%x", sha3.Sum256(content))
+	require.NoError(t, cache.WriteChunk(hash, []byte("not the right content")))
+
+	_, err := cache.OpenChunk(hash)
+	assert.Equal(t, ErrNotInCache, err)
+
+	exists, err := cache.ChunkExists(hash)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = os.Stat(filepath.Join(dir, "chunks", hash))
+	assert.True(t, os.IsNotExist(err))
+
+	// Garbage on disk
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "chunks", "garbage"), []byte("not gzip"), 0644))
+	cache, err = NewCacheStorage(dir, 0)
+	require.NoError(t, err)
+	_, err = cache.OpenChunk("garbage")
+	assert.Equal(t, ErrNotInCache, err)
+
+	stats, err := cache.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.Chunks)
+	assert.Equal(t, int64(1), stats.Corrupted)
+}
+
+func TestCacheStorage_LRUEviction(t *testing.T) {
+	cache, dir := newTestCacheStorage(t, 0)
+
+	var hashes []string
+	for i := 0; i < 4; i++ {
+		content := testContent(4096, byte(i))
+		hash := fmt.Sprintf("%x", sha3.Sum256(content))
+		require.NoError(t, cache.WriteChunk(hash, content))
+		hashes = append(hashes, hash)
+	}
+
+	stats, err := cache.Stats()
+	require.NoError(t, err)
+	chunkSize := stats.Size / 4
+
+	// Make access order: 1, 0, 3, 2 (oldest first)
+	for i, hash := range []string{hashes[1], hashes[0], hashes[3], hashes[2]} {
+		at := time.Now().Add(time.Duration(i-10) * time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "chunks", hash), at, at))
+	}
+
+	// Reopen with room for 2.5 chunks
+	cache, err = NewCacheStorage(dir, chunkSize*5/2)
+	require.NoError(t, err)
+
+	for i, expected := range []bool{false, false, true, true} {
+		exists, err := cache.ChunkExists(hashes[[]int{1, 0, 3, 2}[i]])
+		require.NoError(t, err)
+		assert.Equal(t, expected, exists, "chunk %d", i)
+	}
+
+	// Reading chunk 3 makes chunk 2 the least recently used one
+	_, err = readAllAndClose(cache.OpenChunk(hashes[3]))
+	require.NoError(t, err)
+
+	content := testContent(4096, 10)
+	hash := fmt.Sprintf("%x", sha3.Sum256(content))
+	require.NoError(t, cache.WriteChunk(hash, content))
+
+	for h, expected := range map[string]bool{hashes[2]: false, hashes[3]: true, hash: true} {
+		exists, err := cache.ChunkExists(h)
+		require.NoError(t, err)
+		assert.Equal(t, expected, exists)
+	}
+
+	stats, err = cache.Stats()
+	require.NoError(t, err)
+	assert.True(t, stats.Size <= stats.MaxSize)
+	assert.Equal(t, int64(3), stats.Evictions)
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestCacheStorage_SaveStats(t *testing.T) {
+	cache, dir := newTestCacheStorage(t, 0)
+
+	content := []byte("some chunk")
+	hash := fmt.Sprintf("%x", sha3.Sum256(content))
+	require.NoError(t, cache.WriteChunk(hash, content))
+	require.NoError(t, cache.SaveStats())
+
+	cache, err := NewCacheStorage(dir, 0)
+	require.NoError(t, err)
+	_, err = readAllAndClose(cache.OpenChunk(hash))
+	require.NoError(t, err)
+	require.NoError(t, cache.SaveStats())
+
+	stats, err := cache.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Writes)
+	assert.Equal(t, int64(1), stats.Hits)
+
+	require.NoError(t, cache.Clean())
+	stats, err = cache.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, CacheStats{}, *stats)
+}
+
+func TestPITR_RestoreFromCorruptedCache(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	cache, dir := newTestCacheStorage(t, 0)
+
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.SetCacheStorage(cache)
+
+	source := newTestSourceDir(t, map[string][]byte{"a.bin": testContent(1024, 1)})
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "chunks"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "chunks", files[0].Name()), []byte("corrupted"), 0644))
+
+	restoreDir := newTestSourceDir(t, nil)
+	require.NoError(t, pitr.RestoreFromBackup(restoreDir, list[0], AllFileFilter))
+	assertSameFiles(t, source, restoreDir, "a.bin")
+
+	fetched, existing, err := pitr.WarmCache(list[0], AllFileFilter)
+	require.NoError(t, err)
+	assert.Equal(t, 0, fetched)
+	assert.Equal(t, 1, existing)
+}
+
+func newTestCacheStorage(t *testing.T, maxSize int64) (*CacheStorage, string) {
+	dir, err := ioutil.TempDir("", "pitreos-cache")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cache, err := NewCacheStorage(dir, maxSize)
+	require.NoError(t, err)
+	return cache, dir
+}
+
+func TestPITR_RestoreFromDStoreCache(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	cache := newTestLocalStorage(t)
+
+	pitr := New(1, 2, time.Minute, storage)
+	source := newTestSourceDir(t, map[string][]byte{"a.bin": testContent(2*1024*1024, 1)})
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+
+	bi, err := pitr.downloadBackupIndex(list[0])
+	require.NoError(t, err)
+	corrupted := bi.Files[0].Chunks[0].ContentSHA
+	require.NoError(t, cache.WriteChunk(corrupted, []byte("corrupted")))
+
+	// Missing and corrupted chunks are downloaded, and cached again
+	pitr.SetCacheStorage(cache)
+	restoreDir := newTestSourceDir(t, nil)
+	require.NoError(t, pitr.RestoreFromBackup(restoreDir, list[0], AllFileFilter))
+	assertSameFiles(t, source, restoreDir, "a.bin")
+
+	_, err = readVerifiedChunk(cache, corrupted)
+	require.NoError(t, err)
+}
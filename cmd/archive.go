@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveCompression returns the compression to use for `filename`,
+// when `compression` is "auto".
+func archiveCompression(compression, filename string) string {
+	if compression != "auto" {
+		return compression
+	}
+
+	switch {
+	case strings.HasSuffix(filename, ".zst"), strings.HasSuffix(filename, ".tzst"):
+		return "zstd"
+	case strings.HasSuffix(filename, ".gz"), strings.HasSuffix(filename, ".tgz"):
+		return "gzip"
+	}
+	return "none"
+}
+
+// compressWriter wraps `w` with the given compression. Closing the
+// returned writer flushes the compressed stream, but doesn't close `w`.
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "none":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q, use one of: auto, none, gzip, zstd", compression)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompressReader detects the compression of `r` (gzip, zstd or none)
+// from its first bytes, and returns a reader of its decompressed content.
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReaderSize(r, 1024*1024)
+	magic, err := buffered.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{decoder}, nil
+	}
+	return nopReadCloser{buffered}, nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+type nopReadCloser struct {
+	io.Reader
+}
+
+func (nopReadCloser) Close() error { return nil }
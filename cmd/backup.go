@@ -12,7 +12,7 @@ var metadataJSON string
 var backupTag string
 
 var backupCmd = &cobra.Command{
-	Use:   "backup {local_dir} <filter>",
+	Use:   "backup {local_dir | name=dir,othername=otherdir} <filter>",
 	Short: "Backs up your files differentially",
 	Example: `  pitreos backup mydata -s gs://mybackups/projectname -t dev -c --metadata '{"blocknum": 123456, "version": "1.2.1"}'
 
@@ -20,13 +20,52 @@ var backupCmd = &cobra.Command{
     The uploaded chunks will be kept in a local cache for faster restore.
     The "dev" tag can be used to differentiate backups that will share their chunks.
     The metadata will be attached to the backup and shown when listing backups with '--long' flag.
+
+  pitreos backup blocks=/mnt/a/blocks,state=/mnt/b/state -s gs://mybackups/nodeos
+
+    This will back up both directories together, in a single point-in-time backup,
+    as the "blocks" and "state" roots.
 `,
 	Long: `Backs up your files by slicing them into chunks and comparing
 their hashes with those present at the destination.
 This approach is optimized for large files.
 
+Several directories can be backed up together by giving them names, like
+'blocks=/mnt/a/blocks,state=/mnt/b/state'. Their files are recorded, and
+matched against the filter, as 'blocks/...' and 'state/...'.
+
 Optionally specify a 'filter' argument to only show files matching the filter arguments.
-The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when provided.`,
+The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when provided.
+Files can also be selected with '--include' and '--exclude' glob patterns (see 'pitreos help filters').
+Files excluded by a '.pitreosignore' file at the root of the source are skipped.
+
+Backups of a tag hold a lock on it, renewed while they run, so that two
+backups of the same tag can't run concurrently. A lock not renewed for
+'--lock-ttl' expires. See 'pitreos locks' to inspect and break locks, and
+'--no-lock' to back up without taking one.
+
+Files being written to while backed up, like the state of a running
+nodeos, can be backed up as they were when their backup started with
+'--snapshot reflink': each file is first cloned with a reflink (FICLONE,
+on XFS formatted with 'reflink=1' or Btrfs), instantly and without using
+space, and the clone is backed up, then deleted. The backup fails when
+the filesystem doesn't support reflinks, while '--snapshot auto' backs up
+such files as they are.
+
+Files matching '--appendonly-files' globs (like 'blocks/*.log' or
+'**/blocks.log') are backed up on top of their previous backup in the tag,
+only reading what was appended to them, once the last chunk of their
+previous backup, and '--appendonly-samples' others picked at random, are
+found unchanged. Files failing these checks are backed up entirely. With
+'--appendonly-auto', other files passing them are detected as append-only.
+Changes to chunks not checked would go unnoticed: use '--appendonly-samples -1'
+to check them all. The backup index records how each append-only file was
+checked.
+
+Files changing while being read are read again, up to '--changed-retries'
+times. When they still change, they are marked inconsistent in the backup
+index, and flagged when listing the files of the backup, or fail the
+backup with '--strict'.`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 
@@ -35,29 +74,58 @@ The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when p
 		errorCheck("unmarshaling --meta", err)
 
 		pitr := getPITR(viper.GetString("store"))
+		pitr.LockTTL = viper.GetDuration("backup-lock-ttl")
+		if viper.GetBool("backup-no-lock") {
+			pitr.LockTTL = 0
+		}
+		pitr.Snapshot, err = pitreos.ParseSnapshotMode(viper.GetString("backup-snapshot"))
+		errorCheck("parsing --snapshot", err)
+		pitr.AppendonlyAuto = viper.GetBool("backup-appendonly-auto")
+		pitr.ChangedFileRetries = viper.GetInt("backup-changed-retries")
+		pitr.FailOnChangedFiles = viper.GetBool("backup-strict")
 
 		stringFilter := ""
 		if len(args) > 1 {
 			stringFilter = args[1]
 		}
 
-		filter, err := pitreos.NewIncludeThanExcludeFilter(stringFilter, "")
-		errorCheck("unable to create include filter", err)
+		filter := getFilter(stringFilter)
+
+		if pitreos.IsRootsSpec(args[0]) {
+			roots, err := pitreos.ParseRoots(args[0])
+			errorCheck("parsing source roots", err)
 
-		err = pitr.GenerateBackup(args[0], viper.GetString("tag"), metadata, filter)
-		errorCheck("storing backup", err)
+			err = pitr.GenerateBackupFromRoots(roots, viper.GetString("tag"), metadata, filter)
+			errorCheck("storing backup", err)
+		} else {
+			err = pitr.GenerateBackup(args[0], viper.GetString("tag"), metadata, filter)
+			errorCheck("storing backup", err)
+		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(backupCmd)
+	addFilterFlags(backupCmd)
 
 	backupCmd.Flags().StringP("meta", "m", `{}`, "Additional metadata in JSON format to store with backup")
 	backupCmd.Flags().StringP("tag", "t", "default", "Backup tag, appended to timestamp")
 
+	backupCmd.Flags().Bool("no-lock", false, "Back up without locking the tag")
+	backupCmd.Flags().Duration("lock-ttl", pitreos.DefaultLockTTL, "Time after which the lock on the tag expires, unless renewed")
+	backupCmd.Flags().Bool("appendonly-auto", false, "Detect append-only files, besides --appendonly-files, by checking that their previous backup is still at their start")
+	backupCmd.Flags().Int("changed-retries", pitreos.DefaultChangedFileRetries, "Number of times files changing while being read are read again")
+	backupCmd.Flags().Bool("strict", false, "Fail the backup when files still change after --changed-retries, instead of marking them inconsistent")
+	backupCmd.Flags().String("snapshot", "off", "Back up reflink clones of files: off, reflink (fail when unsupported) or auto (back up files as they are when unsupported)")
+
 	for _, flag := range []string{"meta", "tag"} {
 		if err := viper.BindPFlag(flag, backupCmd.Flags().Lookup(flag)); err != nil {
 			panic(err)
 		}
 	}
+	for _, flag := range []string{"no-lock", "lock-ttl", "snapshot", "appendonly-auto", "changed-retries", "strict"} {
+		if err := viper.BindPFlag("backup-"+flag, backupCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
 }
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dustin/go-humanize"
+	"github.com/eoscanada/pitreos"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspects and manages the local chunks cache",
+	Long: `Inspects and manages the local chunks cache, located in '--cache-dir'
+and used when '--enable-caching' is set.`,
+}
+
+var cacheStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Shows the content and usage counters of the cache",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cacheStorage = getCacheStorage()
+
+		stats, err := cacheStorage.Stats()
+		errorCheck("reading cache stats", err)
+
+		maxSize := "unlimited"
+		if stats.MaxSize > 0 {
+			maxSize = humanize.Bytes(uint64(stats.MaxSize))
+		}
+
+		fmt.Printf("Cache directory: %s\n", viper.GetString("cache-dir"))
+		fmt.Printf("Chunks:          %d\n", stats.Chunks)
+		fmt.Printf("Size:            %s (max: %s)\n", humanize.Bytes(uint64(stats.Size)), maxSize)
+		fmt.Printf("Hits:            %d\n", stats.Hits)
+		fmt.Printf("Misses:          %d\n", stats.Misses)
+		fmt.Printf("Writes:          %d\n", stats.Writes)
+		fmt.Printf("Evictions:       %d\n", stats.Evictions)
+		fmt.Printf("Corrupted:       %d\n", stats.Corrupted)
+	},
+}
+
+var cacheCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Removes every chunk from the cache",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cache := getCacheStorage()
+		errorCheck("cleaning cache", cache.Clean())
+
+		fmt.Printf("Cache %q cleaned\n", viper.GetString("cache-dir"))
+	},
+}
+
+var cacheWarmCmd = &cobra.Command{
+	Use:   "warm [tag|backup name] <filter>",
+	Short: "Downloads the chunks of a backup to the cache, ahead of a restore",
+	Example: `  pitreos cache warm 2018-08-28-18-15-45--default -s gs://mybackups/nodeos
+`,
+	Long: `Downloads to the cache every chunk of a backup it doesn't already have,
+so that a later restore doesn't need to reach the storage.
+
+Optionally specify a 'filter' argument to only download chunks of files matching the filter arguments.
+The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when provided.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		pitr := getPITR(viper.GetString("store"))
+		if cacheStorage == nil {
+			cacheStorage = getCacheStorage()
+			pitr.SetCacheStorage(cacheStorage)
+		}
+
+		stringFilter := ""
+		if len(args) > 1 {
+			stringFilter = args[1]
+		}
+
+		filter, err := pitreos.NewIncludeThanExcludeFilter(stringFilter, "")
+		errorCheck("unable to create include filter", err)
+
+		backupName := resolveBackupName(pitr, args[0])
+		fetched, existing, err := pitr.WarmCache(backupName, filter)
+		errorCheck("warming cache", err)
+
+		fmt.Printf("Cached %d chunks, %d were already cached\n", fetched, existing)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheStatsCmd, cacheCleanCmd, cacheWarmCmd)
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var catCmd = &cobra.Command{
+	Use:   "cat [tag|backup name] {filename}",
+	Short: "Writes the content of a single file of a backup to stdout",
+	Example: `  pitreos cat 2018-08-28-18-15-45--default config.ini
+
+  pitreos cat default state/shared_memory.bin --offset 1048576 --length 4096 | xxd
+
+  pitreos cat default blocks/blocks.log -o /tmp/blocks.log
+`,
+	Long: `Writes the content of a single file of a backup to stdout (or to
+'--output'), without restoring the backup. The file is assembled from its
+chunks as it is written, and empty chunks are written as zeros.
+
+Use '--offset' and '--length' to only get part of the file: only the
+chunks covering that range are downloaded.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		pitr := getPITR(viper.GetString("store"))
+		backupName := resolveBackupName(pitr, args[0])
+
+		reader, err := pitr.OpenFile(backupName, args[1])
+		errorCheck("opening file", err)
+
+		offset := viper.GetInt64("cat-offset")
+		if offset > 0 {
+			_, err := reader.Seek(offset, io.SeekStart)
+			errorCheck("seeking to offset", err)
+		}
+
+		var src io.Reader = reader
+		if length := viper.GetInt64("cat-length"); length > 0 {
+			src = io.LimitReader(reader, length)
+		}
+
+		out := os.Stdout
+		if output := viper.GetString("cat-output"); output != "" && output != "-" {
+			out, err = os.Create(output)
+			errorCheck("creating output file", err)
+			defer out.Close()
+		}
+
+		_, err = io.Copy(out, src)
+		errorCheck("writing file content", err)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(catCmd)
+
+	catCmd.Flags().Int64("offset", 0, "Offset in bytes to start reading the file at")
+	catCmd.Flags().Int64("length", 0, "Number of bytes to read (default: up to the end of the file)")
+	catCmd.Flags().StringP("output", "o", "", "Write to this path instead of stdout")
+
+	// Bound under their own keys, `list` also has an `--offset` flag
+	for _, flag := range []string{"offset", "length", "output"} {
+		if err := viper.BindPFlag("cat-"+flag, catCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/eoscanada/pitreos"
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
@@ -22,8 +24,8 @@ func errorCheck(prefix string, err error) {
 
 func getPITR(storageURL string) *pitreos.PITR {
 	ctx := context.Background()
-	storage, err := pitreos.NewDStoreStorage(ctx, storageURL)
-	errorCheck("setting up storage", err)
+	storage := getStorage(ctx, storageURL)
+	storage = withPeers(storage)
 
 	appendonlyFiles := viper.GetStringSlice("appendonly-files")
 	chunkSize := viper.GetInt64("chunk-size")
@@ -40,23 +42,148 @@ func getPITR(storageURL string) *pitreos.PITR {
 
 	pitr := pitreos.New(chunkSize, threads, transferTimeout, storage)
 	pitr.AppendonlyFiles = appendonlyFiles
+	pitr.VerifyAppendonly = viper.GetBool("appendonly-verify")
+	pitr.AppendonlySampledChunks = viper.GetInt("appendonly-samples")
+	pitr.Hooks = pitreos.Hooks{
+		PreBackup:   viper.GetString("pre-backup-hook"),
+		PostBackup:  viper.GetString("post-backup-hook"),
+		PreRestore:  viper.GetString("pre-restore-hook"),
+		PostRestore: viper.GetString("post-restore-hook"),
+		OnFailure:   viper.GetString("on-failure-hook"),
+	}
 
 	if viper.GetBool("enable-caching") {
 		zlog.Debug("Caching enabled")
-		cacheStorage, _ := pitreos.NewDStoreStorage(ctx, viper.GetString("cache-dir"))
+		cacheStorage = getCacheStorage()
 		pitr.SetCacheStorage(cacheStorage)
 	}
 
 	return pitr
 }
 
+// cacheStorage is set when caching is enabled, to save its stats once
+// the command completed.
+var cacheStorage *pitreos.CacheStorage
+
+func getCacheStorage() *pitreos.CacheStorage {
+	var maxSize uint64
+	if size := viper.GetString("cache-max-size"); size != "" && size != "0" {
+		var err error
+		maxSize, err = humanize.ParseBytes(size)
+		errorCheck("parsing --cache-max-size", err)
+	}
+
+	cache, err := pitreos.NewCacheStorage(viper.GetString("cache-dir"), int64(maxSize))
+	errorCheck("setting up cache", err)
+	return cache
+}
+
+// getStorage sets up the storage at `storageURL`, replicated on the
+// `--replicas` stores when any are configured.
+func getStorage(ctx context.Context, storageURL string) pitreos.Storage {
+	storage, err := pitreos.NewStorage(ctx, storageURL)
+	errorCheck("setting up storage", err)
+
+	replicaURLs := viper.GetStringSlice("replicas")
+	if len(replicaURLs) == 0 {
+		return storage
+	}
+
+	backends := []pitreos.Storage{storage}
+	for _, replicaURL := range replicaURLs {
+		replica, err := pitreos.NewStorage(ctx, replicaURL)
+		errorCheck(fmt.Sprintf("setting up replica storage %q", replicaURL), err)
+		backends = append(backends, replica)
+	}
+
+	replicated, err := pitreos.NewReplicatedStorage(viper.GetInt("write-quorum"), backends...)
+	errorCheck("setting up replicated storage", err)
+	replicated.ReadFastest = viper.GetBool("read-fastest")
+
+	zlog.Info("replicating storage",
+		zap.Strings("replica_urls", replicaURLs),
+		zap.Int("write_quorum", viper.GetInt("write-quorum")),
+		zap.Bool("read_fastest", replicated.ReadFastest),
+	)
+
+	return replicated
+}
+
+// withPeers puts the `--peers` caches in front of `storage`, when any
+// are configured.
+func withPeers(storage pitreos.Storage) pitreos.Storage {
+	peerURLs := viper.GetStringSlice("peers")
+	if len(peerURLs) == 0 {
+		return storage
+	}
+
+	peerTimeout := time.Second * time.Duration(viper.GetInt("peer-timeout"))
+	var peers []pitreos.Storage
+	for _, peerURL := range peerURLs {
+		peer := pitreos.NewHTTPStorage(peerURL)
+		peer.SetTimeout(peerTimeout)
+		peers = append(peers, peer)
+	}
+
+	zlog.Info("reading chunks from peers first", zap.Strings("peer_urls", peerURLs), zap.Duration("peer_timeout", peerTimeout))
+	return pitreos.NewPeerStorage(storage, peers...)
+}
+
+// backupAt and backupBeforeMetas hold the `--at` and `--before-meta`
+// flags of commands added with addBackupSelectionFlags.
+var backupAt string
+var backupBeforeMetas []string
+
+func addBackupSelectionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&backupAt, "at", "", "Use the newest backup with the given tag made at or before this time (RFC3339, like 2025-01-01T12:00:00Z)")
+	cmd.Flags().StringArrayVar(&backupBeforeMetas, "before-meta", nil, "Use the newest backup with the given tag whose metadata value is at or below this one, like blocknum=123456 (repeatable)")
+}
+
 func resolveBackupName(pitr *pitreos.PITR, backupName string) string {
 	// We assume it's a full backup name
 	if strings.Contains(backupName, "--") {
+		if backupAt != "" || len(backupBeforeMetas) != 0 {
+			errorCheck("selecting backup", fmt.Errorf("--at and --before-meta select a backup of a tag, not of full backup name %q", backupName))
+		}
 		return backupName
 	}
 
-	fmt.Println("Fetching latest backup")
+	if backupAt != "" || len(backupBeforeMetas) != 0 {
+		criteria := pitreos.BackupCriteria{Tag: backupName}
+		if backupAt != "" {
+			at, err := pitreos.ParseDate(backupAt)
+			errorCheck("invalid --at time", err)
+			criteria.At = at
+		}
+
+		criteria.BeforeMeta = make(map[string]string)
+		for _, kv := range backupBeforeMetas {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				errorCheck("finding backup", fmt.Errorf("invalid --before-meta %q, use key=value", kv))
+			}
+			criteria.BeforeMeta[parts[0]] = parts[1]
+		}
+
+		fmt.Fprintln(os.Stderr, "Finding backup")
+		found, err := pitr.FindBackup(criteria)
+		errorCheck("finding backup", err)
+
+		fmt.Fprintf(os.Stderr, "Found backup %q\n", found)
+		return found
+	}
+
+	if tag, channel, ok := pitreos.ParseChannel(backupName); ok {
+		fmt.Fprintf(os.Stderr, "Following channel %q of tag %q\n", channel, tag)
+		found, err := pitr.ResolveChannel(tag, channel)
+		errorCheck("resolving channel", err)
+
+		fmt.Fprintf(os.Stderr, "Found backup %q\n", found)
+		return found
+	}
+
+	// Not on stdout, which can be piped (see `cat`)
+	fmt.Fprintln(os.Stderr, "Fetching latest backup")
 	lastBackup, err := pitr.GetLatestBackup(backupName)
 	errorCheck("Getting last available backup", err)
 
@@ -64,6 +191,6 @@ func resolveBackupName(pitr *pitreos.PITR, backupName string) string {
 		errorCheck("getting last backups", errors.New("last available backup found empty"))
 	}
 
-	fmt.Printf("Found latest backup %q\n", lastBackup)
+	fmt.Fprintf(os.Stderr, "Found latest backup %q\n", lastBackup)
 	return lastBackup
 }
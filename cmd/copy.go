@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/dustin/go-humanize"
+	"github.com/eoscanada/pitreos"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var copyCmd = &cobra.Command{
+	Use:   "copy [tag|backup name]...",
+	Short: "Copies backups, and the chunks they need, from one store to another",
+	Example: `  pitreos copy dev --from gs://prod-backups/nodeos --to gs://dev-backups/nodeos
+
+    This will copy the latest backup with the "dev" tag to the dev bucket.
+
+  pitreos copy --all --from gs://old-bucket/nodeos --to s3://new-bucket/nodeos?region=us-east-1
+
+    This will copy every backup of the old bucket to the new one.
+`,
+	Long: `Copies backups from the '--from' store (default: '--store') to the '--to' store.
+Only the chunks missing at the destination are transferred, and they are
+verified against their hash while being copied.
+
+Each argument is either a full backup name, or a tag resolving to its
+latest backup. With '--all', every backup of the given tags (or every
+backup when no tag is given) is copied.
+
+An interrupted copy can be run again: it resumes where it stopped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		all := viper.GetBool("all")
+		if len(args) == 0 && !all {
+			errorCheck("copying backups", fmt.Errorf("specify backups or tags to copy, or --all"))
+		}
+
+		to := viper.GetString("to")
+		if to == "" {
+			errorCheck("copying backups", fmt.Errorf("specify a destination store with --to"))
+		}
+
+		from := viper.GetString("from")
+		if from == "" {
+			from = viper.GetString("store")
+		}
+
+		pitr := getPITR(from)
+		dest, err := pitreos.NewStorage(context.Background(), to)
+		errorCheck("setting up destination storage", err)
+
+		var backupNames []string
+		if all {
+			list, err := pitr.ListBackups(math.MaxInt32, 0, "", false)
+			errorCheck("listing backups", err)
+
+			for _, b := range list {
+				if len(args) == 0 || matchesAnyTag(b.Name, args) {
+					backupNames = append(backupNames, b.Name)
+				}
+			}
+		} else {
+			for _, arg := range args {
+				backupNames = append(backupNames, resolveBackupName(pitr, arg))
+			}
+		}
+
+		fmt.Printf("Copying %d backups from %q to %q\n", len(backupNames), from, to)
+		stats, err := pitr.CopyBackups(dest, backupNames)
+		if stats != nil {
+			fmt.Printf("Copied %d backups (%d already present), %d chunks (%s), %d chunks already present\n",
+				stats.Backups, stats.SkippedBackups, stats.CopiedChunks, humanize.Bytes(uint64(stats.CopiedBytes)), stats.ExistingChunks)
+		}
+		errorCheck("copying backups", err)
+	},
+}
+
+func matchesAnyTag(backupName string, tags []string) bool {
+	_, backupTag, err := pitreos.ParseBackupName(backupName)
+	if err != nil {
+		return false
+	}
+
+	for _, tag := range tags {
+		if backupTag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	RootCmd.AddCommand(copyCmd)
+
+	copyCmd.Flags().String("from", "", "Source storage URL (default: --store)")
+	copyCmd.Flags().String("to", "", "Destination storage URL")
+	copyCmd.Flags().Bool("all", false, "Copy every backup of the given tags, instead of only the latest one")
+
+	for _, flag := range []string{"from", "to", "all"} {
+		if err := viper.BindPFlag(flag, copyCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
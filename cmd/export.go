@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export [tag|backup name] <filter>",
+	Short: "Exports the files of a backup as a tar archive",
+	Example: `  pitreos export 2018-08-28-18-15-45--default -o backup.tar.zst
+
+  pitreos export default 'state/.*' | tar -tvf -
+`,
+	Long: `Exports the files of a backup as a tar archive, written to '--output'
+(default: stdout), without restoring the backup.
+
+Files with empty chunks are written as GNU sparse entries, so their holes
+take no room in the archive, and are restored as holes by GNU tar.
+
+The archive is compressed according to '--compression', which defaults
+to guessing from the '--output' extension (.zst, .gz).
+
+Optionally specify a 'filter' argument to only export files matching the filter arguments.
+The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when provided.
+Files can also be selected with '--include', '--exclude' and '--match', see
+'pitreos help filters'.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		pitr := getPITR(viper.GetString("store"))
+		backupName := resolveBackupName(pitr, args[0])
+
+		stringFilter := ""
+		if len(args) > 1 {
+			stringFilter = args[1]
+		}
+
+		filter := getFilter(stringFilter)
+
+		// Files are written next to '--output', and only renamed to it once
+		// complete, so a failed export leaves no partial archive behind
+		output := viper.GetString("export-output")
+		out := os.Stdout
+		var tmpPath string
+		if output != "" && output != "-" {
+			tmpPath = fmt.Sprintf("%s.tmp-%d", output, os.Getpid())
+			var err error
+			out, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+			errorCheck("creating output file", err)
+		}
+		check := func(prefix string, err error) {
+			if err != nil && tmpPath != "" {
+				out.Close()
+				os.Remove(tmpPath)
+			}
+			errorCheck(prefix, err)
+		}
+
+		w, err := compressWriter(out, archiveCompression(viper.GetString("export-compression"), output))
+		check("setting up compression", err)
+
+		check("exporting backup", pitr.ExportBackup(w, backupName, filter))
+		check("flushing compressed archive", w.Close())
+		check("closing output", out.Close())
+
+		if tmpPath != "" {
+			check("moving archive in place", os.Rename(tmpPath, output))
+			fmt.Printf("Backup %q exported to %q\n", backupName, output)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+	addFilterFlags(exportCmd)
+
+	exportCmd.Flags().StringP("output", "o", "", "Write the archive to this path instead of stdout")
+	exportCmd.Flags().String("compression", "auto", "Compression of the archive: auto, none, gzip or zstd")
+
+	// Bound under their own keys, `cat` also has an `--output` flag
+	for _, flag := range []string{"output", "compression"} {
+		if err := viper.BindPFlag("export-"+flag, exportCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package cmd
 import (
 	"fmt"
 
-	"github.com/eoscanada/pitreos"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -13,12 +12,15 @@ var filesCmd = &cobra.Command{
 	Short: "Lists available files in the specified backup on the selected storage",
 	Example: `
   pitreos files 2018-08-28-18-15-45--default
+  pitreos files default --at 2018-08-28T12:00:00Z
 `,
 	Long: `List available files in the closest available backup before
-the requested timestamp (default: now).
+the requested timestamp (default: now), given with '--at', or with
+'--before-meta' like 'pitreos restore'.
 
 Optionally specify a 'filter' argument to only show files matching the filter arguments.
-The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when provided.`,
+The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when provided.
+Files can also be selected with '--include' and '--exclude' glob patterns (see 'pitreos help filters').`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 
@@ -31,8 +33,7 @@ The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when p
 			stringFilter = args[1]
 		}
 
-		filter, err := pitreos.NewIncludeThanExcludeFilter(stringFilter, "")
-		errorCheck("unable to create include filter", err)
+		filter := getFilter(stringFilter)
 
 		fmt.Printf("Listing backup %q files (filter %s)\n", backupName, filter)
 		resolvedName := resolveBackupName(pitr, backupName)
@@ -40,11 +41,13 @@ The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when p
 			fmt.Printf("Resolved backup name input to %q\n", resolvedName)
 		}
 
-		err = pitr.ListBackupFiles(resolvedName, filter)
+		err := pitr.ListBackupFiles(resolvedName, filter)
 		errorCheck("listing backup's files", err)
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(filesCmd)
+	addFilterFlags(filesCmd)
+	addBackupSelectionFlags(filesCmd)
 }
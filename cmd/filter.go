@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eoscanada/pitreos"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// filterRules collects the `--include` and `--exclude` flags of the
+// running command, in the order they were given.
+var filterRules []string
+
+type filterRulesFlag struct {
+	include bool
+}
+
+func (f filterRulesFlag) String() string { return "" }
+func (f filterRulesFlag) Type() string   { return "pattern" }
+
+func (f filterRulesFlag) Set(pattern string) error {
+	if f.include {
+		filterRules = append(filterRules, pitreos.IncludeRule(pattern))
+	} else {
+		filterRules = append(filterRules, pitreos.ExcludeRule(pattern))
+	}
+	return nil
+}
+
+func addFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().Var(filterRulesFlag{include: true}, "include", "Include files matching this glob pattern (repeatable, see 'pitreos help filters')")
+	cmd.Flags().Var(filterRulesFlag{include: false}, "exclude", "Exclude files matching this glob pattern (repeatable, see 'pitreos help filters')")
+	cmd.Flags().StringArrayVar(&filterExpressions, "match", nil, "Only consider files matching this expression on their size, mtime, kind, name or path, like 'size > 1GB and kind != sparse' (repeatable, see 'pitreos help filters')")
+}
+
+// filterExpressions collects the `--match` flags of the running command.
+var filterExpressions []string
+
+// getFilter combines the 'filter' regexp argument of a command with the
+// `filter-rules` of the config file, the `--include` and `--exclude`
+// flags and the `--match` expressions.
+func getFilter(stringFilter string) pitreos.Filter {
+	regexpFilter, err := pitreos.NewIncludeThanExcludeFilter(stringFilter, "")
+	errorCheck("unable to create include filter", err)
+
+	configRules := viper.GetStringSlice("filter-rules")
+	if len(configRules) == 0 && len(filterRules) == 0 && len(filterExpressions) == 0 {
+		return regexpFilter
+	}
+
+	combined := &combinedFilter{filters: []pitreos.Filter{regexpFilter}}
+	if len(configRules) != 0 || len(filterRules) != 0 {
+		configFilter, err := pitreos.NewRuleFilter(configRules)
+		errorCheck("unable to create filter-rules of config file", err)
+		flagsFilter, err := pitreos.NewRuleFilter(filterRules)
+		errorCheck("unable to create filter rules", err)
+		// Command-line rules win over the config file ones
+		combined.filters = append(combined.filters, configFilter.Then(flagsFilter))
+	}
+
+	for _, expression := range filterExpressions {
+		exprFilter, err := pitreos.ParseFilterExpression(expression)
+		errorCheck(fmt.Sprintf("invalid --match expression %q", expression), err)
+		combined.filters = append(combined.filters, exprFilter)
+		combined.expressions = append(combined.expressions, expression)
+	}
+
+	return combined
+}
+
+type combinedFilter struct {
+	filters     []pitreos.Filter
+	expressions []string
+}
+
+// Match tells whether a file could match on its path alone, see
+// pitreos.And.
+func (f *combinedFilter) Match(relativePath string) bool {
+	return pitreos.And(f.filters...).Match(relativePath)
+}
+
+func (f *combinedFilter) MatchAttributes(relativePath string, attrs pitreos.FileAttributes) bool {
+	return pitreos.And(f.filters...).MatchAttributes(relativePath, attrs)
+}
+
+func (f *combinedFilter) String() string {
+	var parts []string
+	for _, filter := range f.filters {
+		if stringer, ok := filter.(fmt.Stringer); ok {
+			parts = append(parts, stringer.String())
+		}
+	}
+	for _, expression := range f.expressions {
+		parts = append(parts, fmt.Sprintf("[Match %s]", expression))
+	}
+	return strings.Join(parts, " ")
+}
+
+var filtersHelpCmd = &cobra.Command{
+	Use:   "filters",
+	Short: "How to select files with '--include', '--exclude' and '--match'",
+	Long: `Commands working on files ('backup', 'restore', 'files', 'export' and
+'import') take an optional 'filter' argument, a Golang Regexp matched
+against file names, and any number of '--include' and '--exclude' glob
+patterns.
+
+Patterns follow the '.gitignore' syntax:
+
+  *.log             any file (or directory) named *.log, at any depth
+  /state/*.bin      leading or inner slash: relative to the root only
+  reversible/       trailing slash: only matches directories
+  **/tmp/**         '**' matches any number of directories
+
+Rules are evaluated in order, the last matching one wins. Files matching
+no rule are included, unless the first rule is an '--include': then only
+files matching an '--include' are.
+
+Rules can also be set in the config file ('.pitreos.yaml'), under
+'filter-rules', in the '.gitignore' syntax ('!pattern' includes back
+files). They are evaluated before the command-line ones, so these win:
+'--include' re-includes files the config file excludes, and when the
+first command-line rule is an '--include', only files matching an
+'--include' (or a config file '!pattern') are.
+
+When backing up, a '.pitreosignore' file at the root of the source
+directory (or of each root) holds '.gitignore'-like exclude rules for the
+files under it.
+
+Files can also be selected on their attributes with '--match'
+expressions, combining conditions with 'and', 'or', 'not' and
+parentheses:
+
+  size     file size: size >= 1GB (<, <=, >, >=, =, !=)
+  mtime    modification time: mtime < 2025-01-01, mtime > 2025-01-01T12:00:00Z
+  kind     regular, empty, sparse or symlink: kind = sparse (=, !=)
+  name     glob on the base name: name = "*.log*" (=, !=)
+  path     regexp on the relative path: path ~ "^state/" (~, !~)
+
+For example:
+
+  pitreos backup /data --match 'size > 100MB and not (kind = sparse or name = "*.tmp")'
+
+When restoring, attributes are those recorded in the backup. Backups made
+by older versions have no modification times: their backup date is used.
+Several '--match' flags must all match, along with the other filters.`,
+}
+
+func init() {
+	RootCmd.AddCommand(filtersHelpCmd)
+}
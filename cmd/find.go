@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eoscanada/pitreos"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var findCmd = &cobra.Command{
+	Use:   "find [prefix]",
+	Short: "Finds backups by metadata value",
+	Example: `  pitreos find --meta blocknum=123456
+
+    Prints the name of the backups taken at block 123456.
+
+  pitreos find --meta chain_id=abc --meta blocknum=123456 --tag prod --output json
+`,
+	Long: `Finds backups whose metadata, as given with 'pitreos backup --meta',
+has exactly the given values. Nested values are accessed with dots, like
+'--meta chain.blocknum=123456'.
+
+For comparisons, see the '--where' flag of 'pitreos list'.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(findMetas) == 0 {
+			errorCheck("finding backups", fmt.Errorf("specify at least one --meta key=value"))
+		}
+
+		var prefix string
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+
+		filters := getBackupFilters(viper.GetString("find-tag"), "", "")
+		for _, kv := range findMetas {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				errorCheck("finding backups", fmt.Errorf("invalid --meta %q, use key=value", kv))
+			}
+			filters = append(filters, pitreos.BackupMetaFilter(parts[0], parts[1]))
+		}
+
+		pitr := getPITR(viper.GetString("store"))
+		backups, err := pitr.SearchBackups(prefix, filters...)
+		errorCheck("searching backups", err)
+
+		output := viper.GetString("find-output")
+		if output == "text" {
+			if len(backups) == 0 {
+				errorCheck("finding backups", fmt.Errorf("no backup found"))
+			}
+			for _, b := range backups {
+				fmt.Println(b.Name)
+			}
+			return
+		}
+		printBackupMetas(backups, output, false)
+	},
+}
+
+// findMetas collects the repeatable `--meta` flags of `find`.
+var findMetas []string
+
+func init() {
+	RootCmd.AddCommand(findCmd)
+
+	findCmd.Flags().StringArrayVar(&findMetas, "meta", nil, "Metadata value to look for, as key=value (repeatable)")
+	findCmd.Flags().String("tag", "", "Only consider backups with this exact tag")
+	findCmd.Flags().String("output", "text", "Output format: text (backup names) or json")
+
+	for _, flag := range []string{"tag", "output"} {
+		if err := viper.BindPFlag("find-"+flag, findCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var hooksHelpCmd = &cobra.Command{
+	Use:   "hooks",
+	Short: "How to run commands around backups and restores",
+	Long: `Shell commands can be run around backups and restores, like to pause
+nodeos while its state is being backed up:
+
+  --pre-backup-hook     before backing up
+  --post-backup-hook    once the backup is stored
+  --pre-restore-hook    before restoring
+  --post-restore-hook   once the backup is restored
+  --on-failure-hook     when a backup or restore fails, including when
+                        one of its hooks fails
+
+They can also be set in the config file ('.pitreos.yaml'), like
+'pre-backup-hook: curl -s localhost:8888/v1/producer/pause'. A hook
+failing fails the backup or restore.
+
+Hooks get the details of the operation as environment variables:
+
+  PITREOS_HOOK          name of the hook, like 'pre-backup'
+  PITREOS_OPERATION     backup or restore
+  PITREOS_BACKUP_NAME   name of the backup
+  PITREOS_TAG           tag of the backup
+  PITREOS_SOURCE        directory backed up (or 'name=dir,...')
+  PITREOS_DESTINATION   directory restored to (or 'name=dir,...')
+  PITREOS_FILES         number of files (post hooks)
+  PITREOS_TOTAL_SIZE    total size of the files, in bytes (post hooks)
+  PITREOS_CHUNKS        number of chunks of the files (post hooks)
+  PITREOS_DURATION      duration of the operation, in seconds (post hooks)
+  PITREOS_ERROR         error of the operation (on-failure)
+
+When the pre-backup hook prints a JSON object, it is merged into the
+backup metadata, overriding '--meta' keys. For example, to record the head
+block of nodeos:
+
+  pitreos backup /data -t prod \
+    --pre-backup-hook 'curl -s localhost:8888/v1/chain/get_info | jq "{blocknum: .head_block_num}"'
+
+The output of other hooks is logged.`,
+}
+
+func init() {
+	RootCmd.AddCommand(hooksHelpCmd)
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import {archive} <filter>",
+	Short: "Creates a backup from a tar archive, without extracting it",
+	Example: `  pitreos import snapshot.tar.gz -t partner -s gs://mybackups/nodeos
+
+  curl https://example.com/snapshot.tar.zst | pitreos import - -t partner
+`,
+	Long: `Creates a backup from the regular files of a tar archive ('-' for stdin),
+chunking, hashing and uploading them straight from the stream, without
+extracting the archive to disk.
+
+gzip and zstd compressed archives are detected automatically. Holes of
+sparse entries, like any all-zero chunk, are stored as empty chunks.
+
+Optionally specify a 'filter' argument to only import files matching the filter arguments.
+The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when provided.
+Files can also be selected with '--include', '--exclude' and '--match', see
+'pitreos help filters'.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var metadata map[string]interface{}
+		err := json.Unmarshal([]byte(viper.GetString("import-meta")), &metadata)
+		errorCheck("unmarshaling --meta", err)
+
+		pitr := getPITR(viper.GetString("store"))
+
+		stringFilter := ""
+		if len(args) > 1 {
+			stringFilter = args[1]
+		}
+
+		filter := getFilter(stringFilter)
+
+		var in io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			errorCheck("opening archive", err)
+			defer f.Close()
+			in = f
+		}
+
+		archive, err := decompressReader(in)
+		errorCheck("reading archive", err)
+		defer archive.Close()
+
+		backupName, err := pitr.ImportBackup(archive, viper.GetString("import-tag"), metadata, filter)
+		errorCheck("importing archive", err)
+
+		fmt.Printf("Archive imported as backup %q\n", backupName)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+	addFilterFlags(importCmd)
+
+	importCmd.Flags().StringP("meta", "m", `{}`, "Additional metadata in JSON format to store with backup")
+	importCmd.Flags().StringP("tag", "t", "default", "Backup tag, appended to timestamp")
+
+	// Bound under their own keys, `backup` also has these flags
+	for _, flag := range []string{"meta", "tag"} {
+		if err := viper.BindPFlag("import-"+flag, importCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
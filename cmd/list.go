@@ -3,7 +3,10 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 
+	"github.com/dustin/go-humanize"
+	"github.com/eoscanada/pitreos"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -18,8 +21,26 @@ var listCmd = &cobra.Command{
   pitreos list 2018-08 -l 30
 
     Lists 20 backups from the month of August 2018.
+
+  pitreos list --tag prod --since 2025-01-01 --where 'meta.blocknum >= 1000000' --output json
+
+    Lists, as JSON, backups tagged 'prod' made since 2025, at block 1000000 or later.
 `,
-	Long: `Lists available backups on the selected storage`,
+	Long: `Lists available backups on the selected storage
+
+Backups can be selected on their metadata with '--tag', '--since' and
+'--where' expressions, combining conditions with 'and', 'or', 'not' and
+parentheses:
+
+  name      backup name (=, !=, ~, !~)
+  tag       backup tag (=, !=, ~, !~)
+  date      backup date: date >= 2025-01-01 (<, <=, >, >=, =, !=)
+  files     number of files (<, <=, >, >=, =, !=)
+  size      total size of files: size > 10GB (<, <=, >, >=, =, !=)
+  meta.KEY  metadata value, compared as numbers when both sides are:
+            meta.blocknum >= 1000000 (<, <=, >, >=, =, !=, ~, !~)
+
+'--limit' and '--offset' then apply to the matching backups.`,
 	Run: func(cmd *cobra.Command, args []string) {
 
 		pitr := getPITR(viper.GetString("store"))
@@ -33,26 +54,110 @@ var listCmd = &cobra.Command{
 			prefix = args[0]
 		}
 
-		list, err := pitr.ListBackups(limit, offset, prefix, long)
-		errorCheck("listing backups", err)
+		tag := viper.GetString("list-tag")
+		filters := getBackupFilters("", viper.GetString("list-since"), viper.GetString("list-where"))
+		output := viper.GetString("list-output")
+		if len(filters) == 0 && output == "text" {
+			var list []*pitreos.ListableBackup
+			var err error
+			if tag != "" {
+				list, err = pitr.ListTaggedBackups(limit, offset, prefix, tag, long)
+			} else {
+				list, err = pitr.ListBackups(limit, offset, prefix, long)
+			}
+			errorCheck("listing backups", err)
+
+			fmt.Println("")
+			fmt.Printf("Backups found:\n")
+			for _, b := range list {
+				if b.Meta != nil {
+					cnt, err := json.Marshal(b.Meta)
+					if err != nil {
+						fmt.Println("  ERROR decoding following backup's meta:", err)
+					}
+					fmt.Printf("- %s\t%s\n", b.Name, string(cnt))
+				} else {
+					fmt.Printf("- %s\n", b.Name)
+				}
+			}
+			fmt.Println("")
+			fmt.Printf("Total: %d\n", len(list))
+			fmt.Println("")
+			return
+		}
+
+		if tag != "" {
+			filters = append(filters, pitreos.BackupTagFilter(tag))
+		}
+		backups, err := pitr.SearchBackups(prefix, filters...)
+		errorCheck("searching backups", err)
+
+		if offset >= len(backups) {
+			backups = nil
+		} else {
+			backups = backups[offset:]
+		}
+		if len(backups) > limit {
+			backups = backups[:limit]
+		}
+
+		printBackupMetas(backups, output, long)
+	},
+}
+
+// getBackupFilters turns the '--tag', '--since' and '--where' flags of
+// `list` and `find` into backup filters.
+func getBackupFilters(tag, since, where string) (filters []pitreos.BackupFilter) {
+	if tag != "" {
+		filters = append(filters, pitreos.BackupTagFilter(tag))
+	}
+
+	if since != "" {
+		t, err := pitreos.ParseDate(since)
+		errorCheck("invalid --since date", err)
+		filters = append(filters, pitreos.BackupSinceFilter(t))
+	}
+
+	if where != "" {
+		filter, err := pitreos.ParseBackupExpression(where)
+		errorCheck("invalid --where expression", err)
+		filters = append(filters, filter)
+	}
+	return
+}
 
+func printBackupMetas(backups []*pitreos.BackupMeta, output string, long bool) {
+	switch output {
+	case "json":
+		if backups == nil {
+			backups = []*pitreos.BackupMeta{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		errorCheck("encoding backups", enc.Encode(backups))
+
+	case "text":
 		fmt.Println("")
 		fmt.Printf("Backups found:\n")
-		for _, b := range list {
-			if b.Meta != nil {
-				cnt, err := json.Marshal(b.Meta)
-				if err != nil {
-					fmt.Println("  ERROR decoding following backup's meta:", err)
-				}
-				fmt.Printf("- %s\t%s\n", b.Name, string(cnt))
-			} else {
+		for _, b := range backups {
+			if !long {
 				fmt.Printf("- %s\n", b.Name)
+				continue
+			}
+
+			cnt, err := json.Marshal(b.Meta)
+			if err != nil {
+				fmt.Println("  ERROR decoding following backup's meta:", err)
 			}
+			fmt.Printf("- %s\t%d files\t%s\t%s\n", b.Name, b.Files, humanize.Bytes(uint64(b.TotalSize)), string(cnt))
 		}
 		fmt.Println("")
-		fmt.Printf("Total: %d\n", len(list))
+		fmt.Printf("Total: %d\n", len(backups))
 		fmt.Println("")
-	},
+
+	default:
+		errorCheck("listing backups", fmt.Errorf("invalid output %q, use text or json", output))
+	}
 }
 
 func init() {
@@ -61,10 +166,19 @@ func init() {
 	listCmd.Flags().IntP("limit", "l", 20, "Limit on how many backups to return")
 	listCmd.Flags().IntP("offset", "o", 0, "List backups starting at offset")
 	listCmd.Flags().Bool("long", false, "Print metadata for each backup")
+	listCmd.Flags().String("tag", "", "Only list backups with this exact tag")
+	listCmd.Flags().String("since", "", "Only list backups made since this date (2006-01-02 or RFC3339)")
+	listCmd.Flags().String("where", "", "Only list backups matching this expression, like 'meta.blocknum >= 1000000'")
+	listCmd.Flags().String("output", "text", "Output format: text or json")
 
 	for _, flag := range []string{"limit", "offset", "prefix", "long"} {
 		if err := viper.BindPFlag(flag, listCmd.Flags().Lookup(flag)); err != nil {
 			panic(err)
 		}
 	}
+	for _, flag := range []string{"tag", "since", "where", "output"} {
+		if err := viper.BindPFlag("list-"+flag, listCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
 }
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var locksCmd = &cobra.Command{
+	Use:   "locks",
+	Short: "Lists the locks held on the selected storage",
+	Long: `Lists the locks held on the selected storage, like those taken by
+'pitreos backup' on the tag it backs up, with their holder and expiry.
+
+Expired locks, left by crashed processes, are taken over by the next
+backup. Use 'pitreos locks break' to remove them by hand.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		pitr := getPITR(viper.GetString("store"))
+
+		locks, err := pitr.ListLocks()
+		errorCheck("listing locks", err)
+
+		now := time.Now()
+		fmt.Println("")
+		fmt.Printf("Locks found:\n")
+		for _, lock := range locks {
+			state := fmt.Sprintf("expires in %s", lock.Expires.Sub(now).Round(time.Second))
+			if lock.Expired(now) {
+				state = fmt.Sprintf("EXPIRED %s ago", now.Sub(lock.Expires).Round(time.Second))
+			}
+			fmt.Printf("- %s\t%s by %s, since %s, %s\n", lock.Name, lock.Operation, lock.Holder, lock.Acquired.Format(time.RFC3339), state)
+		}
+		fmt.Println("")
+		fmt.Printf("Total: %d\n", len(locks))
+		fmt.Println("")
+	},
+}
+
+var locksBreakCmd = &cobra.Command{
+	Use:   "break {name}",
+	Short: "Removes an expired lock, or any lock with --force",
+	Long: `Removes an expired lock. With '--force', removes a lock even when it is
+still renewed by its holder: make sure it is stuck first, as the holder
+will then fail when finishing its backup.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pitr := getPITR(viper.GetString("store"))
+
+		err := pitr.BreakLock(args[0], viper.GetBool("locks-force"))
+		errorCheck("breaking lock", err)
+
+		fmt.Printf("Lock %q removed\n", args[0])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(locksCmd)
+	locksCmd.AddCommand(locksBreakCmd)
+
+	locksBreakCmd.Flags().Bool("force", false, "Remove the lock even when not expired")
+	if err := viper.BindPFlag("locks-force", locksBreakCmd.Flags().Lookup("force")); err != nil {
+		panic(err)
+	}
+}
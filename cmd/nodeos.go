@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/eoscanada/pitreos"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var nodeosCmd = &cobra.Command{
+	Use:   "nodeos",
+	Short: "Commands working with a running nodeos",
+}
+
+var nodeosBackupCmd = &cobra.Command{
+	Use:   "backup {data_dir}",
+	Short: "Snapshots a running nodeos, then backs up the snapshot and its blocks",
+	Example: `  pitreos nodeos backup /var/lib/nodeos -s gs://mybackups/nodeos -t prod --api-url http://127.0.0.1:8888
+
+    This will have nodeos write a snapshot, through its producer_api_plugin,
+    then back up the snapshot and the 'blocks' directory of /var/lib/nodeos.
+`,
+	Long: `Has a running nodeos write a snapshot of its state, through the
+'/v1/producer/create_snapshot' endpoint of its producer_api_plugin, waits
+for the snapshot file to be written, then backs up, in a single backup:
+
+  snapshots/{snapshot}   the new snapshot only
+  blocks/...             the 'blocks' directory of 'data_dir'
+
+'blocks/blocks.log' and 'blocks/blocks.index' are treated as append-only,
+so only what was appended since the last backup of the tag is read.
+
+The head block number ('blocknum'), head block ID ('head_block_id'), chain
+ID ('chain_id') and snapshot path ('snapshot') are recorded in the backup
+metadata, along with '--meta', which cannot set them.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var metadata map[string]interface{}
+		err := json.Unmarshal([]byte(viper.GetString("nodeos-meta")), &metadata)
+		errorCheck("unmarshaling --meta", err)
+
+		pitr := getPITR(viper.GetString("store"))
+		pitr.LockTTL = pitreos.DefaultLockTTL
+		client := pitreos.NewNodeosClient(viper.GetString("nodeos-api-url"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("nodeos-snapshot-timeout"))
+		defer cancel()
+
+		snapshot, err := pitr.BackupNodeos(ctx, client, args[0], viper.GetString("nodeos-tag"), metadata)
+		errorCheck("backing up nodeos", err)
+
+		fmt.Printf("Backed up snapshot %q, at block %d (%s)\n", snapshot.SnapshotName, snapshot.HeadBlockNum, snapshot.HeadBlockID)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(nodeosCmd)
+	nodeosCmd.AddCommand(nodeosBackupCmd)
+
+	nodeosBackupCmd.Flags().String("api-url", "http://127.0.0.1:8888", "URL of the nodeos HTTP API, with the producer_api_plugin enabled")
+	nodeosBackupCmd.Flags().Duration("snapshot-timeout", 30*time.Minute, "Time to wait for nodeos to write its snapshot")
+	nodeosBackupCmd.Flags().StringP("meta", "m", `{}`, "Additional metadata in JSON format to store with backup")
+	nodeosBackupCmd.Flags().StringP("tag", "t", "default", "Backup tag, appended to timestamp")
+
+	for _, flag := range []string{"api-url", "snapshot-timeout", "meta", "tag"} {
+		if err := viper.BindPFlag("nodeos-"+flag, nodeosBackupCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
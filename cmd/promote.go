@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote [tag|backup name] --to {channel}",
+	Short: "Points a channel of a tag, like 'stable', to a backup",
+	Example: `  pitreos promote 2018-08-28-18-15-45--prod --to stable
+
+    Points the 'stable' channel of the 'prod' tag to this backup.
+
+  pitreos restore prod@stable ../mydata
+
+    Restores the backup the 'stable' channel of the 'prod' tag points to.
+`,
+	Long: `Points a channel of the tag of a backup to it. Channels, like 'stable' or
+'canary', are named pointers to backups, moved by hand. Commands taking a
+backup name or tag also take 'tag@channel'.
+
+The 'latest' channel of a tag is updated by every backup.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		channel := viper.GetString("promote-to")
+		if channel == "" {
+			errorCheck("promoting backup", fmt.Errorf("specify a channel with --to"))
+		}
+
+		pitr := getPITR(viper.GetString("store"))
+		backupName := resolveBackupName(pitr, args[0])
+
+		previous, err := pitr.PromoteBackup(backupName, channel)
+		errorCheck("promoting backup", err)
+
+		if previous != "" {
+			fmt.Printf("Channel %q now points to %q (was %q)\n", channel, backupName, previous)
+		} else {
+			fmt.Printf("Channel %q now points to %q\n", channel, backupName)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(promoteCmd)
+
+	promoteCmd.Flags().String("to", "", "Channel to point to the backup, like 'stable' or 'canary'")
+	if err := viper.BindPFlag("promote-to", promoteCmd.Flags().Lookup("to")); err != nil {
+		panic(err)
+	}
+}
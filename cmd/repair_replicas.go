@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/eoscanada/pitreos"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var repairReplicasCmd = &cobra.Command{
+	Use:   "repair-replicas",
+	Short: "Copies backup indexes and chunks missing from any replica",
+	Example: `  pitreos repair-replicas -s gs://mybackups/nodeos --replicas s3://mybackups/nodeos?region=us-east-1
+
+    This will copy to each store any backup index, or chunk referenced by a backup index,
+    that is present on the other store but missing from it.
+`,
+	Long: `Finds backup indexes, and chunks referenced by them, that are missing from
+any of the stores given by '--store' and '--replicas', and copies them
+over from a store having them. Chunks are verified against their hash
+before being copied.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		storage := getStorage(context.Background(), viper.GetString("store"))
+
+		replicated, ok := storage.(*pitreos.ReplicatedStorage)
+		if !ok {
+			errorCheck("repairing replicas", errors.New("no replicas configured, use --replicas"))
+		}
+
+		dryRun := viper.GetBool("dry-run")
+		report, err := replicated.Repair(viper.GetInt("threads"), dryRun)
+		errorCheck("repairing replicas", err)
+
+		fmt.Printf("Backups: %d, chunks: %d\n", report.Backups, report.Chunks)
+		for i := range replicated.Backends() {
+			fmt.Printf("- replica %d: %d missing indexes, %d missing chunks\n", i, report.MissingIndexes[i], report.MissingChunks[i])
+		}
+
+		if !dryRun {
+			fmt.Printf("Copied %d indexes and %d chunks\n", report.CopiedIndexes, report.CopiedChunks)
+		}
+
+		if len(report.LostChunks) > 0 {
+			fmt.Printf("WARNING: %d chunks are missing from every replica:\n", len(report.LostChunks))
+			for _, hash := range report.LostChunks {
+				fmt.Printf("- %s\n", hash)
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(repairReplicasCmd)
+
+	repairReplicasCmd.Flags().Bool("dry-run", false, "Only report what is missing, without copying anything")
+
+	for _, flag := range []string{"dry-run"} {
+		if err := viper.BindPFlag(flag, repairReplicasCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
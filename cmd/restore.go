@@ -1,31 +1,42 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
-	"strings"
 
 	"github.com/eoscanada/pitreos"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-var timestampString string
-
 var restoreCmd = &cobra.Command{
 	Use:   "restore [tag|backup name] {destination path} <filter>",
 	Short: "Restores your files to a specified point in time (default: latest available)",
 	Example: `
   pitreos restore 2018-08-28-18-15-45--default ../mydata -c
   pitreos restore default ../mydata -c
+  pitreos restore default blocks=/mnt/a/blocks,state=/mnt/b/state
+  pitreos restore default ../mydata --at 2018-08-28T12:00:00Z
+  pitreos restore default ../mydata --before-meta blocknum=123456
 `,
 	Long: `Restores your files to the closest available backup before
 the requested timestamp (default: now).
+
+Given a tag, the newest backup with this tag is restored. Use '--at' to
+restore the newest one made at or before a time, and '--before-meta' the
+newest one whose metadata value is at or below a value (like a block
+number).
+
 It compares existing chunks of data in your files and downloads only the necessary data.
 This is optimized for large and sparse files, like virtual machines disks or nodeos state.
 
+For backups of several named roots, the destination can be given as
+'name=/path,othername=/otherpath' to restore each root to its own path
+(roots not listed are skipped), otherwise roots are restored as
+subdirectories of the destination.
+
 Optionally specify a 'filter' argument to only download files matching the filter arguments.
-The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when provided.`,
+The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when provided.
+Files can also be selected with '--include' and '--exclude' glob patterns (see 'pitreos help filters').`,
 	Args: cobra.MinimumNArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
 
@@ -39,29 +50,28 @@ The 'filter' argument is interpreted as a Golang Regexp (Perl compatible) when p
 			stringFilter = args[2]
 		}
 
-		filter, err := pitreos.NewIncludeThanExcludeFilter(stringFilter, "")
-		errorCheck("unable to create include filter", err)
+		filter := getFilter(stringFilter)
 
-		if !strings.Contains(args[0], "--") {
-			fmt.Println("Getting lastest backup from storage")
-			lastBackup, err := pitr.GetLatestBackup(backupName)
-			errorCheck("Getting last available backup", err)
+		backupName = resolveBackupName(pitr, backupName)
 
-			if lastBackup == "" {
-				errorCheck("getting last backups", errors.New("last available backup found empty"))
-			}
+		fmt.Printf("Restoring backup %q to destination %q (filter %s)\n", backupName, destPath, filter)
+		if pitreos.IsRootsSpec(destPath) {
+			roots, err := pitreos.ParseRoots(destPath)
+			errorCheck("parsing destination roots", err)
 
-			backupName = lastBackup
+			err = pitr.RestoreFromBackupToRoots(roots, backupName, filter)
+			errorCheck("restoring from backup", err)
+		} else {
+			err := pitr.RestoreFromBackup(destPath, backupName, filter)
+			errorCheck("restoring from backup", err)
 		}
 
-		fmt.Printf("Restoring backup %q to destination %q (filter %s)\n", backupName, destPath, filter)
-		err = pitr.RestoreFromBackup(destPath, backupName, filter)
-		errorCheck("restoring from backup", err)
-
 		fmt.Printf("Restoration of backup completed\n")
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(restoreCmd)
+	addFilterFlags(restoreCmd)
+	addBackupSelectionFlags(restoreCmd)
 }
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/dfuse-io/logging"
+	"github.com/eoscanada/pitreos"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -40,6 +41,13 @@ comparison, optimized for very large files, sparse files and append-only
 files like the ones that you get when running Nodeos.
 Supports local storage, and several objects stores (GCP, AWS, AZ) in
 addition to local caching.`,
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		if cacheStorage != nil {
+			if err := cacheStorage.SaveStats(); err != nil {
+				zlog.Warn("cannot save cache stats", zap.Error(err))
+			}
+		}
+	},
 }
 
 func Execute() {
@@ -69,9 +77,24 @@ func init() {
 
 	RootCmd.PersistentFlags().String("cache-dir", path.Join(home, ".pitreos", "cache"), "Cache directory")
 	RootCmd.PersistentFlags().BoolP("enable-caching", "c", false, "Keep/use a copy of every block file sent")
-	RootCmd.PersistentFlags().StringSliceP("appendonly-files", "a", []string{}, "Files treated as append-only (ex: blocks/blocks.log)")
-
-	for _, flag := range []string{"store", "chunk-size", "threads", "timeout", "cache-dir", "enable-caching", "appendonly-files", "verbosity"} {
+	RootCmd.PersistentFlags().String("cache-max-size", "", "Maximum size of the cache (ex: 20GB), least recently used chunks are evicted beyond it (default: unlimited)")
+	RootCmd.PersistentFlags().StringSliceP("appendonly-files", "a", []string{}, "Globs of files treated as append-only (ex: blocks/blocks.log, **/*.log)")
+	RootCmd.PersistentFlags().Bool("appendonly-verify", false, "Check append-only files against their last chunk and --appendonly-samples others before skipping their start, on backup and restore")
+	RootCmd.PersistentFlags().Int("appendonly-samples", pitreos.DefaultAppendonlySampledChunks, "Number of chunks checked at random, besides the last one, in append-only files (-1 checks them all)")
+
+	RootCmd.PersistentFlags().StringSlice("replicas", []string{}, "Additional storage URLs on which every index and chunk written to --store is replicated")
+	RootCmd.PersistentFlags().Int("write-quorum", 0, "Number of stores (--store and --replicas) that must acknowledge a write (0 means all)")
+	RootCmd.PersistentFlags().Bool("read-fastest", false, "Read from all replicas at once and use the fastest, instead of the first healthy one")
+	RootCmd.PersistentFlags().StringSlice("peers", []string{}, "URLs of sibling nodes running 'pitreos serve-cache' (ex: http://10.0.0.2:8181), tried before --store when downloading chunks")
+	RootCmd.PersistentFlags().Int("peer-timeout", 10, "Timeout in seconds for each chunk download from a peer")
+
+	RootCmd.PersistentFlags().String("pre-backup-hook", "", "Shell command run before backing up, whose JSON output is merged into the backup metadata (see 'pitreos help hooks')")
+	RootCmd.PersistentFlags().String("post-backup-hook", "", "Shell command run once a backup is stored")
+	RootCmd.PersistentFlags().String("pre-restore-hook", "", "Shell command run before restoring")
+	RootCmd.PersistentFlags().String("post-restore-hook", "", "Shell command run once a backup is restored")
+	RootCmd.PersistentFlags().String("on-failure-hook", "", "Shell command run when a backup or restore fails")
+
+	for _, flag := range []string{"store", "chunk-size", "threads", "timeout", "cache-dir", "enable-caching", "cache-max-size", "appendonly-files", "appendonly-verify", "appendonly-samples", "verbosity", "replicas", "write-quorum", "read-fastest", "peers", "peer-timeout", "pre-backup-hook", "post-backup-hook", "pre-restore-hook", "post-restore-hook", "on-failure-hook"} {
 		if err := viper.BindPFlag(flag, RootCmd.PersistentFlags().Lookup(flag)); err != nil {
 			panic(err)
 		}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/eoscanada/pitreos"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serves the backups of the store read-only over HTTP",
+	Example: `  pitreos serve -s gs://mybackups/nodeos --listen-addr :8080
+
+    Then:
+
+  curl http://localhost:8080/backups?prefix=2018-08
+  curl http://localhost:8080/backups/2018-08-28-18-15-45--default
+  curl http://localhost:8080/backups/2018-08-28-18-15-45--default/files/config.ini
+`,
+	Long: `Serves the backups of the store read-only over HTTP:
+
+  GET /backups[?prefix=&limit=100&offset=0]   lists backups with their metadata, as JSON
+  GET /backups/{backup}                       returns the backup index, as JSON
+  GET /backups/{backup}/files/{filename}      streams the content of a file
+
+Files are assembled from their chunks on the fly, and support HTTP Range
+requests, so a single file can be fetched from a backup without restoring
+it. Use '--enable-caching' to keep the downloaded chunks around.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		pitr := getPITR(viper.GetString("store"))
+		listenAddr := viper.GetString("serve-listen-addr")
+
+		zlog.Info("serving backups", zap.String("store_url", viper.GetString("store")), zap.String("listen_addr", listenAddr))
+		fmt.Printf("Serving backups of %q on %s\n", viper.GetString("store"), listenAddr)
+
+		handler := pitreos.NewBackupsHandler(pitr)
+		mux := http.NewServeMux()
+		mux.Handle("/backups", handler)
+		mux.Handle("/backups/", handler)
+		errorCheck("serving backups", http.ListenAndServe(listenAddr, mux))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().String("listen-addr", ":8080", "Address to listen on for HTTP requests")
+
+	// Bound under its own key, `serve-cache` also has a `--listen-addr` flag
+	if err := viper.BindPFlag("serve-listen-addr", serveCmd.Flags().Lookup("listen-addr")); err != nil {
+		panic(err)
+	}
+}
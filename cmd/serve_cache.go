@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/eoscanada/pitreos"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+var serveCacheCmd = &cobra.Command{
+	Use:   "serve-cache",
+	Short: "Serves the local chunks cache read-only over HTTP, for sibling nodes",
+	Example: `  pitreos serve-cache --listen-addr :8181
+
+    Then, on a new node in the same datacenter:
+
+  pitreos restore default /data --peers http://10.0.0.2:8181 -s gs://mybackups/nodeos
+`,
+	Long: `Serves the chunks of the local cache ('--cache-dir') read-only over HTTP,
+so that sibling nodes given this node in '--peers' download chunks from it
+instead of the storage.
+
+Chunks are served uncompressed at 'GET /chunks/{sha3}', and verified
+against their hash both before being served and once downloaded.
+Chunks missing from this cache are downloaded from the storage by the
+sibling node.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Shared, so that its stats are saved once stopped
+		cacheStorage = getCacheStorage()
+		listenAddr := viper.GetString("listen-addr")
+
+		zlog.Info("serving cache", zap.String("cache_dir", viper.GetString("cache-dir")), zap.String("listen_addr", listenAddr))
+		fmt.Printf("Serving cache %q on %s\n", viper.GetString("cache-dir"), listenAddr)
+
+		mux := http.NewServeMux()
+		mux.Handle("/chunks/", pitreos.NewChunkHandler(cacheStorage))
+		server := &http.Server{Addr: listenAddr, Handler: mux}
+
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			zlog.Info("stopping cache server")
+			if err := server.Shutdown(context.Background()); err != nil {
+				zlog.Warn("cannot stop cache server gracefully", zap.Error(err))
+			}
+		}()
+
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			errorCheck("serving cache", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(serveCacheCmd)
+
+	serveCacheCmd.Flags().String("listen-addr", ":8181", "Address to listen on for HTTP requests")
+
+	for _, flag := range []string{"listen-addr"} {
+		if err := viper.BindPFlag(flag, serveCacheCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
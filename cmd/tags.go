@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var tagsCmd = &cobra.Command{
+	Use:   "tags",
+	Short: "Lists backup tags, with their number of backups and latest backup",
+	Long: `Lists the tags of the backups on the selected storage, with their
+number of backups and latest backup.
+
+Tags are matched exactly: the tag 'dev' doesn't select 'john_dev' backups.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		pitr := getPITR(viper.GetString("store"))
+
+		tags, err := pitr.ListTags()
+		errorCheck("listing tags", err)
+
+		fmt.Println("")
+		fmt.Printf("Tags found:\n")
+		for _, tag := range tags {
+			fmt.Printf("- %s\t%d backups\tlatest: %s\n", tag.Tag, tag.Backups, tag.Latest)
+		}
+		fmt.Println("")
+		fmt.Printf("Total: %d\n", len(tags))
+		fmt.Println("")
+	},
+}
+
+var tagsHistoryCmd = &cobra.Command{
+	Use:   "history {tag}",
+	Short: "Lists the backups of a tag, oldest first",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pitr := getPITR(viper.GetString("store"))
+
+		list, err := pitr.ListTaggedBackups(math.MaxInt32, 0, "", args[0], viper.GetBool("tags-long"))
+		errorCheck("listing backups", err)
+
+		for _, b := range list {
+			if b.Meta != nil {
+				cnt, err := json.Marshal(b.Meta)
+				if err != nil {
+					fmt.Println("  ERROR decoding following backup's meta:", err)
+				}
+				fmt.Printf("- %s\t%s\n", b.Name, string(cnt))
+			} else {
+				fmt.Printf("- %s\n", b.Name)
+			}
+		}
+		fmt.Printf("Total: %d\n", len(list))
+	},
+}
+
+var tagsAliasCmd = &cobra.Command{
+	Use:     "alias [tag|backup name] {new tag}",
+	Aliases: []string{"retag"},
+	Short:   "Makes a backup also available under another tag, without copying chunks",
+	Example: `  pitreos tags alias 2018-08-28-18-15-45--default stable
+
+    Makes the backup also available as 2018-08-28-18-15-45--stable.
+
+  pitreos tags alias dev prod
+
+    Makes the latest 'dev' backup also available under the 'prod' tag.
+`,
+	Long: `Makes a backup also available under another tag, by writing a copy of
+its index, named with the same date and the new tag. Chunks are shared,
+not copied. The original backup is kept.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		pitr := getPITR(viper.GetString("store"))
+
+		backupName := resolveBackupName(pitr, args[0])
+		aliasName, err := pitr.AliasBackup(backupName, args[1])
+		errorCheck("aliasing backup", err)
+
+		fmt.Printf("Backup %q is now also available as %q\n", backupName, aliasName)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(tagsCmd)
+	tagsCmd.AddCommand(tagsHistoryCmd, tagsAliasCmd)
+
+	tagsHistoryCmd.Flags().Bool("long", false, "Print metadata for each backup")
+	if err := viper.BindPFlag("tags-long", tagsHistoryCmd.Flags().Lookup("long")); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,123 @@
+package pitreos
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/abourget/llerrgroup"
+	"github.com/ghodss/yaml"
+	"go.uber.org/zap"
+)
+
+type CopyStats struct {
+	Backups        int
+	SkippedBackups int
+	Chunks         int
+	ExistingChunks int
+	CopiedChunks   int
+	CopiedBytes    int64
+}
+
+// CopyBackups copies the given backups from the PITR's storage to
+// `dest`, with only the chunks `dest` doesn't already have. Chunks are
+// verified against their hash while being copied.
+//
+// Each backup index is written once all its chunks were copied, so an
+// interrupted copy can simply be run again: backups already present at
+// the destination are skipped, and so are the chunks copied so far.
+func (p *PITR) CopyBackups(dest Storage, backupNames []string) (*CopyStats, error) {
+	stats := &CopyStats{}
+
+	for _, backupName := range backupNames {
+		existing, err := dest.ListBackups(1, backupName)
+		if err != nil {
+			return stats, fmt.Errorf("listing destination backups: %w", err)
+		}
+		if len(existing) == 1 && existing[0] == backupName {
+			zlog.Info("backup already present at destination, skipping", zap.String("backup_name", backupName))
+			stats.SkippedBackups++
+			continue
+		}
+
+		if err := p.copyBackup(dest, backupName, stats); err != nil {
+			return stats, fmt.Errorf("copying backup %q: %w", backupName, err)
+		}
+		stats.Backups++
+	}
+
+	return stats, nil
+}
+
+func (p *PITR) copyBackup(dest Storage, backupName string, stats *CopyStats) error {
+	content, err := readAllAndClose(p.storage.OpenBackupIndex(backupName))
+	if err != nil {
+		return fmt.Errorf("reading index: %w", err)
+	}
+
+	var bm *BackupIndex
+	if err := yaml.Unmarshal(content, &bm); err != nil {
+		return fmt.Errorf("unmarshal index: %w", err)
+	}
+
+	hashes := make(map[string]bool)
+	for _, file := range bm.Files {
+		for _, chunk := range file.Chunks {
+			if !chunk.IsEmpty && chunk.ContentSHA != "" {
+				hashes[chunk.ContentSHA] = true
+			}
+		}
+	}
+
+	zlog.Info("copying backup", zap.String("backup_name", backupName), zap.Int("chunk_count", len(hashes)))
+
+	var lock sync.Mutex
+	eg := llerrgroup.New(p.threads)
+	for hash := range hashes {
+		if eg.Stop() {
+			break
+		}
+
+		hash := hash
+		eg.Go(func() error {
+			exists, err := dest.ChunkExists(hash)
+			if err != nil {
+				return fmt.Errorf("chunk exists: %w", err)
+			}
+
+			var copied int64
+			if !exists {
+				data, err := readVerifiedChunk(p.storage, hash)
+				if err != nil {
+					return err
+				}
+				if err := dest.WriteChunk(hash, data); err != nil {
+					return fmt.Errorf("write chunk: %w", err)
+				}
+				copied = int64(len(data))
+				zlog.Debug("chunk copied", zap.String("hash", hash), zap.Int64("bytes", copied))
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			stats.Chunks++
+			if exists {
+				stats.ExistingChunks++
+			} else {
+				stats.CopiedChunks++
+				stats.CopiedBytes += copied
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	if err := dest.WriteBackupIndex(backupName, content); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+	if err := writeBackupMeta(dest, backupName, bm); err != nil {
+		return err
+	}
+	return updateLatestRef(dest, backupName)
+}
@@ -0,0 +1,98 @@
+package pitreos
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPITR_CopyBackups(t *testing.T) {
+	src, dest := newTestLocalStorage(t), newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, src)
+
+	source := newTestSourceDir(t, map[string][]byte{
+		"a.bin":     testContent(2*1024*1024+10, 1),
+		"sub/b.bin": testContent(1024, 2),
+	})
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	list, err := src.ListBackups(10, "")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	stats, err := pitr.CopyBackups(dest, list)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Backups)
+	assert.Equal(t, 4, stats.Chunks)
+	assert.Equal(t, 4, stats.CopiedChunks)
+
+	// Already there
+	stats, err = pitr.CopyBackups(dest, list)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.SkippedBackups)
+	assert.Equal(t, 0, stats.CopiedChunks)
+
+	restoreDir := newTestSourceDir(t, nil)
+	require.NoError(t, New(1, 2, time.Minute, dest).RestoreFromBackup(restoreDir, list[0], AllFileFilter))
+	assertSameFiles(t, source, restoreDir, "a.bin", "sub/b.bin")
+}
+
+func TestPITR_CopyBackups_VerifiesHashes(t *testing.T) {
+	src, dest := newTestLocalStorage(t), newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, src)
+
+	source := newTestSourceDir(t, map[string][]byte{"a.bin": testContent(1024, 1)})
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	list, err := src.ListBackups(10, "")
+	require.NoError(t, err)
+
+	bm, err := pitr.downloadBackupIndex(list[0])
+	require.NoError(t, err)
+	require.NoError(t, src.WriteChunk(bm.Files[0].Chunks[0].ContentSHA, []byte("corrupted")))
+
+	_, err = pitr.CopyBackups(dest, list)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid sha3sum")
+
+	// The index is not written until all chunks made it
+	copied, err := dest.ListBackups(10, "")
+	require.NoError(t, err)
+	assert.Empty(t, copied)
+}
+
+func newTestSourceDir(t *testing.T, files map[string][]byte) string {
+	dir, err := ioutil.TempDir("", "pitreos-source")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		filePath := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		require.NoError(t, ioutil.WriteFile(filePath, content, 0644))
+	}
+	return dir
+}
+
+func testContent(size int, seed byte) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i%253) + seed
+	}
+	return content
+}
+
+func assertSameFiles(t *testing.T, expectedDir, actualDir string, names ...string) {
+	for _, name := range names {
+		expected, err := ioutil.ReadFile(filepath.Join(expectedDir, name))
+		require.NoError(t, err)
+		actual, err := ioutil.ReadFile(filepath.Join(actualDir, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual, name)
+	}
+}
@@ -0,0 +1,238 @@
+package pitreos
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ExportBackup writes the files of a backup matching `filter` to `w`, as
+// a tar archive. Files with empty chunks are written as GNU sparse
+// (format 1.0) entries, so their holes take no room in the archive, and
+// are restored as holes by GNU tar.
+func (p *PITR) ExportBackup(w io.Writer, backupName string, filter Filter) error {
+	bm, err := p.downloadBackupIndex(backupName)
+	if err != nil {
+		return err
+	}
+
+	if bm.Version != p.filemetaVersion {
+		return fmt.Errorf("incompatible version of backupIndex, expected %s got %s", p.filemetaVersion, bm.Version)
+	}
+
+	matchingFiles, err := bm.FindFilesMatching(filter)
+	if err != nil {
+		return err
+	}
+	sort.Slice(matchingFiles, func(i, j int) bool { return matchingFiles[i].FileName < matchingFiles[j].FileName })
+
+	tw := tar.NewWriter(w)
+	for _, file := range matchingFiles {
+		fragments := dataFragments(file)
+
+		zlog.Info("exporting file", zap.String("file_name", file.FileName), zap.Int64("size", file.TotalSize), zap.Int("data_fragments", len(fragments)))
+
+		if len(fragments) == 1 && fragments[0].length == file.TotalSize {
+			err = p.exportRegularFile(tw, file)
+		} else {
+			// Sparse entries are written directly to `w`, between
+			// entries of `tw`, which cannot write them.
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			err = p.exportSparseFile(w, file, fragments)
+		}
+		if err != nil {
+			return fmt.Errorf("exporting %q: %s", file.FileName, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+func (p *PITR) exportRegularFile(tw *tar.Writer, file *FileIndex) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     file.FileName,
+		Size:     file.TotalSize,
+		Mode:     tarMode(file),
+		ModTime:  file.Attributes().ModTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, p.newFileReader(file))
+	return err
+}
+
+// tarMode returns the permissions the file was backed up with, or 0644
+// for backups made before they were recorded.
+func tarMode(file *FileIndex) int64 {
+	if perm := file.Mode.Perm(); perm != 0 {
+		return int64(perm)
+	}
+	return 0644
+}
+
+// exportSparseFile writes a PAX extended header holding the GNU sparse
+// records, then the entry itself, whose content is the sparse map
+// followed by the data fragments.
+func (p *PITR) exportSparseFile(w io.Writer, file *FileIndex, fragments []dataFragment) error {
+	sparseMap := strconv.Itoa(len(fragments)) + "\n"
+	dataSize := int64(0)
+	for _, fragment := range fragments {
+		sparseMap += fmt.Sprintf("%d\n%d\n", fragment.offset, fragment.length)
+		dataSize += fragment.length
+	}
+	sparseMapBlocks := []byte(sparseMap)
+	sparseMapBlocks = append(sparseMapBlocks, make([]byte, tarPadding(int64(len(sparseMapBlocks))))...)
+	entrySize := int64(len(sparseMapBlocks)) + dataSize
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     file.FileName,
+		"GNU.sparse.realsize": strconv.FormatInt(file.TotalSize, 10),
+	}
+	if entrySize > maxTarOctalSize {
+		records["size"] = strconv.FormatInt(entrySize, 10)
+	}
+
+	dir, name := splitTarPath(file.FileName)
+	paxData := formatPAXRecords(records)
+	modTime := file.Attributes().ModTime
+	paxHeader := tarHeaderBlock(dir+"PaxHeaders.0/"+name, 'x', int64(len(paxData)), 0644, modTime)
+	header := tarHeaderBlock(dir+"GNUSparseFile.0/"+name, tar.TypeReg, entrySize, tarMode(file), modTime)
+
+	for _, blk := range [][]byte{paxHeader, paxData, make([]byte, tarPadding(int64(len(paxData)))), header, sparseMapBlocks} {
+		if _, err := w.Write(blk); err != nil {
+			return err
+		}
+	}
+
+	reader := p.newFileReader(file)
+	for _, fragment := range fragments {
+		if _, err := reader.Seek(fragment.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, reader, fragment.length); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(make([]byte, tarPadding(dataSize)))
+	return err
+}
+
+type dataFragment struct {
+	offset int64
+	length int64
+}
+
+// dataFragments returns the ranges of `file` covered by non-empty
+// chunks, contiguous ones merged. When the file ends with a hole, a
+// last empty fragment marks its end, like GNU tar does.
+func dataFragments(file *FileIndex) (out []dataFragment) {
+	chunks := make([]*ChunkDef, len(file.Chunks))
+	copy(chunks, file.Chunks)
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Start < chunks[j].Start })
+
+	for _, chunk := range chunks {
+		if chunk.IsEmpty || chunk.Start >= file.TotalSize {
+			continue
+		}
+
+		end := chunk.End + 1
+		if end > file.TotalSize {
+			end = file.TotalSize
+		}
+
+		if last := len(out) - 1; last >= 0 && out[last].offset+out[last].length == chunk.Start {
+			out[last].length = end - out[last].offset
+			continue
+		}
+		out = append(out, dataFragment{offset: chunk.Start, length: end - chunk.Start})
+	}
+
+	if last := len(out) - 1; last < 0 || out[last].offset+out[last].length < file.TotalSize {
+		out = append(out, dataFragment{offset: file.TotalSize})
+	}
+	return out
+}
+
+const tarBlockSize = 512
+
+// maxTarOctalSize is the largest size fitting the 11 octal digits of a
+// ustar header, larger ones go in a PAX `size` record.
+const maxTarOctalSize = 1<<33 - 1
+
+func tarPadding(size int64) int64 {
+	return -size & (tarBlockSize - 1)
+}
+
+func splitTarPath(filePath string) (dir, name string) {
+	if idx := strings.LastIndex(filePath, "/"); idx >= 0 {
+		return filePath[:idx+1], filePath[idx+1:]
+	}
+	return "", filePath
+}
+
+// tarHeaderBlock formats a ustar header. Names longer than the ustar
+// limit are truncated: the real name is always in the PAX records.
+func tarHeaderBlock(name string, typeflag byte, size, mode int64, modTime time.Time) []byte {
+	if size > maxTarOctalSize {
+		size = 0
+	}
+
+	blk := make([]byte, tarBlockSize)
+	copy(blk[0:100], name)
+	formatTarOctal(blk[100:108], mode)
+	formatTarOctal(blk[108:116], 0)
+	formatTarOctal(blk[116:124], 0)
+	formatTarOctal(blk[124:136], size)
+	formatTarOctal(blk[136:148], modTime.Unix())
+	blk[156] = typeflag
+	copy(blk[257:263], "ustar\x00")
+	copy(blk[263:265], "00")
+
+	copy(blk[148:156], "        ")
+	var checksum int64
+	for _, b := range blk {
+		checksum += int64(b)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", checksum))
+
+	return blk
+}
+
+func formatTarOctal(field []byte, value int64) {
+	copy(field, fmt.Sprintf("%0*o", len(field)-1, value))
+}
+
+// formatPAXRecords formats records as "%d %s=%s\n", the length
+// including itself, sorted for a deterministic output.
+func formatPAXRecords(records map[string]string) []byte {
+	var keys []string
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out []byte
+	for _, k := range keys {
+		record := " " + k + "=" + records[k] + "\n"
+		size := len(record) + len(strconv.Itoa(len(record)))
+		if len(strconv.Itoa(size)) != len(strconv.Itoa(len(record))) {
+			size++
+		}
+		out = append(out, strconv.Itoa(size)+record...)
+	}
+	return out
+}
@@ -0,0 +1,107 @@
+package pitreos
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPITR_ExportBackup(t *testing.T) {
+	// Second and last MiBs are all zeros, so stored as empty chunks
+	sparse := testContent(4*1024*1024, 1)
+	for _, start := range []int{1024 * 1024, 3 * 1024 * 1024} {
+		for i := start; i < start+1024*1024; i++ {
+			sparse[i] = 0
+		}
+	}
+
+	files := map[string][]byte{
+		"config.ini":        []byte("p2p-peer-address = 1.2.3.4:9876\n"),
+		"state/shared.bin":  sparse,
+		"blocks/blocks.log": testContent(1024*1024+10, 2),
+		"empty":             {},
+	}
+
+	source := newTestSourceDir(t, files)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, mode := range map[string]os.FileMode{"config.ini": 0600, "state/shared.bin": 0640} {
+		require.NoError(t, os.Chmod(filepath.Join(source, name), mode))
+		require.NoError(t, os.Chtimes(filepath.Join(source, name), modTime, modTime))
+	}
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, pitr.ExportBackup(buf, list[0], AllFileFilter))
+
+	// Holes take no room: 3 MiB of data, plus headers
+	assert.True(t, buf.Len() < 3*1024*1024+64*1024, "archive size %d", buf.Len())
+
+	tr := tar.NewReader(buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		cnt, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		assert.Equal(t, files[hdr.Name], cnt, hdr.Name)
+		assert.Equal(t, int64(len(files[hdr.Name])), hdr.Size, hdr.Name)
+		names = append(names, hdr.Name)
+
+		switch hdr.Name {
+		case "config.ini":
+			assert.Equal(t, int64(0600), hdr.Mode)
+			assert.True(t, modTime.Equal(hdr.ModTime), hdr.ModTime)
+		case "state/shared.bin":
+			assert.Equal(t, int64(0640), hdr.Mode)
+			assert.True(t, modTime.Equal(hdr.ModTime), hdr.ModTime)
+		}
+	}
+	assert.Equal(t, []string{"blocks/blocks.log", "config.ini", "empty", "state/shared.bin"}, names)
+
+	filter, err := NewIncludeThanExcludeFilter("config", "")
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, pitr.ExportBackup(buf, list[0], filter))
+
+	tr = tar.NewReader(buf)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "config.ini", hdr.Name)
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDataFragments(t *testing.T) {
+	file := &FileIndex{
+		TotalSize: 50,
+		Chunks: []*ChunkDef{
+			{Start: 20, End: 29, IsEmpty: true},
+			{Start: 0, End: 9},
+			{Start: 10, End: 19},
+			{Start: 30, End: 39},
+			{Start: 40, End: 49, IsEmpty: true},
+		},
+	}
+	assert.Equal(t, []dataFragment{{0, 20}, {30, 10}, {50, 0}}, dataFragments(file))
+
+	file.Chunks[4].IsEmpty = false
+	assert.Equal(t, []dataFragment{{0, 20}, {30, 20}}, dataFragments(file))
+}
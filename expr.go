@@ -0,0 +1,217 @@
+package pitreos
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Conditions expressions, as given on the command line, look like:
+//
+//	size > 1GB and not (name = "*.log*" or kind = sparse)
+//
+// They are parsed to a tree of exprNode, then compiled to a Filter (see
+// ParseFilterExpression) or a backup predicate, each with their own
+// fields.
+type exprNode interface{}
+
+type exprAnd struct{ left, right exprNode }
+type exprOr struct{ left, right exprNode }
+type exprNot struct{ inner exprNode }
+
+type exprCondition struct {
+	field string
+	op    string
+	value string
+}
+
+var exprOperators = []string{"<=", ">=", "!=", "!~", "==", "=", "<", ">", "~"}
+
+func parseExpr(in string) (exprNode, error) {
+	tokens, err := tokenizeExpr(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression", p.tokens[p.pos].text)
+	}
+	return node, nil
+}
+
+type exprToken struct {
+	text   string
+	quoted bool
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peekKeyword(keyword string) bool {
+	return p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, keyword)
+}
+
+func (p *exprParser) next() (exprToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return exprToken{}, false
+	}
+	p.pos++
+	return p.tokens[p.pos-1], true
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = exprOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekKeyword("and") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = exprAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peekKeyword("not") {
+		p.pos++
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprNot{inner}, nil
+	}
+
+	if p.peekKeyword("(") {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peekKeyword(")") {
+			return nil, fmt.Errorf("missing closing parenthesis in expression")
+		}
+		p.pos++
+		return inner, nil
+	}
+
+	return p.parseCondition()
+}
+
+func (p *exprParser) parseCondition() (exprNode, error) {
+	field, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	op, ok := p.next()
+	if !ok || op.quoted || !isExprOperator(op.text) {
+		return nil, fmt.Errorf("expected an operator after %q in expression", field.text)
+	}
+
+	value, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("expected a value after %q in expression", field.text+" "+op.text)
+	}
+
+	opText := op.text
+	if opText == "==" {
+		opText = "="
+	}
+	return exprCondition{field: field.text, op: opText, value: value.text}, nil
+}
+
+func isExprOperator(s string) bool {
+	for _, op := range exprOperators {
+		if s == op {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenizeExpr splits an expression into parentheses, operators, quoted
+// strings and bare words. Operators need no spaces around them.
+func tokenizeExpr(in string) (tokens []exprToken, err error) {
+	runes := []rune(in)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(' || r == ')':
+			tokens = append(tokens, exprToken{text: string(r)})
+			i++
+
+		case r == '"' || r == '\'':
+			end := i + 1
+			var value []rune
+			for ; end < len(runes) && runes[end] != r; end++ {
+				if runes[end] == '\\' && end+1 < len(runes) && runes[end+1] == r {
+					end++
+				}
+				value = append(value, runes[end])
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string in expression")
+			}
+			tokens = append(tokens, exprToken{text: string(value), quoted: true})
+			i = end + 1
+
+		default:
+			if op := exprOperatorAt(runes, i); op != "" {
+				tokens = append(tokens, exprToken{text: op})
+				i += len(op)
+				continue
+			}
+
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' && exprOperatorAt(runes, i) == "" {
+				i++
+			}
+			tokens = append(tokens, exprToken{text: string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
+
+func exprOperatorAt(runes []rune, i int) string {
+	for _, op := range exprOperators {
+		if strings.HasPrefix(string(runes[i:]), op) {
+			return op
+		}
+	}
+	return ""
+}
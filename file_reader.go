@@ -0,0 +1,154 @@
+package pitreos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/avast/retry-go"
+)
+
+// chunkFetchAttempts bounds the downloads of a chunk failing with a
+// transient error.
+const chunkFetchAttempts = 3
+
+// fileReader reads a backed up file by assembling its chunks on the fly,
+// downloading them as needed. Empty chunks, and ranges not covered by
+// any chunk, read as zeros.
+type fileReader struct {
+	pitr   *PITR
+	size   int64
+	chunks []*ChunkDef
+	offset int64
+
+	// Last downloaded chunk, most reads are sequential
+	current     *ChunkDef
+	currentData []byte
+}
+
+// OpenFile returns the content of `filename` in the given backup,
+// assembled from its chunks as it is read. Chunks are downloaded (or
+// read from the cache) only when the range they cover is read, so
+// seeking to part of a large file only transfers what is needed.
+func (p *PITR) OpenFile(backupName, filename string) (io.ReadSeeker, error) {
+	bm, err := p.downloadBackupIndex(backupName)
+	if err != nil {
+		return nil, err
+	}
+
+	if bm.Version != p.filemetaVersion {
+		return nil, fmt.Errorf("incompatible version of backupIndex, expected %s got %s", p.filemetaVersion, bm.Version)
+	}
+
+	file, err := bm.findFileIndex(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.newFileReader(file), nil
+}
+
+func (p *PITR) newFileReader(file *FileIndex) *fileReader {
+	chunks := make([]*ChunkDef, len(file.Chunks))
+	copy(chunks, file.Chunks)
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Start < chunks[j].Start })
+
+	return &fileReader{
+		pitr:   p,
+		size:   file.TotalSize,
+		chunks: chunks,
+	}
+}
+
+func (r *fileReader) Read(buf []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	if remaining := r.size - r.offset; int64(len(buf)) > remaining {
+		buf = buf[:remaining]
+	}
+
+	// First chunk ending at or after the offset
+	idx := sort.Search(len(r.chunks), func(i int) bool { return r.chunks[i].End >= r.offset })
+
+	var n int
+	switch {
+	case idx == len(r.chunks):
+		n = zeroFill(buf, r.size-r.offset)
+	case r.chunks[idx].Start > r.offset:
+		n = zeroFill(buf, r.chunks[idx].Start-r.offset)
+	case r.chunks[idx].IsEmpty:
+		n = zeroFill(buf, r.chunks[idx].End+1-r.offset)
+	default:
+		chunk := r.chunks[idx]
+		data, err := r.chunkData(chunk)
+		if err != nil {
+			return 0, err
+		}
+
+		pos := r.offset - chunk.Start
+		if pos >= int64(len(data)) {
+			return 0, fmt.Errorf("chunk %s is shorter than its definition", chunk.ContentSHA)
+		}
+		n = copy(buf, data[pos:])
+	}
+
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *fileReader) chunkData(chunk *ChunkDef) ([]byte, error) {
+	if r.current == chunk {
+		return r.currentData, nil
+	}
+
+	// Missing and corrupted chunks won't come back on the next attempt
+	var data []byte
+	err := retry.Do(func() (err error) {
+		data, err = r.pitr.fetchChunk(chunk.ContentSHA)
+		return err
+	}, retry.Attempts(chunkFetchAttempts), retry.LastErrorOnly(true), retry.RetryIf(func(err error) bool {
+		return !isNotFound(err) && !errors.Is(err, errInvalidChunkHash)
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	r.current = chunk
+	r.currentData = data
+	return data, nil
+}
+
+func zeroFill(buf []byte, max int64) int {
+	if int64(len(buf)) > max {
+		buf = buf[:max]
+	}
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf)
+}
@@ -0,0 +1,93 @@
+package pitreos
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPITR_OpenFile(t *testing.T) {
+	// Second MiB is all zeros, so stored as an empty chunk
+	content := testContent(3*1024*1024+100, 1)
+	for i := 1024 * 1024; i < 2*1024*1024; i++ {
+		content[i] = 0
+	}
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	source := newTestSourceDir(t, map[string][]byte{"data/a.bin": content})
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+
+	reader, err := pitr.OpenFile(list[0], "data/a.bin")
+	require.NoError(t, err)
+
+	cnt, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, content, cnt)
+
+	tests := []struct {
+		offset int64
+		whence int
+		length int
+		expect []byte
+	}{
+		{offset: 0, whence: io.SeekStart, length: 10, expect: content[:10]},
+		{offset: 1024*1024 - 5, whence: io.SeekStart, length: 10, expect: content[1024*1024-5 : 1024*1024+5]},
+		{offset: 2*1024*1024 - 5, whence: io.SeekStart, length: 10, expect: content[2*1024*1024-5 : 2*1024*1024+5]},
+		{offset: -10, whence: io.SeekEnd, length: 10, expect: content[len(content)-10:]},
+		{offset: -10, whence: io.SeekEnd, length: 100, expect: content[len(content)-10:]},
+		{offset: 10, whence: io.SeekEnd, length: 10, expect: []byte{}},
+	}
+
+	for _, test := range tests {
+		_, err := reader.Seek(test.offset, test.whence)
+		require.NoError(t, err)
+
+		cnt, err := ioutil.ReadAll(io.LimitReader(reader, int64(test.length)))
+		require.NoError(t, err)
+		assert.Equal(t, test.expect, cnt, "offset %d whence %d", test.offset, test.whence)
+	}
+
+	_, err = reader.Seek(-1, io.SeekStart)
+	assert.Error(t, err)
+
+	_, err = pitr.OpenFile(list[0], "missing")
+	assert.Error(t, err)
+}
+
+func TestPITR_OpenFile_BadChunks(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	source := newTestSourceDir(t, map[string][]byte{"a.bin": testContent(2*1024*1024, 1)})
+	require.NoError(t, New(1, 2, time.Minute, storage).GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+	counting := &countingStorage{Storage: storage}
+	pitr := New(1, 2, time.Minute, counting)
+	bm, err := pitr.downloadBackupIndex(list[0])
+	require.NoError(t, err)
+	missing, corrupted := bm.Files[0].Chunks[0].ContentSHA, bm.Files[0].Chunks[1].ContentSHA
+
+	// Neither missing nor corrupted chunks are downloaded again
+	require.NoError(t, storage.store.DeleteObject(storage.ctx, storage.chunkPath(missing)))
+	require.NoError(t, storage.WriteChunk(corrupted, []byte("corrupted")))
+
+	reader, err := pitr.OpenFile(list[0], "a.bin")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), counting.openedChunks)
+
+	_, err = reader.Seek(1024*1024, io.SeekStart)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), counting.openedChunks)
+}
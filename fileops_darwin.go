@@ -5,6 +5,8 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 )
 
 type FileOps struct {
@@ -118,11 +120,18 @@ func getDirFiles(directory string) (fileNames []string, err error) {
 	return
 }
 
-func stringarrayContains(a []string, x string) bool {
-	for _, n := range a {
-		if x == n {
-			return true
-		}
+// cloneFile makes `dst` a reflink clone of `src`. Only Linux's FICLONE is
+// supported.
+func cloneFile(dst, src *os.File) error {
+	return ErrReflinkUnsupported
+}
+
+// fileChangeTime returns the last time the file's content or inode
+// changed.
+func fileChangeTime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
 	}
-	return false
+	return time.Unix(stat.Ctimespec.Unix())
 }
@@ -5,8 +5,11 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 
 	fibmap "github.com/frostschutz/go-fibmap"
+	"go.uber.org/zap"
 )
 
 type FileOps struct {
@@ -167,11 +170,28 @@ func getDirFiles(directory string) (fileNames []string, err error) {
 	return
 }
 
-func stringarrayContains(a []string, x string) bool {
-	for _, n := range a {
-		if x == n {
-			return true
-		}
+// ficlone is the FICLONE ioctl request, `_IOW(0x94, 9, int)`.
+const ficlone = 0x40049409
+
+// cloneFile makes `dst` a reflink clone of `src`, sharing its blocks.
+func cloneFile(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	switch errno {
+	case 0:
+		return nil
+	case syscall.EOPNOTSUPP, syscall.EXDEV, syscall.EINVAL, syscall.ENOTTY, syscall.ENOSYS:
+		zlog.Debug("ficlone failed", zap.String("file_path", src.Name()), zap.Error(errno))
+		return ErrReflinkUnsupported
 	}
-	return false
+	return errno
+}
+
+// fileChangeTime returns the last time the file's content or inode
+// changed.
+func fileChangeTime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(stat.Ctim.Unix())
 }
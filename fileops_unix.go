@@ -0,0 +1,19 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package pitreos
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileHasHoles reports whether fewer blocks are allocated to the file
+// than its size needs.
+func fileHasHoles(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return stat.Blocks*512 < info.Size()
+}
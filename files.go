@@ -35,7 +35,11 @@ func (p *PITR) ListBackupFiles(backupName string, filter Filter) error {
 			return fmt.Errorf("estimating disk size: %w", err)
 		}
 
-		fmt.Fprintf(w, "%s\t%s\t%s\n", humanize.Bytes(size), humanize.Bytes(estimatedDiskSize), file.FileName)
+		name := file.FileName
+		if file.Inconsistent {
+			name += " (inconsistent)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", humanize.Bytes(size), humanize.Bytes(estimatedDiskSize), name)
 		w.Flush()
 	}
 
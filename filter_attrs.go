@@ -0,0 +1,399 @@
+package pitreos
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// FileKind is the kind of a file, as matched by KindFilter.
+type FileKind string
+
+const (
+	FileKindRegular FileKind = "regular"
+	FileKindEmpty   FileKind = "empty"
+	FileKindSparse  FileKind = "sparse"
+	FileKindSymlink FileKind = "symlink"
+)
+
+// FileAttributes are the attributes of a file that an AttributeFilter
+// can match on. When backing up, they come from the local file; when
+// restoring, from its FileIndex.
+type FileAttributes struct {
+	Size    int64
+	ModTime time.Time
+	Kind    FileKind
+}
+
+// AttributeFilter is implemented by filters matching on more than the
+// file name. Backups, restores and listings call MatchAttributes instead
+// of Match on filters implementing it.
+type AttributeFilter interface {
+	Filter
+	MatchAttributes(relativePath string, attrs FileAttributes) bool
+}
+
+// matchFile matches a file against `filter`, with its attributes when
+// the filter supports them.
+func matchFile(filter Filter, relativePath string, attrs FileAttributes) bool {
+	if af, ok := filter.(AttributeFilter); ok {
+		return af.MatchAttributes(relativePath, attrs)
+	}
+	return filter.Match(relativePath)
+}
+
+// localFileAttributes returns the attributes of a file to back up, along
+// with its mode. Symbolic links are followed, as their target is what
+// gets backed up, but keep the symlink kind.
+func localFileAttributes(filePath string) (FileAttributes, os.FileMode, error) {
+	linkInfo, err := os.Lstat(filePath)
+	if err != nil {
+		return FileAttributes{}, 0, err
+	}
+
+	info := linkInfo
+	if linkInfo.Mode()&os.ModeSymlink != 0 {
+		if info, err = os.Stat(filePath); err != nil {
+			return FileAttributes{}, 0, err
+		}
+	}
+
+	attrs := FileAttributes{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		Kind:    FileKindRegular,
+	}
+	switch {
+	case linkInfo.Mode()&os.ModeSymlink != 0:
+		attrs.Kind = FileKindSymlink
+	case info.Size() == 0:
+		attrs.Kind = FileKindEmpty
+	case fileHasHoles(info):
+		attrs.Kind = FileKindSparse
+	}
+	return attrs, linkInfo.Mode(), nil
+}
+
+// Attributes returns the attributes of the file, as it was backed up.
+// Backups made before modification times were recorded match on the
+// backup date instead.
+func (f *FileIndex) Attributes() FileAttributes {
+	attrs := FileAttributes{
+		Size:    f.TotalSize,
+		ModTime: f.Date,
+		Kind:    FileKindRegular,
+	}
+	if f.ModTime != nil {
+		attrs.ModTime = *f.ModTime
+	}
+
+	switch {
+	case f.Mode&os.ModeSymlink != 0:
+		attrs.Kind = FileKindSymlink
+	case f.TotalSize == 0:
+		attrs.Kind = FileKindEmpty
+	default:
+		for _, chunk := range f.Chunks {
+			if chunk.IsEmpty {
+				attrs.Kind = FileKindSparse
+				break
+			}
+		}
+	}
+	return attrs
+}
+
+// AttributeFilterFunc matches files on their attributes only.
+type AttributeFilterFunc func(attrs FileAttributes) bool
+
+// Match is true for any name: the attributes are needed to match.
+func (f AttributeFilterFunc) Match(relativePath string) bool {
+	return true
+}
+
+func (f AttributeFilterFunc) MatchAttributes(relativePath string, attrs FileAttributes) bool {
+	return f(attrs)
+}
+
+func MinSizeFilter(size int64) AttributeFilterFunc {
+	return func(attrs FileAttributes) bool { return attrs.Size >= size }
+}
+
+func MaxSizeFilter(size int64) AttributeFilterFunc {
+	return func(attrs FileAttributes) bool { return attrs.Size <= size }
+}
+
+func ModifiedAfterFilter(t time.Time) AttributeFilterFunc {
+	return func(attrs FileAttributes) bool { return attrs.ModTime.After(t) }
+}
+
+func ModifiedBeforeFilter(t time.Time) AttributeFilterFunc {
+	return func(attrs FileAttributes) bool { return attrs.ModTime.Before(t) }
+}
+
+func KindFilter(kinds ...FileKind) AttributeFilterFunc {
+	return func(attrs FileAttributes) bool {
+		for _, kind := range kinds {
+			if attrs.Kind == kind {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+type andFilter []Filter
+type orFilter []Filter
+type notFilter struct{ inner Filter }
+
+// And matches files matching all of `filters`.
+func And(filters ...Filter) AttributeFilter { return andFilter(filters) }
+
+// Or matches files matching any of `filters`.
+func Or(filters ...Filter) AttributeFilter { return orFilter(filters) }
+
+// Not matches files not matching `filter`.
+func Not(filter Filter) AttributeFilter { return notFilter{filter} }
+
+// Match of And, Or and Not tells whether a file could match on its path
+// alone, like the Match of attribute filters: children are matched with
+// their own Match.
+func (f andFilter) Match(relativePath string) bool {
+	for _, filter := range f {
+		if !filter.Match(relativePath) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f andFilter) MatchAttributes(relativePath string, attrs FileAttributes) bool {
+	for _, filter := range f {
+		if !matchFile(filter, relativePath, attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f orFilter) Match(relativePath string) bool {
+	for _, filter := range f {
+		if filter.Match(relativePath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f orFilter) MatchAttributes(relativePath string, attrs FileAttributes) bool {
+	for _, filter := range f {
+		if matchFile(filter, relativePath, attrs) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match is true when the inner filter needs attributes, as any file
+// could then not match it.
+func (f notFilter) Match(relativePath string) bool {
+	if _, ok := f.inner.(AttributeFilter); ok {
+		return true
+	}
+	return !f.inner.Match(relativePath)
+}
+
+func (f notFilter) MatchAttributes(relativePath string, attrs FileAttributes) bool {
+	return !matchFile(f.inner, relativePath, attrs)
+}
+
+// ParseFilterExpression parses a filter expression, combining with
+// `and`, `or`, `not` and parentheses conditions on:
+//
+//	size   file size, like `size >= 1GB` (<, <=, >, >=, =, !=)
+//	mtime  modification time, like `mtime < 2025-01-01` or `mtime > 2025-01-01T12:00:00Z`
+//	kind   regular, empty, sparse or symlink, like `kind = sparse` (=, !=)
+//	name   glob on the base name, like `name = "*.log*"` (=, !=)
+//	path   regexp on the relative path, like `path ~ "^state/"` (~, !~)
+func ParseFilterExpression(expression string) (AttributeFilter, error) {
+	node, err := parseExpr(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := compileFilterExpr(node)
+	if err != nil {
+		return nil, err
+	}
+	return And(filter), nil
+}
+
+func compileFilterExpr(node exprNode) (Filter, error) {
+	switch n := node.(type) {
+	case exprAnd:
+		left, right, err := compileFilterExprPair(n.left, n.right)
+		if err != nil {
+			return nil, err
+		}
+		return And(left, right), nil
+	case exprOr:
+		left, right, err := compileFilterExprPair(n.left, n.right)
+		if err != nil {
+			return nil, err
+		}
+		return Or(left, right), nil
+	case exprNot:
+		inner, err := compileFilterExpr(n.inner)
+		if err != nil {
+			return nil, err
+		}
+		return Not(inner), nil
+	case exprCondition:
+		return compileFilterCondition(n)
+	}
+	return nil, fmt.Errorf("invalid expression")
+}
+
+func compileFilterExprPair(left, right exprNode) (Filter, Filter, error) {
+	l, err := compileFilterExpr(left)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := compileFilterExpr(right)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, r, nil
+}
+
+func compileFilterCondition(c exprCondition) (Filter, error) {
+	invalidOp := fmt.Errorf("invalid operator %q for %q", c.op, c.field)
+
+	switch strings.ToLower(c.field) {
+	case "size":
+		size, err := humanize.ParseBytes(c.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q: %s", c.value, err)
+		}
+		cmp, err := compareOp(c.op)
+		if err != nil {
+			return nil, invalidOp
+		}
+		return AttributeFilterFunc(func(attrs FileAttributes) bool {
+			return cmp(compareInt64(attrs.Size, int64(size)))
+		}), nil
+
+	case "mtime":
+		t, err := ParseDate(c.value)
+		if err != nil {
+			return nil, err
+		}
+		cmp, err := compareOp(c.op)
+		if err != nil {
+			return nil, invalidOp
+		}
+		return AttributeFilterFunc(func(attrs FileAttributes) bool {
+			return cmp(compareTime(attrs.ModTime, t))
+		}), nil
+
+	case "kind":
+		kind := FileKind(strings.ToLower(c.value))
+		switch kind {
+		case FileKindRegular, FileKindEmpty, FileKindSparse, FileKindSymlink:
+		default:
+			return nil, fmt.Errorf("invalid file kind %q, use one of: regular, empty, sparse, symlink", c.value)
+		}
+		return equalityFilter(c, KindFilter(kind))
+
+	case "name":
+		if _, err := path.Match(c.value, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q: %s", c.value, err)
+		}
+		return equalityFilter(c, FilterFunc(func(relativePath string) bool {
+			matched, _ := path.Match(c.value, path.Base(relativePath))
+			return matched
+		}))
+
+	case "path":
+		re, err := regexp.Compile(c.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regexp %q: %s", c.value, err)
+		}
+		filter := FilterFunc(func(relativePath string) bool { return re.MatchString(relativePath) })
+		switch c.op {
+		case "~":
+			return filter, nil
+		case "!~":
+			return Not(filter), nil
+		}
+		return nil, invalidOp
+	}
+
+	return nil, fmt.Errorf("unknown field %q, use one of: size, mtime, kind, name, path", c.field)
+}
+
+func equalityFilter(c exprCondition, filter Filter) (Filter, error) {
+	switch c.op {
+	case "=":
+		return filter, nil
+	case "!=":
+		return Not(filter), nil
+	}
+	return nil, fmt.Errorf("invalid operator %q for %q", c.op, c.field)
+}
+
+// compareOp returns a function checking the result of a comparison
+// (-1, 0 or 1) against `op`.
+func compareOp(op string) (func(cmp int) bool, error) {
+	switch op {
+	case "<":
+		return func(cmp int) bool { return cmp < 0 }, nil
+	case "<=":
+		return func(cmp int) bool { return cmp <= 0 }, nil
+	case ">":
+		return func(cmp int) bool { return cmp > 0 }, nil
+	case ">=":
+		return func(cmp int) bool { return cmp >= 0 }, nil
+	case "=":
+		return func(cmp int) bool { return cmp == 0 }, nil
+	case "!=":
+		return func(cmp int) bool { return cmp != 0 }, nil
+	}
+	return nil, fmt.Errorf("invalid comparison operator %q", op)
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// ParseDate parses dates as written in filter and backup expressions:
+// RFC3339, 2006-01-02T15:04:05 or 2006-01-02, in UTC unless specified.
+func ParseDate(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, use 2006-01-02 or RFC3339", value)
+}
@@ -0,0 +1,156 @@
+package pitreos
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFilterExpression(t *testing.T) {
+	jan := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+	big := FileAttributes{Size: 2 * 1000 * 1000 * 1000, ModTime: jan, Kind: FileKindRegular}
+	small := FileAttributes{Size: 100, ModTime: jan.AddDate(0, 2, 0), Kind: FileKindRegular}
+	sparse := FileAttributes{Size: 1 << 30, ModTime: jan, Kind: FileKindSparse}
+
+	tests := []struct {
+		expression string
+		path       string
+		attrs      FileAttributes
+		expected   bool
+	}{
+		{"size > 1GB", "a", big, true},
+		{"size>1GB", "a", small, false},
+		{"size <= 100", "a", small, true},
+		{"size != 100B", "a", small, false},
+		{"mtime < 2025-02-01", "a", big, true},
+		{"mtime >= 2025-02-01T00:00:00Z", "a", big, false},
+		{"kind = sparse", "a", sparse, true},
+		{"KIND == SPARSE", "a", big, false},
+		{"kind != sparse", "a", big, true},
+		{`name = "*.log*"`, "blocks/blocks.log", small, true},
+		{`name = '*.log*'`, "blocks.log/index", small, false},
+		{"path ~ ^state/", "state/shared_memory.bin", small, true},
+		{"path !~ ^state/", "state/shared_memory.bin", small, false},
+		{"size > 1GB and kind = sparse", "a", big, false},
+		{"size > 1GB or kind = sparse", "a", sparse, true},
+		{"not kind = sparse", "a", sparse, false},
+		{`size > 1KB AND NOT (name = "*.tmp" or kind = sparse)`, "a.bin", big, true},
+		{`size > 1KB and not (name = "*.tmp" or kind = sparse)`, "a.tmp", big, false},
+		{"kind = regular or kind = sparse and size < 1KB", "a", big, true},
+		{"(kind = regular or kind = sparse) and size < 1KB", "a", big, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			filter, err := ParseFilterExpression(test.expression)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, filter.MatchAttributes(test.path, test.attrs))
+		})
+	}
+
+	for _, invalid := range []string{
+		"",
+		"size",
+		"size >",
+		"size > many",
+		"owner = root",
+		"kind = socket",
+		"kind < sparse",
+		"path = a",
+		"name = [",
+		"path ~ (",
+		"mtime > yesterday",
+		"(size > 1",
+		"size > 1 size < 2",
+		`name = "unterminated`,
+	} {
+		_, err := ParseFilterExpression(invalid)
+		assert.Error(t, err, "expected %q to be invalid", invalid)
+	}
+}
+
+func TestCombinators(t *testing.T) {
+	logs := FilterFunc(func(relativePath string) bool { return filepath.Ext(relativePath) == ".log" })
+	attrs := FileAttributes{Size: 10}
+
+	assert.True(t, matchFile(And(logs, MinSizeFilter(10)), "a.log", attrs))
+	assert.False(t, matchFile(And(logs, MinSizeFilter(11)), "a.log", attrs))
+	assert.True(t, matchFile(Or(logs, MaxSizeFilter(5)), "a.log", attrs))
+	assert.False(t, matchFile(Or(logs, MaxSizeFilter(5)), "a.bin", attrs))
+	assert.True(t, matchFile(Not(logs), "a.bin", attrs))
+	assert.True(t, matchFile(Not(And(logs, KindFilter(FileKindSparse))), "a.log", attrs))
+
+	// Plain filters keep matching on names only
+	assert.True(t, matchFile(AllFileFilter, "a", attrs))
+
+	// Without attributes, files match when their path could
+	assert.True(t, And(MinSizeFilter(1)).Match("a.bin"))
+	assert.True(t, And(logs, MinSizeFilter(1)).Match("a.log"))
+	assert.False(t, And(logs, MinSizeFilter(1)).Match("a.bin"))
+	assert.True(t, Or(logs, MinSizeFilter(1)).Match("a.bin"))
+	assert.False(t, Or(logs).Match("a.bin"))
+	assert.False(t, Not(logs).Match("a.log"))
+	assert.True(t, Not(MinSizeFilter(1)).Match("a.log"))
+}
+
+func TestFileIndex_Attributes(t *testing.T) {
+	date := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	mtime := date.Add(-time.Hour)
+
+	fi := &FileIndex{Date: date, TotalSize: 10, Chunks: []*ChunkDef{{Start: 0, End: 4}, {Start: 5, End: 9, IsEmpty: true}}}
+	assert.Equal(t, FileAttributes{Size: 10, ModTime: date, Kind: FileKindSparse}, fi.Attributes())
+
+	fi = &FileIndex{Date: date, ModTime: &mtime, TotalSize: 0}
+	assert.Equal(t, FileAttributes{Size: 0, ModTime: mtime, Kind: FileKindEmpty}, fi.Attributes())
+
+	fi = &FileIndex{Date: date, ModTime: &mtime, TotalSize: 10, Mode: os.ModeSymlink | 0777}
+	assert.Equal(t, FileKindSymlink, fi.Attributes().Kind)
+}
+
+func TestPITR_GenerateBackup_AttributeFilter(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{
+		"big.bin":   testContent(100, 1),
+		"small.bin": testContent(10, 2),
+		"old.bin":   testContent(100, 3),
+		"empty.bin": nil,
+	})
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(source, "old.bin"), old, old))
+	require.NoError(t, os.Symlink("big.bin", filepath.Join(source, "link.bin")))
+
+	filter, err := ParseFilterExpression("size >= 50 and mtime > 2021-01-01 or kind = empty")
+	require.NoError(t, err)
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, filter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+	bm, err := pitr.downloadBackupIndex(list[0])
+	require.NoError(t, err)
+
+	byName := make(map[string]*FileIndex)
+	for _, file := range bm.Files {
+		byName[file.FileName] = file
+	}
+	assert.Len(t, byName, 3)
+	require.Contains(t, byName, "big.bin")
+	assert.Contains(t, byName, "empty.bin")
+	require.Contains(t, byName, "link.bin")
+	assert.False(t, byName["big.bin"].ModTime.IsZero())
+	assert.Equal(t, FileKindSymlink, byName["link.bin"].Attributes().Kind)
+	assert.Equal(t, int64(100), byName["link.bin"].TotalSize)
+
+	// On restore, attributes come from the index
+	restoreFilter, err := ParseFilterExpression("kind = symlink")
+	require.NoError(t, err)
+	files, err := bm.FindFilesMatching(restoreFilter)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "link.bin", files[0].FileName)
+}
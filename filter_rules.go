@@ -0,0 +1,227 @@
+package pitreos
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFileName is the name of the file, at the root of a backup
+// source, holding exclude rules for the files under it.
+const IgnoreFileName = ".pitreosignore"
+
+// RuleFilter matches files against an ordered list of gitignore-style
+// rules, one per line:
+//
+//	# comment
+//	*.log             excludes any file (or directory) named *.log, at any depth
+//	/state/*.bin      leading or inner slash: relative to the root only
+//	reversible/       trailing slash: only matches directories
+//	**/tmp/**         `**` matches any number of directories
+//	!blocks.log       includes back matching files
+//
+// The last matching rule wins. Files matching no rule are included,
+// unless the first rule is an include (`!pattern`): then only files
+// matching an include rule are.
+type RuleFilter struct {
+	rules           []*filterRule
+	defaultIncluded bool
+}
+
+type filterRule struct {
+	line     string
+	segments []string
+	include  bool
+	dirOnly  bool
+}
+
+// NewRuleFilter parses rules as found in a `.pitreosignore` file. Blank
+// lines and comments are ignored.
+func NewRuleFilter(lines []string) (*RuleFilter, error) {
+	f := &RuleFilter{defaultIncluded: true}
+	for _, line := range lines {
+		rule, err := parseFilterRule(line)
+		if err != nil {
+			return nil, err
+		}
+		if rule == nil {
+			continue
+		}
+
+		if len(f.rules) == 0 && rule.include {
+			f.defaultIncluded = false
+		}
+		f.rules = append(f.rules, rule)
+	}
+	return f, nil
+}
+
+// LoadRuleFilter reads rules from a file like `.pitreosignore`. It
+// returns nil, and no error, when the file doesn't exist.
+func LoadRuleFilter(filename string) (*RuleFilter, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	lines, err := readLines(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %s", filename, err)
+	}
+
+	filter, err := NewRuleFilter(lines)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %s", filename, err)
+	}
+	return filter, nil
+}
+
+// IncludeRule and ExcludeRule turn a pattern into a rule line for
+// NewRuleFilter.
+func IncludeRule(pattern string) string {
+	return "!" + pattern
+}
+
+func ExcludeRule(pattern string) string {
+	if strings.HasPrefix(pattern, "!") || strings.HasPrefix(pattern, "#") {
+		return `\` + pattern
+	}
+	return pattern
+}
+
+// Then returns a filter evaluating the rules of `next` after those of f,
+// so they win. Files matching no rule are included as with f, unless the
+// first rule of `next` is an include: then only files matching an
+// include rule are.
+func (f *RuleFilter) Then(next *RuleFilter) *RuleFilter {
+	out := &RuleFilter{defaultIncluded: f.defaultIncluded && next.defaultIncluded}
+	out.rules = append(append(out.rules, f.rules...), next.rules...)
+	return out
+}
+
+func (f *RuleFilter) Match(relativePath string) bool {
+	relativePath = filepath.ToSlash(relativePath)
+	segments := strings.Split(strings.Trim(relativePath, "/"), "/")
+
+	included := f.defaultIncluded
+	for _, rule := range f.rules {
+		if rule.match(segments) {
+			included = rule.include
+		}
+	}
+	return included
+}
+
+func (f *RuleFilter) String() string {
+	if f == nil || len(f.rules) == 0 {
+		return "<No filtering>"
+	}
+
+	var lines []string
+	for _, rule := range f.rules {
+		lines = append(lines, rule.line)
+	}
+	return fmt.Sprintf("[Rules %s]", strings.Join(lines, ", "))
+}
+
+func parseFilterRule(line string) (*filterRule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	rule := &filterRule{line: line}
+	pattern := line
+	switch {
+	case strings.HasPrefix(pattern, "!"):
+		rule.include = true
+		pattern = pattern[1:]
+	case strings.HasPrefix(pattern, `\!`), strings.HasPrefix(pattern, `\#`):
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	// Without a slash, a pattern matches at any depth
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	if pattern == "" || pattern == "**/" {
+		return nil, fmt.Errorf("invalid filter rule %q", line)
+	}
+
+	rule.segments = strings.Split(pattern, "/")
+	for _, segment := range rule.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid filter rule %q: %s", line, err)
+		}
+	}
+
+	return rule, nil
+}
+
+// match reports whether the rule matches the file, or any of its parent
+// directories.
+func (r *filterRule) match(segments []string) bool {
+	last := len(segments)
+	if r.dirOnly {
+		last--
+	}
+
+	for i := 1; i <= last; i++ {
+		if matchSegments(r.segments, segments[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// A trailing `**` matches everything inside, but not the
+			// directory itself
+			if len(pattern) == 1 {
+				return len(segments) > 0
+			}
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+			return false
+		}
+
+		pattern = pattern[1:]
+		segments = segments[1:]
+	}
+	return len(segments) == 0
+}
+
+func readLines(r io.Reader) (lines []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,183 @@
+package pitreos
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleFilter_Match(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []string
+		included []string
+		excluded []string
+	}{
+		{
+			name:     "no rules",
+			included: []string{"a", "a/b/c"},
+		},
+		{
+			name:     "basename at any depth",
+			rules:    []string{"*.log", "# comment", ""},
+			included: []string{"log", "a/b.txt", "a.log.bak"},
+			excluded: []string{"a.log", "x/y/a.log", "logs.log/inner"},
+		},
+		{
+			name:     "anchored",
+			rules:    []string{"/state/*.bin"},
+			included: []string{"x/state/a.bin", "state/a/b.bin", "state/a.txt"},
+			excluded: []string{"state/a.bin"},
+		},
+		{
+			name:     "inner slash is anchored",
+			rules:    []string{"state/*.bin"},
+			included: []string{"x/state/a.bin"},
+			excluded: []string{"state/a.bin"},
+		},
+		{
+			name:     "directory only",
+			rules:    []string{"reversible/"},
+			included: []string{"reversible", "blocks/reversible"},
+			excluded: []string{"reversible/a", "blocks/reversible/shared.bin"},
+		},
+		{
+			name:     "directory name excludes its content",
+			rules:    []string{"tmp"},
+			included: []string{"tmpfile"},
+			excluded: []string{"tmp", "tmp/a", "a/tmp/b/c"},
+		},
+		{
+			name:     "doublestar",
+			rules:    []string{"/a/**/z.bin"},
+			included: []string{"b/a/z.bin", "a/z.txt"},
+			excluded: []string{"a/z.bin", "a/b/z.bin", "a/b/c/d/z.bin"},
+		},
+		{
+			name:     "trailing doublestar",
+			rules:    []string{"data/**"},
+			included: []string{"data", "x/data/a"},
+			excluded: []string{"data/a", "data/a/b"},
+		},
+		{
+			name:     "negation, last match wins",
+			rules:    []string{"blocks/", "!blocks/blocks.log", "blocks/blocks.log.bak"},
+			included: []string{"blocks/blocks.log", "state/a"},
+			excluded: []string{"blocks/blocks.index", "blocks/blocks.log.bak"},
+		},
+		{
+			name:     "leading include excludes everything else",
+			rules:    []string{"!state/**", "*.tmp"},
+			included: []string{"state/shared_memory.bin"},
+			excluded: []string{"blocks/blocks.log", "state/a.tmp"},
+		},
+		{
+			name:     "escaped",
+			rules:    []string{`\!important`, `\#hash`},
+			included: []string{"important"},
+			excluded: []string{"!important", "#hash"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewRuleFilter(test.rules)
+			require.NoError(t, err)
+
+			for _, name := range test.included {
+				assert.True(t, filter.Match(name), "expected %q to be included", name)
+			}
+			for _, name := range test.excluded {
+				assert.False(t, filter.Match(name), "expected %q to be excluded", name)
+			}
+		})
+	}
+
+	_, err := NewRuleFilter([]string{"a[b"})
+	assert.Error(t, err)
+	_, err = NewRuleFilter([]string{"/"})
+	assert.Error(t, err)
+}
+
+func TestRuleFilter_Rules(t *testing.T) {
+	filter, err := NewRuleFilter([]string{ExcludeRule("*.log"), IncludeRule("keep.log"), ExcludeRule("!odd")})
+	require.NoError(t, err)
+
+	assert.False(t, filter.Match("a.log"))
+	assert.True(t, filter.Match("keep.log"))
+	assert.False(t, filter.Match("!odd"))
+	assert.True(t, filter.Match("odd"))
+}
+
+func TestRuleFilter_Then(t *testing.T) {
+	config, err := NewRuleFilter([]string{"*.log", "/tmp/"})
+	require.NoError(t, err)
+
+	// Later rules win, and an include first restricts to included files
+	flags, err := NewRuleFilter([]string{IncludeRule("state/**"), IncludeRule("*.log")})
+	require.NoError(t, err)
+	filter := config.Then(flags)
+	assert.True(t, filter.Match("state/a.bin"))
+	assert.True(t, filter.Match("a.log"))
+	assert.False(t, filter.Match("blocks/blocks.log.bin"))
+
+	flags, err = NewRuleFilter([]string{ExcludeRule("*.bin")})
+	require.NoError(t, err)
+	filter = config.Then(flags)
+	assert.True(t, filter.Match("config.ini"))
+	assert.False(t, filter.Match("a.log"))
+	assert.False(t, filter.Match("a.bin"))
+
+	// Without rules, the default of f is kept
+	empty, err := NewRuleFilter(nil)
+	require.NoError(t, err)
+	assert.True(t, config.Then(empty).Match("config.ini"))
+	assert.False(t, config.Then(empty).Match("a.log"))
+
+	// An exclude first in `next` keeps f restricted to its included files
+	config, err = NewRuleFilter([]string{IncludeRule("state/**")})
+	require.NoError(t, err)
+	flags, err = NewRuleFilter([]string{ExcludeRule("*.tmp")})
+	require.NoError(t, err)
+	filter = config.Then(flags)
+	assert.True(t, filter.Match("state/shared_memory.bin"))
+	assert.False(t, filter.Match("state/a.tmp"))
+	assert.False(t, filter.Match("blocks/blocks.log"))
+}
+
+func TestPITR_GenerateBackup_IgnoreFile(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{
+		"blocks/blocks.log":         testContent(10, 1),
+		"blocks/reversible/a.bin":   testContent(10, 2),
+		"state/shared_memory.bin":   testContent(10, 3),
+		"state/shared_memory.bin~":  testContent(10, 4),
+		"protocol_features/a.json":  testContent(10, 5),
+		"protocol_features/a.json~": testContent(10, 6),
+	})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, IgnoreFileName), []byte("# nodeos\nreversible/\n*~\n!protocol_features/*~\n"), 0644))
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+	bm, err := pitr.downloadBackupIndex(list[0])
+	require.NoError(t, err)
+
+	var names []string
+	for _, file := range bm.Files {
+		names = append(names, file.FileName)
+	}
+	assert.ElementsMatch(t, []string{
+		IgnoreFileName,
+		"blocks/blocks.log",
+		"state/shared_memory.bin",
+		"protocol_features/a.json",
+		"protocol_features/a.json~",
+	}, names)
+}
@@ -3,8 +3,10 @@ module github.com/eoscanada/pitreos
 go 1.14
 
 require (
+	cloud.google.com/go/storage v1.4.0
 	github.com/abourget/llerrgroup v0.0.0-20161118145731-75f536392d17
 	github.com/avast/retry-go v2.6.0+incompatible
+	github.com/aws/aws-sdk-go v1.25.43
 	github.com/dfuse-io/dstore v0.1.0
 	github.com/dfuse-io/logging v0.0.0-20200406213449-45fc25dc6a8d
 	github.com/dustin/go-humanize v1.0.0
@@ -14,10 +16,12 @@ require (
 	github.com/google/go-cmp v0.4.0 // indirect
 	github.com/hashicorp/hcl v0.0.0-20180404174102-ef8a98b0bbce // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/klauspost/compress v1.10.2
 	github.com/magiconair/properties v1.8.0 // indirect
 	github.com/mitchellh/go-homedir v0.0.0-20180801233206-58046073cbff
 	github.com/mitchellh/mapstructure v0.0.0-20180715050151-f15292f7a699 // indirect
 	github.com/pelletier/go-toml v1.2.1-0.20180724185102-c2dbbc24a979 // indirect
+	github.com/pkg/sftp v1.11.0
 	github.com/spf13/afero v1.1.1 // indirect
 	github.com/spf13/cast v1.2.0 // indirect
 	github.com/spf13/cobra v0.0.4-0.20180821161202-6fd8e29b07d8
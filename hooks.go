@@ -0,0 +1,131 @@
+package pitreos
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Hooks are shell commands, run with `sh -c`, around backups and
+// restores, like to pause an application while it is being backed up.
+// Empty hooks are skipped.
+//
+// Hooks get the details of the operation as environment variables:
+//
+//	PITREOS_HOOK         name of the hook, like `pre-backup`
+//	PITREOS_OPERATION    backup or restore
+//	PITREOS_BACKUP_NAME  name of the backup
+//	PITREOS_TAG          tag of the backup
+//	PITREOS_SOURCE       directory backed up, or `name=dir,...` for roots
+//	PITREOS_DESTINATION  directory restored to, or `name=dir,...` for roots
+//	PITREOS_FILES        number of files backed up or restored (post hooks)
+//	PITREOS_TOTAL_SIZE   total size of these files, in bytes (post hooks)
+//	PITREOS_CHUNKS       number of chunks of these files (post hooks)
+//	PITREOS_DURATION     duration of the operation, in seconds (post hooks)
+//	PITREOS_ERROR        error of the operation (on-failure)
+//
+// When the pre-backup hook prints a JSON object, it is merged into the
+// metadata of the backup, overriding keys given to GenerateBackup, like
+// the head block number reported by the application. The output of
+// other hooks is logged.
+type Hooks struct {
+	PreBackup   string
+	PostBackup  string
+	PreRestore  string
+	PostRestore string
+
+	// OnFailure runs when a backup or restore fails, including when one
+	// of its other hooks fails.
+	OnFailure string
+}
+
+// hookEnv are the environment variables of hooks, without their
+// `PITREOS_` prefix.
+type hookEnv map[string]string
+
+func (env hookEnv) setStats(files []*FileIndex, started time.Time) {
+	var totalSize int64
+	var chunks int
+	for _, file := range files {
+		totalSize += file.TotalSize
+		chunks += len(file.Chunks)
+	}
+
+	env["FILES"] = strconv.Itoa(len(files))
+	env["TOTAL_SIZE"] = strconv.FormatInt(totalSize, 10)
+	env["CHUNKS"] = strconv.Itoa(chunks)
+	env["DURATION"] = strconv.FormatFloat(time.Since(started).Seconds(), 'f', 3, 64)
+}
+
+// runHook runs the `name` hook, when set, and returns the JSON object it
+// printed, if any.
+func runHook(name, command string, env hookEnv) (map[string]interface{}, error) {
+	if command == "" {
+		return nil, nil
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "PITREOS_HOOK="+name)
+	var keys []string
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PITREOS_%s=%s", key, env[key]))
+	}
+
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+
+	zlog.Info("running hook", zap.String("hook", name), zap.String("command", command))
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s hook: %s", name, err)
+	}
+
+	output := bytes.TrimSpace(stdout.Bytes())
+	if !bytes.HasPrefix(output, []byte("{")) {
+		if len(output) > 0 {
+			zlog.Info("hook output", zap.String("hook", name), zap.String("output", string(output)))
+		}
+		return nil, nil
+	}
+
+	var out map[string]interface{}
+	if err := json.Unmarshal(output, &out); err != nil {
+		return nil, fmt.Errorf("%s hook: invalid JSON output: %s", name, err)
+	}
+	return out, nil
+}
+
+// runFailureHook runs the on-failure hook after `err`. Its own failure is
+// only logged, `err` being what the caller returns.
+func (h Hooks) runFailureHook(env hookEnv, err error) {
+	env["ERROR"] = err.Error()
+	if _, hookErr := runHook("on-failure", h.OnFailure, env); hookErr != nil {
+		zlog.Warn("on-failure hook failed", zap.Error(hookErr))
+	}
+}
+
+// rootsString formats `roots` for hooks, as they are given on the command
+// line.
+func rootsString(roots []Root) string {
+	var parts []string
+	for _, root := range roots {
+		if root.Name == "" {
+			parts = append(parts, root.Path)
+			continue
+		}
+		parts = append(parts, root.Name+"="+root.Path)
+	}
+	return strings.Join(parts, ",")
+}
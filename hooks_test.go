@@ -0,0 +1,194 @@
+package pitreos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunHook(t *testing.T) {
+	out, err := runHook("pre-backup", "", nil)
+	require.NoError(t, err)
+	assert.Nil(t, out)
+
+	out, err = runHook("pre-backup", `echo "{\"tag\": \"$PITREOS_TAG\", \"hook\": \"$PITREOS_HOOK\"}"`, hookEnv{"TAG": "prod"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"tag": "prod", "hook": "pre-backup"}, out)
+
+	out, err = runHook("post-backup", "echo paused", nil)
+	require.NoError(t, err)
+	assert.Nil(t, out)
+
+	_, err = runHook("pre-backup", "echo '{invalid'", nil)
+	assert.Error(t, err)
+
+	_, err = runHook("pre-backup", "exit 3", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pre-backup hook")
+}
+
+func TestPITR_GenerateBackup_Hooks(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{"a": testContent(100, 1), "b": testContent(50, 2)})
+	logDir, err := ioutil.TempDir("", "pitreos-hooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(logDir)
+	log := filepath.Join(logDir, "log")
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.Hooks = Hooks{
+		PreBackup:  `echo "$PITREOS_HOOK $PITREOS_TAG $PITREOS_SOURCE" >> ` + log + `; echo '{"blocknum": 1234}'`,
+		PostBackup: `echo "$PITREOS_HOOK $PITREOS_BACKUP_NAME $PITREOS_FILES $PITREOS_TOTAL_SIZE" >> ` + log,
+		OnFailure:  `echo "$PITREOS_HOOK $PITREOS_ERROR" >> ` + log,
+	}
+	require.NoError(t, pitr.GenerateBackup(source, "prod", map[string]interface{}{"version": "1.2.1", "blocknum": 1}, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	meta, err := pitr.GetBackupMeta(list[0])
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"version": "1.2.1", "blocknum": float64(1234)}, meta.Meta)
+
+	content, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"pre-backup prod " + source,
+		"post-backup " + list[0] + " 2 150",
+	}, strings.Split(strings.TrimSpace(string(content)), "\n"))
+
+	// A failing pre-backup hook fails the backup, and runs on-failure
+	require.NoError(t, os.Remove(log))
+	pitr.Hooks.PreBackup = "exit 1"
+	assert.Error(t, pitr.GenerateBackup(source, "prod", nil, AllFileFilter))
+	content, err = ioutil.ReadFile(log)
+	require.NoError(t, err)
+	assert.Equal(t, "on-failure pre-backup hook: exit status 1\n", string(content))
+
+	list, err = storage.ListBackups(10, "")
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func TestPITR_RestoreFromBackup_Hooks(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{"a": testContent(100, 1)})
+	dest, err := ioutil.TempDir("", "pitreos-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	logDir, err := ioutil.TempDir("", "pitreos-hooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(logDir)
+	log := filepath.Join(logDir, "log")
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	require.NoError(t, pitr.GenerateBackup(source, "prod", nil, AllFileFilter))
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+
+	pitr.Hooks = Hooks{
+		PreRestore:  `echo "$PITREOS_HOOK $PITREOS_TAG $PITREOS_DESTINATION" >> ` + log,
+		PostRestore: `echo "$PITREOS_HOOK $PITREOS_BACKUP_NAME $PITREOS_FILES" >> ` + log,
+	}
+	require.NoError(t, pitr.RestoreFromBackup(dest, list[0], AllFileFilter))
+
+	content, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"pre-restore prod " + dest,
+		"post-restore " + list[0] + " 1",
+	}, strings.Split(strings.TrimSpace(string(content)), "\n"))
+}
+
+// failingChunkStorage fails every chunk upload.
+type failingChunkStorage struct {
+	*DStoreStorage
+}
+
+func (s *failingChunkStorage) WriteChunk(hash string, content []byte) error {
+	return fmt.Errorf("upload failed")
+}
+
+func TestPITR_GenerateBackup_FailedUploadRunsOnFailure(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{"a": testContent(100, 1)})
+	logDir, err := ioutil.TempDir("", "pitreos-hooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(logDir)
+	log := filepath.Join(logDir, "log")
+
+	storage := &failingChunkStorage{DStoreStorage: newTestLocalStorage(t)}
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.LockTTL = time.Minute
+	pitr.Hooks = Hooks{OnFailure: `echo "$PITREOS_HOOK $PITREOS_ERROR" >> ` + log}
+
+	err = pitr.GenerateBackup(source, "prod", nil, AllFileFilter)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "upload failed")
+
+	content, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "on-failure")
+	assert.Contains(t, string(content), "upload failed")
+
+	// The lock on the tag was released
+	locks, err := pitr.ListLocks()
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+}
+
+// slowFailingChunkStorage fails the first chunk upload, and completes the
+// other ones slowly.
+type slowFailingChunkStorage struct {
+	*DStoreStorage
+	uploads int32
+}
+
+func (s *slowFailingChunkStorage) WriteChunk(hash string, content []byte) error {
+	if atomic.AddInt32(&s.uploads, 1) == 1 {
+		return fmt.Errorf("upload failed")
+	}
+	time.Sleep(50 * time.Millisecond)
+	return s.DStoreStorage.WriteChunk(hash, content)
+}
+
+func TestPITR_GenerateBackup_FailedUploadWaitsForOthers(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{"a": testContent(8*1024*1024, 1)})
+
+	storage := &slowFailingChunkStorage{DStoreStorage: newTestLocalStorage(t)}
+	pitr := New(1, 4, time.Minute, storage)
+
+	err := pitr.GenerateBackup(source, "prod", nil, AllFileFilter)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "upload failed")
+}
+
+func TestPITR_GenerateBackup_LockedRunsOnFailure(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{"a": testContent(100, 1)})
+	logDir, err := ioutil.TempDir("", "pitreos-hooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(logDir)
+	log := filepath.Join(logDir, "log")
+
+	pitr := New(1, 2, time.Minute, newTestLocalStorage(t))
+	pitr.LockTTL = time.Minute
+	pitr.Hooks = Hooks{OnFailure: `echo "$PITREOS_HOOK $PITREOS_ERROR" >> ` + log}
+
+	lease, err := pitr.AcquireLock("prod", "backup", time.Minute)
+	require.NoError(t, err)
+	defer lease.Release()
+
+	err = pitr.GenerateBackup(source, "prod", nil, AllFileFilter)
+	assert.IsType(t, &LockedError{}, err)
+
+	content, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "on-failure")
+}
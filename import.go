@@ -0,0 +1,167 @@
+package pitreos
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/abourget/llerrgroup"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
+)
+
+// ImportBackup creates a backup from the regular files of the
+// (uncompressed) tar archive read from `r`, chunking, hashing and
+// uploading them straight from the stream. Holes of sparse entries, and
+// any other all-zero chunk, become empty chunks.
+//
+// Directories, links and other special entries are skipped. It returns
+// the name of the created backup.
+func (p *PITR) ImportBackup(r io.Reader, tag string, metadata map[string]interface{}, filter Filter) (string, error) {
+	now := time.Now()
+	backupName := makeBackupName(now, tag)
+	bm := &BackupIndex{
+		ChunkSize: p.chunkSize,
+		Date:      now.UTC(),
+		Version:   p.filemetaVersion,
+		Tag:       tag,
+		Meta:      metadata,
+	}
+
+	filesByName := make(map[string]int)
+	eg := llerrgroup.New(p.threads)
+	// fail waits for running uploads before returning, preferring their
+	// error, as importFile only reports that one failed
+	fail := func(err error) (string, error) {
+		if uploadErr := eg.Wait(); uploadErr != nil {
+			return "", uploadErr
+		}
+		return "", err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(fmt.Errorf("reading archive: %s", err))
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeGNUSparse {
+			zlog.Debug("skipping archive entry", zap.String("name", hdr.Name), zap.String("type", string(hdr.Typeflag)))
+			continue
+		}
+
+		fileName, err := archiveEntryName(hdr.Name)
+		if err != nil {
+			return fail(err)
+		}
+		attrs := FileAttributes{Size: hdr.Size, ModTime: hdr.ModTime.UTC(), Kind: FileKindRegular}
+		switch {
+		case hdr.Size == 0:
+			attrs.Kind = FileKindEmpty
+		case hdr.Typeflag == tar.TypeGNUSparse:
+			attrs.Kind = FileKindSparse
+		}
+		if !matchFile(filter, fileName, attrs) {
+			continue
+		}
+
+		fileMeta, err := p.importFile(eg, tr, fileName, hdr.Size, now)
+		if err != nil {
+			return fail(fmt.Errorf("importing %q: %s", fileName, err))
+		}
+		fileMeta.ModTime = &attrs.ModTime
+		fileMeta.Mode = os.FileMode(hdr.Mode).Perm()
+
+		// Later entries replace earlier ones, like when extracting
+		if idx, found := filesByName[fileName]; found {
+			bm.Files[idx] = fileMeta
+			continue
+		}
+		filesByName[fileName] = len(bm.Files)
+		bm.Files = append(bm.Files, fileMeta)
+	}
+
+	if err := eg.Wait(); err != nil {
+		return "", err
+	}
+
+	if err := p.uploadBackupIndexYamlFile(backupName, bm); err != nil {
+		return "", fmt.Errorf("upload backup index: %s", err)
+	}
+
+	zlog.Debug("backup index uploaded", zap.String("backup_name", backupName))
+	return backupName, nil
+}
+
+// importFile reads the content of a file from `r` chunk by chunk, and
+// uploads the chunks through `eg`. The returned FileIndex is complete
+// once `eg` is done.
+func (p *PITR) importFile(eg *llerrgroup.Group, r io.Reader, fileName string, size int64, timestamp time.Time) (*FileIndex, error) {
+	zlog.Info("importing file", zap.String("file_name", fileName), zap.Int64("size", size))
+
+	fileMeta := &FileIndex{
+		FileName:  fileName,
+		TotalSize: size,
+		Date:      timestamp,
+	}
+
+	for start := int64(0); start < size; start += p.chunkSize {
+		partSize := p.chunkSize
+		if size-start < partSize {
+			partSize = size - start
+		}
+
+		// Each chunk needs its own buffer, as it is uploaded concurrently
+		partBuffer := make([]byte, partSize)
+		if _, err := io.ReadFull(r, partBuffer); err != nil {
+			return nil, fmt.Errorf("reading chunk at %d: %s", start, err)
+		}
+
+		chunkMeta := &ChunkDef{
+			Start: start,
+			End:   start + partSize - 1,
+		}
+		fileMeta.Chunks = append(fileMeta.Chunks, chunkMeta)
+
+		if isEmptyChunk(partBuffer) {
+			chunkMeta.IsEmpty = true
+			continue
+		}
+
+		if eg.Stop() {
+			return nil, fmt.Errorf("one of the threads failed, stopping")
+		}
+
+		eg.Go(func() error {
+			chunkMeta.ContentSHA = fmt.Sprintf("%x", sha3.Sum256(partBuffer))
+
+			if p.cacheStorage != nil {
+				if err := p.cacheStorage.WriteChunk(chunkMeta.ContentSHA, partBuffer); err != nil {
+					return fmt.Errorf("cache storage writechunk: %s", err)
+				}
+			}
+
+			_, err := p.writeChunkIfAbsent(chunkMeta.ContentSHA, partBuffer)
+			return err
+		})
+	}
+
+	return fileMeta, nil
+}
+
+// archiveEntryName turns the name of an archive entry into a relative
+// file name, refusing names escaping the archive root.
+func archiveEntryName(name string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean(name), "/")
+	if cleaned == "" || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid archive entry name %q", name)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,147 @@
+package pitreos
+
+import (
+	"archive/tar"
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPITR_ImportBackup(t *testing.T) {
+	content := testContent(2*1024*1024+10, 1)
+	for i := 0; i < 1024*1024; i++ {
+		content[i] = 0
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, entry := range []struct {
+		hdr     *tar.Header
+		content []byte
+	}{
+		{&tar.Header{Typeflag: tar.TypeDir, Name: "./state/", Mode: 0755}, nil},
+		{&tar.Header{Typeflag: tar.TypeReg, Name: "./state/shared.bin", Mode: 0644}, content},
+		{&tar.Header{Typeflag: tar.TypeReg, Name: "config.ini", Mode: 0644}, []byte("old")},
+		{&tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "config.ini"}, nil},
+		{&tar.Header{Typeflag: tar.TypeReg, Name: "config.ini", Mode: 0644}, []byte("new")},
+	} {
+		entry.hdr.Size = int64(len(entry.content))
+		require.NoError(t, tw.WriteHeader(entry.hdr))
+		_, err := tw.Write(entry.content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+
+	backupName, err := pitr.ImportBackup(buf, "partner", map[string]interface{}{"source": "partner"}, AllFileFilter)
+	require.NoError(t, err)
+	assert.Contains(t, backupName, "--partner")
+
+	bm, err := pitr.downloadBackupIndex(backupName)
+	require.NoError(t, err)
+	assert.Equal(t, "partner", bm.Tag)
+	assert.Equal(t, "partner", bm.Meta["source"])
+	require.Len(t, bm.Files, 2)
+	assert.Equal(t, "state/shared.bin", bm.Files[0].FileName)
+	assert.Equal(t, "config.ini", bm.Files[1].FileName)
+
+	require.Len(t, bm.Files[0].Chunks, 3)
+	assert.True(t, bm.Files[0].Chunks[0].IsEmpty)
+	assert.False(t, bm.Files[0].Chunks[1].IsEmpty)
+
+	restoreDir := newTestSourceDir(t, nil)
+	require.NoError(t, pitr.RestoreFromBackup(restoreDir, backupName, AllFileFilter))
+	assertSameFiles(t, newTestSourceDir(t, map[string][]byte{
+		"state/shared.bin": content,
+		"config.ini":       []byte("new"),
+	}), restoreDir, "state/shared.bin", "config.ini")
+}
+
+func TestPITR_ImportBackup_ExportedArchive(t *testing.T) {
+	// Middle MiB is all zeros, so exported as a sparse entry
+	content := testContent(3*1024*1024, 1)
+	for i := 1024 * 1024; i < 2*1024*1024; i++ {
+		content[i] = 0
+	}
+	source := newTestSourceDir(t, map[string][]byte{"data/a.bin": content})
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, pitr.ExportBackup(buf, list[0], AllFileFilter))
+
+	backupName, err := pitr.ImportBackup(buf, "imported", nil, AllFileFilter)
+	require.NoError(t, err)
+
+	original, err := pitr.downloadBackupIndex(list[0])
+	require.NoError(t, err)
+	imported, err := pitr.downloadBackupIndex(backupName)
+	require.NoError(t, err)
+	// Backups list chunks in upload order
+	assert.ElementsMatch(t, original.Files[0].Chunks, imported.Files[0].Chunks)
+}
+
+// slowChunkStorage delays chunk writes, tracking how many are running
+type slowChunkStorage struct {
+	*DStoreStorage
+	running int32
+}
+
+func (s *slowChunkStorage) WriteChunk(hash string, content []byte) error {
+	atomic.AddInt32(&s.running, 1)
+	defer atomic.AddInt32(&s.running, -1)
+	time.Sleep(100 * time.Millisecond)
+	return s.DStoreStorage.WriteChunk(hash, content)
+}
+
+func TestPITR_ImportBackup_TruncatedArchive(t *testing.T) {
+	content := testContent(2*1024*1024, 1)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "a.bin", Mode: 0644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "b.bin", Mode: 0644, Size: int64(len(content))}))
+	_, err = tw.Write(content[:1024*1024+10])
+	require.NoError(t, err)
+
+	storage := &slowChunkStorage{DStoreStorage: newTestLocalStorage(t)}
+	pitr := New(1, 2, time.Minute, storage)
+
+	_, err = pitr.ImportBackup(buf, "partner", nil, AllFileFilter)
+	require.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&storage.running))
+}
+
+func TestArchiveEntryName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"a/b":         "a/b",
+		"./a/b":       "a/b",
+		"/a/b":        "a/b",
+		"a/../b":      "b",
+		"/../a":       "a",
+		"..":          "",
+		"../a":        "",
+		"a/../../etc": "",
+		".":           "",
+	} {
+		actual, err := archiveEntryName(name)
+		if expected == "" {
+			assert.Error(t, err, name)
+			continue
+		}
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, actual, name)
+	}
+}
@@ -3,12 +3,19 @@ package pitreos
 import (
 	"fmt"
 	"math"
-	"strings"
+	"sort"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// GetLatestBackup returns the name of the newest backup with exactly
+// `tag`, from the `latest` ref of the tag when there is one.
 func (p *PITR) GetLatestBackup(tag string) (string, error) {
+	return p.ResolveChannel(tag, LatestChannel)
+}
+
+func (p *PITR) findLatestBackup(tag string) (string, error) {
 	list, err := p.storage.ListBackups(math.MaxInt32, "")
 	if err != nil {
 		return "", err
@@ -17,7 +24,7 @@ func (p *PITR) GetLatestBackup(tag string) (string, error) {
 	for i := len(list) - 1; i >= 0; i-- {
 		candidate := list[i]
 		zlog.Debug("Found candidate backup", zap.String("name", candidate))
-		if strings.HasSuffix(candidate, tag) {
+		if backupHasTag(candidate, tag) {
 			zlog.Debug("Found matching backup", zap.String("name", candidate))
 			return candidate, nil
 		}
@@ -26,22 +33,120 @@ func (p *PITR) GetLatestBackup(tag string) (string, error) {
 	return "", fmt.Errorf("no backup found")
 }
 
+// BackupCriteria selects a backup with FindBackup. Zero fields match any
+// backup.
+type BackupCriteria struct {
+	// Tag is the exact tag of the backup
+	Tag string
+	// At is the time the backup must have been made at or before
+	At time.Time
+	// BeforeMeta holds metadata values the backup must be at or below,
+	// compared as numbers when both sides are, like `blocknum: 123456`
+	BeforeMeta map[string]string
+}
+
+// FindBackup returns the name of the newest backup matching `criteria`.
+// Backup dates are read from backup names, metadata is only fetched for
+// candidates, newest first.
+func (p *PITR) FindBackup(criteria BackupCriteria) (string, error) {
+	list, err := p.storage.ListBackups(math.MaxInt32, "")
+	if err != nil {
+		return "", err
+	}
+
+	type candidate struct {
+		name string
+		date time.Time
+	}
+	var candidates []candidate
+	for _, name := range list {
+		date, tag, err := ParseBackupName(name)
+		if err != nil {
+			zlog.Debug("skipping backup", zap.String("name", name), zap.Error(err))
+			continue
+		}
+		if criteria.Tag != "" && tag != criteria.Tag {
+			continue
+		}
+		if !criteria.At.IsZero() && date.After(criteria.At) {
+			continue
+		}
+		candidates = append(candidates, candidate{name, date})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].date.Before(candidates[j].date) })
+
+	for i := len(candidates) - 1; i >= 0; i-- {
+		name := candidates[i].name
+		if len(criteria.BeforeMeta) == 0 {
+			return name, nil
+		}
+
+		meta, err := p.GetBackupMeta(name)
+		if err != nil {
+			return "", err
+		}
+		if metaAtOrBefore(meta, criteria.BeforeMeta) {
+			zlog.Debug("found matching backup", zap.String("name", name))
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("no backup found")
+}
+
+func metaAtOrBefore(meta *BackupMeta, values map[string]string) bool {
+	for key, value := range values {
+		v, found := lookupMeta(meta.Meta, key)
+		if !found || compareMetaValues(metaValueString(v), value) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (p *PITR) ListBackups(limit, offset int, prefix string, withMeta bool) (out []*ListableBackup, err error) {
 	list, err := p.storage.ListBackups(offset+limit, prefix)
 	if err != nil {
 		return nil, err
 	}
+	return p.listableBackups(list, offset, withMeta)
+}
+
+// ListTaggedBackups is ListBackups, only returning backups with exactly
+// `tag`. Tags end backup names, so storages can't filter on them: all
+// backups starting with `prefix` are listed, then filtered here.
+func (p *PITR) ListTaggedBackups(limit, offset int, prefix, tag string, withMeta bool) (out []*ListableBackup, err error) {
+	list, err := p.storage.ListBackups(math.MaxInt32, prefix)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, el := range list[offset:] {
-		newBackup := &ListableBackup{Name: el}
-		if withMeta {
-			bi, err := p.downloadBackupIndex(el)
-			if err != nil {
-				return nil, err
-			}
-			newBackup.Meta = bi.Meta
+	list = filterBackupsByTag(list, tag)
+	if len(list) > offset+limit {
+		list = list[:offset+limit]
+	}
+	return p.listableBackups(list, offset, withMeta)
+}
+
+func (p *PITR) listableBackups(list []string, offset int, withMeta bool) (out []*ListableBackup, err error) {
+	if offset >= len(list) {
+		return nil, nil
+	}
+
+	list = list[offset:]
+	if !withMeta {
+		for _, el := range list {
+			out = append(out, &ListableBackup{Name: el})
 		}
-		out = append(out, newBackup)
+		return
+	}
+
+	metas, err := p.getBackupMetas(list)
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range metas {
+		out = append(out, &ListableBackup{Name: meta.Name, Meta: meta.Meta})
 	}
 	return
 }
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -35,3 +37,51 @@ func TestPITR_ListBackups(t *testing.T) {
 	require.Equal(t, expected, bk)
 
 }
+
+func TestParseBackupName(t *testing.T) {
+	now := time.Date(2018, 8, 28, 18, 15, 45, 123, time.UTC)
+	date, tag, err := ParseBackupName(makeBackupName(now, "my--tag"))
+	require.NoError(t, err)
+	assert.Equal(t, now.Truncate(time.Second), date)
+	assert.Equal(t, "my--tag", tag)
+
+	for _, invalid := range []string{"default", "2018-08-28--default", "yesterday--default"} {
+		_, _, err := ParseBackupName(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPITR_FindBackup(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+
+	day := func(d int) time.Time { return time.Date(2025, 1, d, 0, 0, 0, 0, time.UTC) }
+	for d, tag := range map[int]string{1: "prod", 2: "prod", 3: "dev", 4: "prod"} {
+		bi := &BackupIndex{Date: day(d), Tag: tag, Meta: map[string]interface{}{"blocknum": d * 1000}}
+		require.NoError(t, pitr.uploadBackupIndexYamlFile(makeBackupName(day(d), tag), bi))
+	}
+	require.NoError(t, storage.WriteBackupIndex("not-a-backup-name", nil))
+
+	tests := []struct {
+		criteria BackupCriteria
+		expected string
+	}{
+		{BackupCriteria{}, "2025-01-04-00-00-00--prod"},
+		{BackupCriteria{Tag: "dev"}, "2025-01-03-00-00-00--dev"},
+		{BackupCriteria{Tag: "prod", At: day(3)}, "2025-01-02-00-00-00--prod"},
+		{BackupCriteria{At: day(3).Add(time.Second)}, "2025-01-03-00-00-00--dev"},
+		{BackupCriteria{At: time.Date(2025, 1, 2, 1, 0, 0, 0, time.FixedZone("", 3600))}, "2025-01-02-00-00-00--prod"},
+		{BackupCriteria{Tag: "prod", BeforeMeta: map[string]string{"blocknum": "3999"}}, "2025-01-02-00-00-00--prod"},
+		{BackupCriteria{BeforeMeta: map[string]string{"blocknum": "1000"}}, "2025-01-01-00-00-00--prod"},
+	}
+	for _, test := range tests {
+		name, err := pitr.FindBackup(test.criteria)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, name, "%+v", test.criteria)
+	}
+
+	_, err := pitr.FindBackup(BackupCriteria{At: day(1).Add(-time.Second)})
+	assert.Error(t, err)
+	_, err = pitr.FindBackup(BackupCriteria{BeforeMeta: map[string]string{"missing": "1"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,396 @@
+package pitreos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultLockTTL is how long a lock is held without a heartbeat from its
+// holder. Holders renew their locks every third of it.
+const DefaultLockTTL = 2 * time.Minute
+
+// MinLockTTL is the shortest time to live accepted by AcquireLock.
+const MinLockTTL = time.Second
+
+// lockWaitInterval is how often a held lock is retried by waitForLock.
+const lockWaitInterval = 200 * time.Millisecond
+
+// LockStorage is implemented by storages able to keep locks, stored as
+// `locks/{name}.json`.
+type LockStorage interface {
+	ListLocks() ([]string, error)
+	OpenLock(name string) (io.ReadCloser, error)
+	WriteLock(name string, content []byte) error
+	DeleteLock(name string) error
+}
+
+// ConditionalLockStorage is implemented by storages able to write a lock
+// only if it is still at the version last read, like with the ETag of
+// S3 objects. An empty version means the lock must not exist yet.
+type ConditionalLockStorage interface {
+	LockStorage
+	OpenLockVersion(name string) (io.ReadCloser, string, error)
+	WriteLockIfVersion(name string, content []byte, version string) (written bool, err error)
+}
+
+// asConditionalLockStorage returns `storage` as a ConditionalLockStorage
+// when it supports conditional writes, through the storages it wraps.
+func asConditionalLockStorage(storage interface{}) (ConditionalLockStorage, bool) {
+	conditional, ok := storage.(ConditionalLockStorage)
+	if !ok {
+		return nil, false
+	}
+	if wrapper, ok := storage.(conditionalSupport); ok && !wrapper.supportsConditionalLocks() {
+		return nil, false
+	}
+	return conditional, true
+}
+
+// Lock is a lease on a name, like the tag of backups, held by a single
+// process at a time. It expires unless its holder renews it.
+type Lock struct {
+	Name      string    `json:"name"`
+	ID        string    `json:"id"`
+	Holder    string    `json:"holder"`
+	Operation string    `json:"operation"`
+	Acquired  time.Time `json:"acquired"`
+	Renewed   time.Time `json:"renewed"`
+	Expires   time.Time `json:"expires"`
+}
+
+func (l *Lock) Expired(now time.Time) bool {
+	return now.After(l.Expires)
+}
+
+// LockedError is returned when acquiring a lock held by someone else.
+type LockedError struct {
+	Lock *Lock
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%q is locked by %s (%s), since %s, until %s", e.Lock.Name, e.Lock.Holder, e.Lock.Operation, e.Lock.Acquired.Format(time.RFC3339), e.Lock.Expires.Format(time.RFC3339))
+}
+
+// Lease is a lock acquired by this process, renewed in the background
+// until released.
+type Lease struct {
+	storage LockStorage
+	ttl     time.Duration
+
+	lock sync.Mutex
+	held Lock
+	err  error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func lockHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+func readLock(storage LockStorage, name string) (*Lock, error) {
+	content, err := readAllAndClose(storage.OpenLock(name))
+	if err != nil {
+		return nil, err
+	}
+
+	var lock *Lock
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, fmt.Errorf("unmarshal lock %q: %s", name, err)
+	}
+	return lock, nil
+}
+
+func readLockVersion(storage ConditionalLockStorage, name string) (*Lock, string, error) {
+	reader, version, err := storage.OpenLockVersion(name)
+	content, err := readAllAndClose(reader, err)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var lock *Lock
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, "", fmt.Errorf("unmarshal lock %q: %s", name, err)
+	}
+	return lock, version, nil
+}
+
+func writeLock(storage LockStorage, lock *Lock) error {
+	content, err := json.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("json marshal: %s", err)
+	}
+	return storage.WriteLock(lock.Name, content)
+}
+
+func writeLockIfVersion(storage ConditionalLockStorage, lock *Lock, version string) (bool, error) {
+	content, err := json.Marshal(lock)
+	if err != nil {
+		return false, fmt.Errorf("json marshal: %s", err)
+	}
+	return storage.WriteLockIfVersion(lock.Name, content, version)
+}
+
+// AcquireLock takes the lock `name` for `operation`, unless it is held,
+// and not expired, by someone else. It returns nil, and no error, when
+// the storage doesn't support locks.
+//
+// With a ConditionalLockStorage, the lock is created, or replaces an
+// expired one, atomically. Other storages have no compare-and-swap, so
+// the lock is read back after being written: of two processes writing
+// it at the same time, only the last writer holds it, but one reading
+// it back before the other writes could believe it holds it too.
+func (p *PITR) AcquireLock(name, operation string, ttl time.Duration) (*Lease, error) {
+	if ttl < MinLockTTL {
+		return nil, fmt.Errorf("lock time to live %s is shorter than %s", ttl, MinLockTTL)
+	}
+
+	storage, ok := p.storage.(LockStorage)
+	if !ok {
+		zlog.Debug("storage doesn't support locks", zap.String("name", name))
+		return nil, nil
+	}
+
+	lease, err := acquireLock(storage, name, operation, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.Info("lock acquired", zap.String("name", name), zap.String("holder", lease.held.Holder), zap.Duration("ttl", ttl))
+	go lease.heartbeat()
+	return lease, nil
+}
+
+func acquireLock(storage LockStorage, name, operation string, ttl time.Duration) (*Lease, error) {
+	now := time.Now().UTC()
+	lease := &Lease{
+		storage: storage,
+		ttl:     ttl,
+		held: Lock{
+			Name:      name,
+			ID:        randomSuffix(),
+			Holder:    lockHolder(),
+			Operation: operation,
+			Acquired:  now,
+			Renewed:   now,
+			Expires:   now.Add(ttl),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if conditional, ok := asConditionalLockStorage(storage); ok {
+		existing, version, err := readLockVersion(conditional, name)
+		switch {
+		case err == nil && !existing.Expired(now):
+			return nil, &LockedError{Lock: existing}
+		case err != nil && !isNotFound(err):
+			return nil, fmt.Errorf("reading lock %q: %w", name, err)
+		}
+
+		written, err := writeLockIfVersion(conditional, &lease.held, version)
+		if err != nil {
+			return nil, fmt.Errorf("writing lock %q: %w", name, err)
+		}
+		if !written {
+			current, err := readLock(storage, name)
+			if err != nil {
+				return nil, fmt.Errorf("lock %q taken concurrently: %w", name, err)
+			}
+			return nil, &LockedError{Lock: current}
+		}
+		return lease, nil
+	}
+
+	if existing, err := readLock(storage, name); err == nil && !existing.Expired(now) {
+		return nil, &LockedError{Lock: existing}
+	}
+
+	if err := writeLock(storage, &lease.held); err != nil {
+		return nil, fmt.Errorf("writing lock %q: %s", name, err)
+	}
+
+	current, err := readLock(storage, name)
+	if err != nil {
+		return nil, fmt.Errorf("reading back lock %q: %s", name, err)
+	}
+	if current.ID != lease.held.ID {
+		return nil, &LockedError{Lock: current}
+	}
+	return lease, nil
+}
+
+// waitForLock acquires the lock `name`, waiting while someone else holds
+// it, at most for `ttl`. The lease is renewed until released.
+func waitForLock(storage LockStorage, name, operation string, ttl time.Duration) (*Lease, error) {
+	deadline := time.Now().Add(ttl)
+	for {
+		lease, err := acquireLock(storage, name, operation, ttl)
+		if err == nil {
+			go lease.heartbeat()
+			return lease, nil
+		}
+		if _, locked := err.(*LockedError); !locked || time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(lockWaitInterval)
+	}
+}
+
+func (l *Lease) heartbeat() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.renew(); err != nil {
+				zlog.Warn("cannot renew lock", zap.String("name", l.held.Name), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (l *Lease) renew() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+
+	if conditional, ok := asConditionalLockStorage(l.storage); ok {
+		return l.renewIfVersion(conditional)
+	}
+
+	current, err := readLock(l.storage, l.held.Name)
+	if err == nil && current.ID != l.held.ID {
+		l.err = fmt.Errorf("lock %q lost, now held by %s", l.held.Name, current.Holder)
+		return l.err
+	}
+
+	now := time.Now().UTC()
+	l.held.Renewed = now
+	l.held.Expires = now.Add(l.ttl)
+	return writeLock(l.storage, &l.held)
+}
+
+// renewIfVersion only replaces the lock if it wasn't taken by someone
+// else since it was read. A broken lock is created again.
+func (l *Lease) renewIfVersion(storage ConditionalLockStorage) error {
+	current, version, err := readLockVersion(storage, l.held.Name)
+	switch {
+	case err != nil && !isNotFound(err):
+		return err
+	case err == nil && current.ID != l.held.ID:
+		l.err = fmt.Errorf("lock %q lost, now held by %s", l.held.Name, current.Holder)
+		return l.err
+	}
+
+	now := time.Now().UTC()
+	l.held.Renewed = now
+	l.held.Expires = now.Add(l.ttl)
+	written, err := writeLockIfVersion(storage, &l.held, version)
+	if err != nil {
+		return err
+	}
+	if !written {
+		l.err = fmt.Errorf("lock %q lost, taken concurrently", l.held.Name)
+		return l.err
+	}
+	return nil
+}
+
+// Err returns an error when the lock was lost, like broken with
+// `pitreos locks break` while this process was stuck.
+func (l *Lease) Err() error {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.err
+}
+
+// Release stops renewing the lock and deletes it, unless someone else
+// holds it by now.
+func (l *Lease) Release() error {
+	if l == nil {
+		return nil
+	}
+
+	close(l.stop)
+	<-l.done
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.err != nil {
+		return nil
+	}
+
+	current, err := readLock(l.storage, l.held.Name)
+	if err != nil {
+		return fmt.Errorf("reading lock %q: %s", l.held.Name, err)
+	}
+	if current.ID != l.held.ID {
+		return nil
+	}
+	return l.storage.DeleteLock(l.held.Name)
+}
+
+// ListLocks returns the locks of the storage, expired or not.
+func (p *PITR) ListLocks() ([]*Lock, error) {
+	storage, ok := p.storage.(LockStorage)
+	if !ok {
+		return nil, fmt.Errorf("storage doesn't support locks")
+	}
+
+	names, err := storage.ListLocks()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*Lock
+	for _, name := range names {
+		lock, err := readLock(storage, name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, lock)
+	}
+	return out, nil
+}
+
+// BreakLock deletes the lock `name`. Unless `force` is set, only expired
+// locks can be broken.
+func (p *PITR) BreakLock(name string, force bool) error {
+	storage, ok := p.storage.(LockStorage)
+	if !ok {
+		return fmt.Errorf("storage doesn't support locks")
+	}
+
+	lock, err := readLock(storage, name)
+	if err != nil {
+		return err
+	}
+	if !force && !lock.Expired(time.Now()) {
+		return &LockedError{Lock: lock}
+	}
+
+	zlog.Info("breaking lock", zap.String("name", name), zap.String("holder", lock.Holder))
+	return storage.DeleteLock(name)
+}
@@ -0,0 +1,209 @@
+package pitreos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPITR_AcquireLock(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+
+	lease, err := pitr.AcquireLock("prod", "backup", time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+
+	_, err = pitr.AcquireLock("prod", "backup", time.Minute)
+	require.Error(t, err)
+	lockedErr, ok := err.(*LockedError)
+	require.True(t, ok)
+	assert.Equal(t, lockHolder(), lockedErr.Lock.Holder)
+
+	// Other names are independent
+	other, err := pitr.AcquireLock("dev", "backup", time.Minute)
+	require.NoError(t, err)
+
+	locks, err := pitr.ListLocks()
+	require.NoError(t, err)
+	assert.Len(t, locks, 2)
+
+	require.NoError(t, lease.Release())
+	require.NoError(t, other.Release())
+	locks, err = pitr.ListLocks()
+	require.NoError(t, err)
+	assert.Len(t, locks, 0)
+
+	lease, err = pitr.AcquireLock("prod", "backup", time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, lease.Release())
+}
+
+func TestPITR_AcquireLock_InvalidTTL(t *testing.T) {
+	pitr := New(1, 2, time.Minute, newTestLocalStorage(t))
+
+	_, err := pitr.AcquireLock("prod", "backup", time.Nanosecond)
+	assert.Error(t, err)
+}
+
+func TestPITR_AcquireLock_Conditional(t *testing.T) {
+	_, storage := newTestS3Storage(t, "")
+	pitr := New(1, 2, time.Minute, storage)
+
+	lease, err := pitr.AcquireLock("prod", "backup", time.Minute)
+	require.NoError(t, err)
+	_, err = pitr.AcquireLock("prod", "backup", time.Minute)
+	assert.IsType(t, &LockedError{}, err)
+
+	// Renewing fails once someone else replaced the lock
+	require.NoError(t, writeLock(storage, &Lock{Name: "prod", ID: "other", Holder: "other:1", Expires: time.Now().Add(time.Minute)}))
+	assert.Error(t, lease.renew())
+	assert.Error(t, lease.Err())
+	require.NoError(t, lease.Release())
+
+	// Expired locks are replaced, only by one of the contenders
+	require.NoError(t, writeLock(storage, &Lock{Name: "prod", ID: "crashed", Holder: "other:1", Expires: time.Now().Add(-time.Second)}))
+	_, version, err := readLockVersion(storage, "prod")
+	require.NoError(t, err)
+
+	lease, err = pitr.AcquireLock("prod", "backup", time.Minute)
+	require.NoError(t, err)
+	written, err := writeLockIfVersion(storage, &Lock{Name: "prod", ID: "late"}, version)
+	require.NoError(t, err)
+	assert.False(t, written)
+
+	require.NoError(t, lease.renew())
+	require.NoError(t, lease.Release())
+	locks, err := pitr.ListLocks()
+	require.NoError(t, err)
+	assert.Len(t, locks, 0)
+}
+
+func TestPITR_AcquireLock_ConditionalWrapped(t *testing.T) {
+	newReplicated := func(backends ...Storage) Storage {
+		replicated, err := NewReplicatedStorage(1, backends...)
+		require.NoError(t, err)
+		return replicated
+	}
+
+	_, s3 := newTestS3Storage(t, "")
+	secondary := newTestLocalStorage(t)
+	for _, storage := range []Storage{
+		NewPeerStorage(s3),
+		newReplicated(s3, secondary),
+	} {
+		_, ok := asConditionalLockStorage(storage)
+		require.True(t, ok)
+		_, ok = asConditionalRefStorage(storage)
+		require.True(t, ok)
+
+		pitr := New(1, 2, time.Minute, storage)
+		lease, err := pitr.AcquireLock("prod", "backup", time.Minute)
+		require.NoError(t, err)
+		_, err = pitr.AcquireLock("prod", "backup", time.Minute)
+		assert.IsType(t, &LockedError{}, err)
+
+		// A contender that read the lock before it was taken loses
+		written, err := writeLockIfVersion(storage.(ConditionalLockStorage), &Lock{Name: "prod", ID: "late"}, "")
+		require.NoError(t, err)
+		assert.False(t, written)
+		require.NoError(t, lease.Release())
+	}
+
+	// Locks won on the primary are copied to the other replicas
+	pitr := New(1, 2, time.Minute, newReplicated(s3, secondary))
+	lease, err := pitr.AcquireLock("prod", "backup", time.Minute)
+	require.NoError(t, err)
+	copied, err := readLock(secondary, "prod")
+	require.NoError(t, err)
+	assert.Equal(t, lease.held.ID, copied.ID)
+	require.NoError(t, lease.Release())
+
+	// Only when the wrapped storage, or primary, supports them
+	for _, storage := range []Storage{
+		NewPeerStorage(secondary),
+		newReplicated(secondary, s3),
+		NewPeerStorage(newReplicated(secondary)),
+	} {
+		_, ok := asConditionalLockStorage(storage)
+		assert.False(t, ok)
+		_, ok = asConditionalRefStorage(storage)
+		assert.False(t, ok)
+	}
+}
+
+func TestPITR_AcquireLock_Expired(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+
+	stale := &Lock{Name: "prod", ID: "crashed", Holder: "other:1", Expires: time.Now().Add(-time.Second)}
+	require.NoError(t, writeLock(storage, stale))
+
+	lease, err := pitr.AcquireLock("prod", "backup", time.Minute)
+	require.NoError(t, err)
+	assert.NoError(t, lease.Err())
+	require.NoError(t, lease.Release())
+}
+
+func TestLease_Heartbeat(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+
+	// Shorter than MinLockTTL, to keep the test fast
+	lease, err := acquireLock(storage, "prod", "backup", 300*time.Millisecond)
+	require.NoError(t, err)
+	go lease.heartbeat()
+
+	// Renewed past its initial expiry
+	time.Sleep(500 * time.Millisecond)
+	_, err = pitr.AcquireLock("prod", "backup", time.Minute)
+	assert.Error(t, err)
+	assert.NoError(t, lease.Err())
+
+	// Lost once broken and taken by someone else
+	require.NoError(t, pitr.BreakLock("prod", true))
+	require.NoError(t, writeLock(storage, &Lock{Name: "prod", ID: "other", Holder: "other:1", Expires: time.Now().Add(time.Minute)}))
+	time.Sleep(200 * time.Millisecond)
+	assert.Error(t, lease.Err())
+
+	// Releasing a lost lock leaves the new holder's lock alone
+	require.NoError(t, lease.Release())
+	lock, err := readLock(storage, "prod")
+	require.NoError(t, err)
+	assert.Equal(t, "other", lock.ID)
+}
+
+func TestPITR_BreakLock(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+
+	require.NoError(t, writeLock(storage, &Lock{Name: "prod", ID: "a", Expires: time.Now().Add(time.Minute)}))
+	assert.Error(t, pitr.BreakLock("prod", false))
+	assert.NoError(t, pitr.BreakLock("prod", true))
+
+	require.NoError(t, writeLock(storage, &Lock{Name: "prod", ID: "a", Expires: time.Now().Add(-time.Minute)}))
+	assert.NoError(t, pitr.BreakLock("prod", false))
+	assert.Error(t, pitr.BreakLock("prod", false))
+}
+
+func TestPITR_GenerateBackup_Locked(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{"a": testContent(10, 1)})
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.LockTTL = time.Minute
+
+	require.NoError(t, writeLock(storage, &Lock{Name: "prod", ID: "a", Holder: "other:1", Expires: time.Now().Add(time.Minute)}))
+	assert.IsType(t, &LockedError{}, pitr.GenerateBackup(source, "prod", nil, AllFileFilter))
+
+	// Other tags aren't locked, and their lock is released once done
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+	locks, err := pitr.ListLocks()
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, "prod", locks[0].Name)
+
+	pitr.LockTTL = 0
+	require.NoError(t, pitr.GenerateBackup(source, "prod", nil, AllFileFilter))
+}
@@ -0,0 +1,189 @@
+package pitreos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// NodeosAppendonlyFiles are the files of a nodeos `blocks` directory only
+// ever appended to, backed up as such by BackupNodeos.
+var NodeosAppendonlyFiles = []string{"blocks/blocks.log", "blocks/blocks.index"}
+
+// nodeosMetaKeys are the metadata set by BackupNodeos.
+var nodeosMetaKeys = []string{"blocknum", "head_block_id", "chain_id", "snapshot"}
+
+// NodeosClient calls the HTTP API of nodeos. Creating snapshots needs its
+// `producer_api_plugin`.
+type NodeosClient struct {
+	apiURL string
+	client *http.Client
+
+	// pollInterval is how often the snapshot file is checked, while
+	// nodeos writes it.
+	pollInterval time.Duration
+}
+
+func NewNodeosClient(apiURL string) *NodeosClient {
+	return &NodeosClient{
+		apiURL:       strings.TrimRight(apiURL, "/"),
+		client:       &http.Client{},
+		pollInterval: time.Second,
+	}
+}
+
+// NodeosInfo is the part of `/v1/chain/get_info` recorded with backups.
+type NodeosInfo struct {
+	ChainID      string `json:"chain_id"`
+	HeadBlockNum uint32 `json:"head_block_num"`
+	HeadBlockID  string `json:"head_block_id"`
+}
+
+// NodeosSnapshot is a snapshot written by nodeos, as returned by
+// `/v1/producer/create_snapshot`.
+type NodeosSnapshot struct {
+	HeadBlockID   string `json:"head_block_id"`
+	HeadBlockNum  uint32 `json:"head_block_num"`
+	HeadBlockTime string `json:"head_block_time"`
+	SnapshotName  string `json:"snapshot_name"`
+}
+
+func (c *NodeosClient) call(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, c.apiURL+path, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("calling %s: %s", path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading %s response: %s", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("calling %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("unmarshal %s response: %s", path, err)
+	}
+	return nil
+}
+
+func (c *NodeosClient) GetInfo(ctx context.Context) (*NodeosInfo, error) {
+	var info *NodeosInfo
+	if err := c.call(ctx, "/v1/chain/get_info", &info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// CreateSnapshot asks nodeos for a snapshot of its state at its head
+// block. The snapshot file may still be being written when it returns,
+// see WaitForSnapshot.
+func (c *NodeosClient) CreateSnapshot(ctx context.Context) (*NodeosSnapshot, error) {
+	var snapshot *NodeosSnapshot
+	if err := c.call(ctx, "/v1/producer/create_snapshot", &snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.SnapshotName == "" {
+		return nil, fmt.Errorf("create_snapshot returned no snapshot name")
+	}
+	return snapshot, nil
+}
+
+// WaitForSnapshot waits for the snapshot file at `snapshotPath` to exist,
+// and its size to stop changing between two checks `interval` apart.
+func WaitForSnapshot(ctx context.Context, snapshotPath string, interval time.Duration) error {
+	lastSize := int64(-1)
+	for {
+		info, err := os.Stat(snapshotPath)
+		switch {
+		case err == nil && info.Size() > 0 && info.Size() == lastSize:
+			return nil
+		case err == nil:
+			lastSize = info.Size()
+		case !os.IsNotExist(err):
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for snapshot %q: %s", snapshotPath, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// BackupNodeos has nodeos, at the other end of `client`, write a snapshot
+// of its state, then backs it up along with its `blocks` directory, under
+// `dataDir`. The backup has two roots, `snapshots`, with only the new
+// snapshot, and `blocks`, where `blocks.log` and `blocks.index` are
+// append-only.
+//
+// The head block number (`blocknum`), head block ID, chain ID and
+// snapshot path are added to `metadata`, which must not already have
+// them.
+func (p *PITR) BackupNodeos(ctx context.Context, client *NodeosClient, dataDir, tag string, metadata map[string]interface{}) (*NodeosSnapshot, error) {
+	for _, key := range nodeosMetaKeys {
+		if _, found := metadata[key]; found {
+			return nil, fmt.Errorf("metadata %q is set from nodeos, and cannot be given", key)
+		}
+	}
+
+	info, err := client.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.Info("creating nodeos snapshot", zap.String("chain_id", info.ChainID), zap.Uint32("head_block_num", info.HeadBlockNum))
+	snapshot, err := client.CreateSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotPath := snapshot.SnapshotName
+	if !filepath.IsAbs(snapshotPath) {
+		snapshotPath = filepath.Join(dataDir, "snapshots", snapshotPath)
+	}
+	if err := WaitForSnapshot(ctx, snapshotPath, client.pollInterval); err != nil {
+		return nil, err
+	}
+	zlog.Info("nodeos snapshot written", zap.String("snapshot_path", snapshotPath), zap.Uint32("head_block_num", snapshot.HeadBlockNum))
+
+	meta := make(map[string]interface{}, len(metadata)+len(nodeosMetaKeys))
+	for k, v := range metadata {
+		meta[k] = v
+	}
+	meta["blocknum"] = snapshot.HeadBlockNum
+	meta["head_block_id"] = snapshot.HeadBlockID
+	meta["chain_id"] = info.ChainID
+	meta["snapshot"] = snapshotPath
+
+	roots := []Root{
+		{Name: "snapshots", Path: filepath.Dir(snapshotPath)},
+		{Name: "blocks", Path: filepath.Join(dataDir, "blocks")},
+	}
+	snapshotFile := "snapshots/" + filepath.Base(snapshotPath)
+	filter := FilterFunc(func(relativePath string) bool {
+		return !strings.HasPrefix(relativePath, "snapshots/") || relativePath == snapshotFile
+	})
+
+	if err := p.generateBackup(roots, tag, meta, filter, NodeosAppendonlyFiles); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,112 @@
+package pitreos
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeNodeos serves the nodeos API endpoints used by BackupNodeos,
+// writing snapshots to `snapshotsDir`.
+func newFakeNodeos(t *testing.T, snapshotsDir string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chain/get_info", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"chain_id": "aca376f2", "head_block_num": 1234, "head_block_id": "000004d2ab"}`)
+	})
+	mux.HandleFunc("/v1/producer/create_snapshot", func(w http.ResponseWriter, r *http.Request) {
+		snapshotPath := filepath.Join(snapshotsDir, "snapshot-000004d2ab.bin")
+		require.NoError(t, ioutil.WriteFile(snapshotPath, testContent(500, 9), 0644))
+		fmt.Fprintf(w, `{"head_block_id": "000004d2ab", "head_block_num": 1234, "head_block_time": "2020-04-01T00:00:00.000", "snapshot_name": %q}`, snapshotPath)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPITR_BackupNodeos(t *testing.T) {
+	dataDir := newTestSourceDir(t, map[string][]byte{
+		"blocks/blocks.log":               testContent(1000, 1),
+		"blocks/blocks.index":             testContent(100, 2),
+		"blocks/reversible/shared.bin":    testContent(100, 3),
+		"snapshots/snapshot-old.bin":      testContent(500, 4),
+		"state/shared_memory.bin":         testContent(1000, 5),
+		"state/fork_db.dat":               testContent(10, 6),
+		"snapshots/.pending-snapshot.bin": nil,
+	})
+	server := newFakeNodeos(t, filepath.Join(dataDir, "snapshots"))
+
+	client := NewNodeosClient(server.URL)
+	client.pollInterval = 10 * time.Millisecond
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.AppendonlyFiles = []string{"other"}
+	snapshot, err := pitr.BackupNodeos(context.Background(), client, dataDir, "prod", map[string]interface{}{"version": "2.0.5"})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1234), snapshot.HeadBlockNum)
+	assert.Equal(t, []string{"other"}, pitr.AppendonlyFiles)
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	bm, err := pitr.downloadBackupIndex(list[0])
+	require.NoError(t, err)
+
+	var names []string
+	for _, file := range bm.Files {
+		names = append(names, file.FileName)
+	}
+	assert.ElementsMatch(t, []string{
+		"snapshots/snapshot-000004d2ab.bin",
+		"blocks/blocks.log",
+		"blocks/blocks.index",
+		"blocks/reversible/shared.bin",
+	}, names)
+	assert.Equal(t, map[string]interface{}{
+		"blocknum":      float64(1234),
+		"head_block_id": "000004d2ab",
+		"chain_id":      "aca376f2",
+		"snapshot":      filepath.Join(dataDir, "snapshots", "snapshot-000004d2ab.bin"),
+		"version":       "2.0.5",
+	}, bm.Meta)
+
+	// Metadata set from nodeos can't be overridden
+	_, err = pitr.BackupNodeos(context.Background(), client, dataDir, "prod", map[string]interface{}{"blocknum": 1})
+	assert.Error(t, err)
+}
+
+func TestNodeosClient_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code": 404, "message": "Not Found"}`, http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := NewNodeosClient(server.URL).CreateSnapshot(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+}
+
+func TestWaitForSnapshot(t *testing.T) {
+	dir := newTestSourceDir(t, nil)
+	snapshotPath := filepath.Join(dir, "snapshot.bin")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, WaitForSnapshot(ctx, snapshotPath, 10*time.Millisecond))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ioutil.WriteFile(snapshotPath, testContent(10, 1), 0644)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, WaitForSnapshot(ctx, snapshotPath, 10*time.Millisecond))
+}
@@ -4,12 +4,51 @@ import (
 	"time"
 )
 
+// DefaultChangedFileRetries is how many times files changing while being
+// backed up are read again, by default.
+const DefaultChangedFileRetries = 2
+
 type PITR struct {
 	chunkSize       int64
 	threads         int
-	AppendonlyFiles []string
 	filemetaVersion string
 
+	// AppendonlyFiles are globs of files only ever appended to, like
+	// `blocks/blocks.log` or `**/*.log`: they are backed up on top of the
+	// chunks of their previous backup, only reading what was appended.
+	AppendonlyFiles []string
+
+	// AppendonlyAuto detects other append-only files, whose previous
+	// backup is still at the start of the file, checked by hashing its
+	// last chunk and AppendonlySampledChunks others at random (all of
+	// them when negative). Changes to chunks not checked go unnoticed.
+	AppendonlyAuto          bool
+	AppendonlySampledChunks int
+
+	// VerifyAppendonly checks AppendonlyFiles the same way, when backing
+	// up and restoring, processing them entirely when they fail. Off by
+	// default, AppendonlyFiles are trusted.
+	VerifyAppendonly bool
+
+	// LockTTL is the time to live of the lock taken on a tag while
+	// backing it up (see AcquireLock). Zero, the default, disables
+	// locking.
+	LockTTL time.Duration
+
+	// Snapshot selects whether files are cloned before being backed up,
+	// see SnapshotMode. Defaults to SnapshotOff.
+	Snapshot SnapshotMode
+
+	// Hooks are commands run around backups and restores.
+	Hooks Hooks
+
+	// ChangedFileRetries is how many times a file changing while being
+	// backed up is read again. When it still changes, it is marked
+	// inconsistent in the backup index, or fails the backup with
+	// FailOnChangedFiles.
+	ChangedFileRetries int
+	FailOnChangedFiles bool
+
 	cacheStorage Storage
 	storage      Storage
 }
@@ -20,10 +59,13 @@ func NewDefaultPITR(storage Storage) *PITR {
 func New(chunkSizeMiB int64, threads int, transferTimeout time.Duration, storage Storage) *PITR {
 	storage.SetTimeout(transferTimeout)
 	return &PITR{
-		filemetaVersion: "v3",
-		chunkSize:       chunkSizeMiB * 1024 * 1024,
-		threads:         threads,
-		storage:         storage,
+		filemetaVersion:         "v3",
+		chunkSize:               chunkSizeMiB * 1024 * 1024,
+		threads:                 threads,
+		storage:                 storage,
+		Snapshot:                SnapshotOff,
+		ChangedFileRetries:      DefaultChangedFileRetries,
+		AppendonlySampledChunks: DefaultAppendonlySampledChunks,
 	}
 }
 
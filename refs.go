@@ -0,0 +1,225 @@
+package pitreos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LatestChannel is the channel of a tag pointing to its newest backup,
+// updated by every backup.
+const LatestChannel = "latest"
+
+// RefStorage is implemented by storages able to keep refs: small
+// objects, stored as `refs/{tag}/{channel}`, holding the name of the
+// backup a channel of a tag points to. Writes must replace the whole
+// object atomically.
+type RefStorage interface {
+	OpenRef(name string) (io.ReadCloser, error)
+	WriteRef(name string, content []byte) error
+}
+
+// ConditionalRefStorage is implemented by storages able to write a ref
+// only if it is still at the version last read, like with the ETag of
+// S3 objects. An empty version means the ref must not exist yet.
+type ConditionalRefStorage interface {
+	RefStorage
+	OpenRefVersion(name string) (io.ReadCloser, string, error)
+	WriteRefIfVersion(name string, content []byte, version string) (written bool, err error)
+}
+
+var errRefsUnsupported = errors.New("refs not supported by storage")
+
+// asConditionalRefStorage returns `storage` as a ConditionalRefStorage
+// when it supports conditional writes, through the storages it wraps.
+func asConditionalRefStorage(storage interface{}) (ConditionalRefStorage, bool) {
+	conditional, ok := storage.(ConditionalRefStorage)
+	if !ok {
+		return nil, false
+	}
+	if wrapper, ok := storage.(conditionalSupport); ok && !wrapper.supportsConditionalRefs() {
+		return nil, false
+	}
+	return conditional, true
+}
+
+const (
+	// refUpdateAttempts bounds the conditional writes of a ref losing
+	// against concurrent updates.
+	refUpdateAttempts = 10
+
+	// refLockTTL is the time to live of the lock taken while updating
+	// a ref on storages without conditional writes. Updates wait for it
+	// at most that long, so the lock of a crashed process expires.
+	refLockTTL = 30 * time.Second
+)
+
+func refName(tag, channel string) string {
+	return path.Join(tag, channel)
+}
+
+// ParseChannel splits a reference to a channel, like `prod@stable`, into
+// its tag and channel. `ok` is false when `in` doesn't name a channel.
+func ParseChannel(in string) (tag, channel string, ok bool) {
+	parts := strings.SplitN(in, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func readRef(storage Storage, tag, channel string) (string, error) {
+	refStorage, ok := storage.(RefStorage)
+	if !ok {
+		return "", errRefsUnsupported
+	}
+
+	content, err := readAllAndClose(refStorage.OpenRef(refName(tag, channel)))
+	if err != nil {
+		return "", err
+	}
+	return parseRef(tag, channel, content)
+}
+
+func readRefVersion(storage ConditionalRefStorage, tag, channel string) (string, string, error) {
+	reader, version, err := storage.OpenRefVersion(refName(tag, channel))
+	content, err := readAllAndClose(reader, err)
+	if err != nil {
+		return "", "", err
+	}
+
+	backupName, err := parseRef(tag, channel, content)
+	return backupName, version, err
+}
+
+func parseRef(tag, channel string, content []byte) (string, error) {
+	backupName := strings.TrimSpace(string(content))
+	if backupName == "" {
+		return "", fmt.Errorf("empty ref %q", refName(tag, channel))
+	}
+	return backupName, nil
+}
+
+func writeRef(storage Storage, tag, channel, backupName string) error {
+	refStorage, ok := storage.(RefStorage)
+	if !ok {
+		return errRefsUnsupported
+	}
+	return refStorage.WriteRef(refName(tag, channel), []byte(backupName+"\n"))
+}
+
+// updateLatestRef points the `latest` channel of the tag of `backupName`
+// to it, unless it already points to a newer backup. Storages without
+// refs, and backups not named by makeBackupName, are left alone.
+//
+// The ref is replaced with a conditional write on storages supporting
+// them, retried when losing against another update. Other storages
+// update it under the lock `{tag}@latest`.
+func updateLatestRef(storage Storage, backupName string) error {
+	if _, ok := storage.(RefStorage); !ok {
+		return nil
+	}
+
+	date, tag, err := ParseBackupName(backupName)
+	if err != nil {
+		zlog.Debug("not updating latest ref", zap.String("backup_name", backupName), zap.Error(err))
+		return nil
+	}
+
+	if conditional, ok := asConditionalRefStorage(storage); ok {
+		for attempt := 0; attempt < refUpdateAttempts; attempt++ {
+			current, version, err := readRefVersion(conditional, tag, LatestChannel)
+			if err != nil && !isNotFound(err) {
+				return fmt.Errorf("reading latest ref of %q: %w", tag, err)
+			}
+			if err == nil && newerBackup(current, date) {
+				zlog.Debug("latest ref points to a newer backup", zap.String("ref", current), zap.String("backup_name", backupName))
+				return nil
+			}
+
+			written, err := conditional.WriteRefIfVersion(refName(tag, LatestChannel), []byte(backupName+"\n"), version)
+			if err != nil {
+				return fmt.Errorf("updating latest ref of %q: %w", tag, err)
+			}
+			if written {
+				return nil
+			}
+			zlog.Debug("latest ref updated concurrently, retrying", zap.String("tag", tag), zap.Int("attempt", attempt))
+		}
+		return fmt.Errorf("updating latest ref of %q: too many concurrent updates", tag)
+	}
+
+	if lockStorage, ok := storage.(LockStorage); ok {
+		lease, err := waitForLock(lockStorage, tag+"@"+LatestChannel, "update latest ref", refLockTTL)
+		if err != nil {
+			return fmt.Errorf("locking latest ref of %q: %w", tag, err)
+		}
+		defer lease.Release()
+	}
+
+	current, err := readRef(storage, tag, LatestChannel)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("reading latest ref of %q: %w", tag, err)
+	}
+	if err == nil && newerBackup(current, date) {
+		zlog.Debug("latest ref points to a newer backup", zap.String("ref", current), zap.String("backup_name", backupName))
+		return nil
+	}
+
+	if err := writeRef(storage, tag, LatestChannel, backupName); err != nil {
+		return fmt.Errorf("updating latest ref of %q: %s", tag, err)
+	}
+	return nil
+}
+
+// newerBackup tells whether the backup `current` was made after `date`.
+func newerBackup(current string, date time.Time) bool {
+	currentDate, _, err := ParseBackupName(current)
+	return err == nil && currentDate.After(date)
+}
+
+// ResolveChannel returns the name of the backup a channel of `tag`
+// points to. The `latest` channel falls back to listing backups when
+// its ref is missing, like for backups made before refs were written.
+func (p *PITR) ResolveChannel(tag, channel string) (string, error) {
+	backupName, err := readRef(p.storage, tag, channel)
+	if err == nil {
+		return backupName, nil
+	}
+
+	if channel != LatestChannel || !(err == errRefsUnsupported || isNotFound(err)) {
+		return "", fmt.Errorf("channel %q of tag %q not found: %w", channel, tag, err)
+	}
+
+	zlog.Debug("no latest ref, listing backups", zap.String("tag", tag), zap.Error(err))
+	return p.findLatestBackup(tag)
+}
+
+// PromoteBackup points the `channel` of the tag of `backupName` to it,
+// like `stable` or `canary`. It returns the backup the channel
+// previously pointed to, if any.
+func (p *PITR) PromoteBackup(backupName, channel string) (previous string, err error) {
+	if err := validateTag(channel); err != nil {
+		return "", fmt.Errorf("invalid channel %q", channel)
+	}
+
+	_, tag, err := ParseBackupName(backupName)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := p.downloadBackupIndex(backupName); err != nil {
+		return "", fmt.Errorf("backup %q: %s", backupName, err)
+	}
+
+	previous, _ = readRef(p.storage, tag, channel)
+	if err := writeRef(p.storage, tag, channel, backupName); err != nil {
+		return "", err
+	}
+	return previous, nil
+}
@@ -0,0 +1,171 @@
+package pitreos
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChannel(t *testing.T) {
+	tag, channel, ok := ParseChannel("prod@stable")
+	assert.True(t, ok)
+	assert.Equal(t, "prod", tag)
+	assert.Equal(t, "stable", channel)
+
+	for _, in := range []string{"prod", "@stable", "prod@", "2018-08-28-18-15-45--prod"} {
+		_, _, ok := ParseChannel(in)
+		assert.False(t, ok, in)
+	}
+}
+
+func TestPITR_LatestRef(t *testing.T) {
+	pitr, storage := newTestTaggedBackups(t, map[int]string{1: "prod", 3: "prod", 2: "dev"})
+
+	ref, err := readRef(storage, "prod", LatestChannel)
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-03-00-00-00--prod", ref)
+
+	// Aliasing an older backup doesn't move the latest ref back
+	_, err = pitr.AliasBackup("2025-01-02-00-00-00--dev", "prod")
+	require.NoError(t, err)
+	latest, err := pitr.GetLatestBackup("prod")
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-03-00-00-00--prod", latest)
+
+	// The ref is trusted over listing
+	require.NoError(t, writeRef(storage, "dev", LatestChannel, "2025-01-01-00-00-00--prod"))
+	latest, err = pitr.GetLatestBackup("dev")
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-01-00-00-00--prod", latest)
+}
+
+func TestPITR_GetLatestBackup_WithoutRef(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+
+	for _, name := range []string{"2025-01-01-00-00-00--prod", "2025-01-02-00-00-00--prod"} {
+		require.NoError(t, storage.WriteBackupIndex(name, []byte("version: v3\n")))
+	}
+
+	latest, err := pitr.GetLatestBackup("prod")
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-02-00-00-00--prod", latest)
+}
+
+func TestPITR_PromoteBackup(t *testing.T) {
+	pitr, _ := newTestTaggedBackups(t, map[int]string{1: "prod", 2: "prod"})
+
+	_, err := pitr.ResolveChannel("prod", "stable")
+	assert.Error(t, err)
+
+	previous, err := pitr.PromoteBackup("2025-01-02-00-00-00--prod", "stable")
+	require.NoError(t, err)
+	assert.Equal(t, "", previous)
+
+	previous, err = pitr.PromoteBackup("2025-01-01-00-00-00--prod", "stable")
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-02-00-00-00--prod", previous)
+
+	stable, err := pitr.ResolveChannel("prod", "stable")
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-01-00-00-00--prod", stable)
+
+	// Channels are per tag, and promoting doesn't touch `latest`
+	_, err = pitr.ResolveChannel("dev", "stable")
+	assert.Error(t, err)
+	latest, err := pitr.GetLatestBackup("prod")
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-02-00-00-00--prod", latest)
+
+	_, err = pitr.PromoteBackup("2025-01-05-00-00-00--prod", "stable")
+	assert.Error(t, err)
+	_, err = pitr.PromoteBackup("2025-01-01-00-00-00--prod", "a/b")
+	assert.Error(t, err)
+}
+
+func TestUpdateLatestRef_Conditional(t *testing.T) {
+	_, storage := newTestS3Storage(t, "")
+
+	require.NoError(t, updateLatestRef(storage, "2025-01-02-00-00-00--prod"))
+	require.NoError(t, updateLatestRef(storage, "2025-01-01-00-00-00--prod"))
+	ref, err := readRef(storage, "prod", LatestChannel)
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-02-00-00-00--prod", ref)
+
+	// A writer that read the ref before the update above loses
+	_, version, err := readRefVersion(storage, "prod", LatestChannel)
+	require.NoError(t, err)
+	require.NoError(t, updateLatestRef(storage, "2025-01-03-00-00-00--prod"))
+	written, err := storage.WriteRefIfVersion(refName("prod", LatestChannel), []byte("2025-01-01-00-00-00--prod\n"), version)
+	require.NoError(t, err)
+	assert.False(t, written)
+
+	ref, err = readRef(storage, "prod", LatestChannel)
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-03-00-00-00--prod", ref)
+}
+
+func TestUpdateLatestRef_Locked(t *testing.T) {
+	storage := newTestLocalStorage(t)
+
+	require.NoError(t, updateLatestRef(storage, "2025-01-02-00-00-00--prod"))
+	names, err := storage.ListLocks()
+	require.NoError(t, err)
+	assert.Len(t, names, 0)
+
+	// Waits for the ref lock of another process
+	lease, err := acquireLock(storage, "prod@latest", "update latest ref", time.Minute)
+	require.NoError(t, err)
+	go lease.heartbeat()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		lease.Release()
+	}()
+	require.NoError(t, updateLatestRef(storage, "2025-01-03-00-00-00--prod"))
+
+	ref, err := readRef(storage, "prod", LatestChannel)
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-03-00-00-00--prod", ref)
+}
+
+// failingRefStorage fails reading refs, like an unreachable storage.
+type failingRefStorage struct {
+	*DStoreStorage
+}
+
+func (s *failingRefStorage) OpenRef(name string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("connection reset")
+}
+
+func TestPITR_ResolveChannel_StorageError(t *testing.T) {
+	_, storage := newTestTaggedBackups(t, map[int]string{1: "prod"})
+
+	// Unreadable refs aren't mistaken for missing ones
+	pitr := New(1, 2, time.Minute, &failingRefStorage{storage})
+	_, err := pitr.ResolveChannel("prod", LatestChannel)
+	assert.Error(t, err)
+
+	pitr = New(1, 2, time.Minute, storage)
+	_, err = pitr.ResolveChannel("dev", LatestChannel)
+	assert.Error(t, err)
+	latest, err := pitr.ResolveChannel("prod", LatestChannel)
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-01-00-00-00--prod", latest)
+}
+
+func TestPITR_GenerateBackup_RefUpdateFailure(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{"a": testContent(10, 1)})
+	storage := newTestLocalStorage(t)
+
+	// The backup is kept when its ref can't be updated
+	pitr := New(1, 2, time.Minute, &failingRefStorage{storage})
+	require.NoError(t, pitr.GenerateBackup(source, "prod", nil, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+}
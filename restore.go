@@ -1,13 +1,15 @@
 package pitreos
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/abourget/llerrgroup"
 	"github.com/avast/retry-go"
@@ -20,6 +22,48 @@ import (
 var counterLock sync.Mutex
 
 func (p *PITR) RestoreFromBackup(dest string, backupName string, filter Filter) error {
+	return p.restoreFromBackup(backupName, dest, filter, func(file *FileIndex) (string, bool) {
+		return filepath.Join(dest, file.FileName), true
+	})
+}
+
+// RestoreFromBackupToRoots restores each named root of a backup to its
+// own destination. Files of roots not listed in `roots` are skipped.
+func (p *PITR) RestoreFromBackupToRoots(roots []Root, backupName string, filter Filter) error {
+	if err := validateRoots(roots); err != nil {
+		return err
+	}
+
+	destinations := make(map[string]string)
+	for _, root := range roots {
+		destinations[root.Name] = root.Path
+	}
+
+	return p.restoreFromBackup(backupName, rootsString(roots), filter, func(file *FileIndex) (string, bool) {
+		dest, found := destinations[file.Root]
+		if !found || file.Root == "" {
+			return "", false
+		}
+		return filepath.Join(dest, strings.TrimPrefix(file.FileName, file.Root+"/")), true
+	}, roots...)
+}
+
+// restoreFromBackup restores the files of a backup to their
+// `destination`, running the restore hooks with `target` as
+// destination.
+func (p *PITR) restoreFromBackup(backupName, target string, filter Filter, destination func(file *FileIndex) (string, bool), expectedRoots ...Root) (err error) {
+	started := time.Now()
+	env := hookEnv{"OPERATION": "restore", "BACKUP_NAME": backupName, "TAG": tagFromBackupName(backupName), "DESTINATION": target}
+	defer func() {
+		if err != nil {
+			p.Hooks.runFailureHook(env, err)
+		}
+	}()
+
+	if _, err := runHook("pre-restore", p.Hooks.PreRestore, env); err != nil {
+		return err
+	}
+
 	bm, err := p.downloadBackupIndex(backupName)
 	if err != nil {
 		return err
@@ -29,30 +73,48 @@ func (p *PITR) RestoreFromBackup(dest string, backupName string, filter Filter)
 		return fmt.Errorf("incompatible version of backupIndex, expected %s got %s", p.filemetaVersion, bm.Version)
 	}
 
+	for _, root := range expectedRoots {
+		if !bm.hasRoot(root.Name) {
+			return fmt.Errorf("root %q not found in backup", root.Name)
+		}
+	}
+
 	matchingFiles, err := bm.FindFilesMatching(filter)
 	if err != nil {
 		return err
 	}
 
+	var restored []*FileIndex
 	for _, file := range matchingFiles {
-		err := p.downloadFileFromChunks(file, dest)
+		filePath, ok := destination(file)
+		if !ok {
+			zlog.Debug("skipping file of root without destination", zap.String("file_name", file.FileName), zap.String("root", file.Root))
+			continue
+		}
+
+		if file.Inconsistent {
+			zlog.Warn("file changed while being backed up, its content may be inconsistent", zap.String("file_name", file.FileName))
+		}
+
+		err := p.downloadFileFromChunks(file, filePath)
 		if err != nil {
 			return fmt.Errorf("retrieve chunk %q: %s", file.FileName, err)
 		}
+		restored = append(restored, file)
 	}
 
-	return nil
+	env.setStats(restored, started)
+	_, err = runHook("post-restore", p.Hooks.PostRestore, env)
+	return err
 }
 
-func (p *PITR) downloadFileFromChunks(fm *FileIndex, localFolder string) error {
+func (p *PITR) downloadFileFromChunks(fm *FileIndex, filePath string) error {
 	zlog.Info("restoring file with size from snapshot",
 		zap.String("file_name", fm.FileName),
 		zap.String("bytes", humanize.Bytes(uint64(fm.TotalSize))),
 		zap.Time("date", fm.Date),
 	)
 
-	filePath := filepath.Join(localFolder, fm.FileName)
-
 	err := os.MkdirAll(path.Dir(filePath), 0755)
 	if err != nil {
 		return fmt.Errorf("mkdirall: %s", err)
@@ -64,7 +126,9 @@ func (p *PITR) downloadFileFromChunks(fm *FileIndex, localFolder string) error {
 	}
 	defer f.Close()
 
-	if stringarrayContains(p.AppendonlyFiles, fm.FileName) {
+	// Files backed up as append-only are restored as such, like files
+	// detected with AppendonlyAuto
+	if matchAppendonlyFile(p.AppendonlyFiles, fm.FileName) || (fm.Appendonly != nil && fm.Appendonly.Rejected == "") {
 		f.isAppendOnly = true
 	}
 
@@ -74,6 +138,12 @@ func (p *PITR) downloadFileFromChunks(fm *FileIndex, localFolder string) error {
 	}
 	f.originalSize = fstats.Size()
 
+	if f.isAppendOnly && p.VerifyAppendonly {
+		if err := p.verifyLocalAppendonlyFile(f, fm); err != nil {
+			return err
+		}
+	}
+
 	if err = f.Truncate(fm.TotalSize); err != nil {
 		return err
 	}
@@ -156,50 +226,15 @@ func (p *PITR) downloadFileFromChunks(fm *FileIndex, localFolder string) error {
 			}
 
 			return retry.Do(func() error {
-				//try from cache first
-				var openChunk io.ReadCloser
-				var inCache bool
-				if p.cacheStorage != nil {
-					// Try this first
-					found, err := p.cacheStorage.ChunkExists(chunkMeta.ContentSHA)
-					if err != nil {
-						return err
-					}
-					if found {
-						openChunk, err = p.cacheStorage.OpenChunk(chunkMeta.ContentSHA)
-						inCache = true
-					}
-				}
-
-				if openChunk == nil {
-					openChunk, err = p.storage.OpenChunk(chunkMeta.ContentSHA)
-				}
-				if err != nil {
-					return fmt.Errorf("open chunk: %s", err)
-				}
-				defer openChunk.Close()
-
-				newData, err := ioutil.ReadAll(openChunk)
+				newData, err := p.fetchChunk(chunkMeta.ContentSHA)
 				if err != nil {
 					return err
 				}
 
-				if p.cacheStorage != nil && !inCache {
-					err := p.cacheStorage.WriteChunk(chunkMeta.ContentSHA, newData)
-					if err != nil {
-						return err
-					}
-				}
-
-				newSHASum := fmt.Sprintf("%x", sha3.Sum256(newData))
-				if chunkMeta.ContentSHA != newSHASum {
-					return fmt.Errorf("invalid sha3sum from downloaded blob, got %s, expected %s", newSHASum, chunkMeta.ContentSHA)
-				}
-
 				zlog.Debug("chunk download finished",
 					zap.Int("chunk_index", n+1),
 					zap.Any("num_chunks", numChunks),
-					zap.Any("new_sha3_sum", newSHASum),
+					zap.Any("new_sha3_sum", chunkMeta.ContentSHA),
 				)
 
 				return f.writeChunkToFile(int64(chunkMeta.Start), newData)
@@ -238,6 +273,73 @@ func (p *PITR) downloadFileFromChunks(fm *FileIndex, localFolder string) error {
 	return nil
 }
 
+// verifyLocalAppendonlyFile checks that the chunks of an append-only file
+// already in the local file, before restoring it, are those of the
+// backup: the last one and AppendonlySampledChunks others. When one
+// differs, the file is restored entirely.
+func (p *PITR) verifyLocalAppendonlyFile(f *FileOps, fm *FileIndex) error {
+	var covered []*ChunkDef
+	for _, chunk := range fm.Chunks {
+		if f.originalSize > chunk.End {
+			covered = append(covered, chunk)
+		}
+	}
+
+	verified, mismatch, err := verifyAppendonlyChunks(f, covered, p.AppendonlySampledChunks)
+	if err != nil {
+		return fmt.Errorf("verifying append-only file: %s", err)
+	}
+	if mismatch != nil {
+		zlog.Warn("local append-only file differs from the backup, restoring it entirely",
+			zap.String("file_name", fm.FileName),
+			zap.Int64("chunk_start", mismatch.Start),
+		)
+		f.isAppendOnly = false
+		return nil
+	}
+
+	zlog.Debug("local append-only file verified", zap.String("file_name", fm.FileName), zap.Int("verified_chunks", len(verified)))
+	return nil
+}
+
+// fetchChunk reads a chunk from the cache when it has it, or downloads
+// it from the storage and caches it otherwise. The content is verified
+// against its sha3 hash.
+// errInvalidChunkHash is returned for chunks whose content doesn't match
+// their hash.
+var errInvalidChunkHash = errors.New("invalid sha3sum")
+
+func (p *PITR) fetchChunk(hash string) ([]byte, error) {
+	if p.cacheStorage != nil {
+		// Read directly, for misses to be counted. Any cache failure falls
+		// back to the storage, and unusable entries are replaced below.
+		data, err := readVerifiedChunk(p.cacheStorage, hash)
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, ErrNotInCache) && !isNotFound(err) {
+			zlog.Info("cached chunk unusable, downloading it", zap.String("sha3_sum", hash), zap.Error(err))
+		}
+	}
+
+	data, err := readAllAndClose(p.storage.OpenChunk(hash))
+	if err != nil {
+		return nil, fmt.Errorf("open chunk: %w", err)
+	}
+
+	if shasum := fmt.Sprintf("%x", sha3.Sum256(data)); shasum != hash {
+		return nil, fmt.Errorf("%w from downloaded blob, got %s, expected %s", errInvalidChunkHash, shasum, hash)
+	}
+
+	if p.cacheStorage != nil {
+		if err := p.cacheStorage.WriteChunk(hash, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
 func (p *PITR) downloadBackupIndex(name string) (out *BackupIndex, err error) {
 	y, err := p.storage.OpenBackupIndex(name)
 	if err != nil {
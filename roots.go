@@ -0,0 +1,76 @@
+package pitreos
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Root is a named source directory of a backup, or a destination of a
+// restore. Files under a root are recorded as `{name}/{relative path}`,
+// so a backup of several roots restores, by default, as one directory
+// holding each root as a subdirectory.
+type Root struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// ParseRoots parses roots given like `blocks=/mnt/a/blocks,state=/mnt/b/state`.
+func ParseRoots(in string) ([]Root, error) {
+	var roots []Root
+	for _, part := range strings.Split(in, ",") {
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid root %q, specify roots like: name=/path,othername=/otherpath", part)
+		}
+		roots = append(roots, Root{Name: kv[0], Path: kv[1]})
+	}
+
+	if err := validateRoots(roots); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// IsRootsSpec reports whether a command-line path argument is a list of
+// named roots rather than a single directory: it starts with a valid root
+// name followed by `=`, so a path like `/data/a=b` is a directory.
+func IsRootsSpec(in string) bool {
+	kv := strings.SplitN(in, "=", 2)
+	return len(kv) == 2 && isValidRootName(kv[0])
+}
+
+func isValidRootName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+func validateRoots(roots []Root) error {
+	if len(roots) == 0 {
+		return fmt.Errorf("no root specified")
+	}
+
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		if !isValidRootName(root.Name) {
+			return fmt.Errorf("invalid root name %q", root.Name)
+		}
+		if seen[root.Name] {
+			return fmt.Errorf("root %q specified twice", root.Name)
+		}
+		seen[root.Name] = true
+	}
+	return nil
+}
+
+// fileNameInRoot returns the file name recorded in backup indexes for
+// `relName` under `root`.
+func fileNameInRoot(root, relName string) string {
+	if root == "" {
+		return relName
+	}
+	return filepath.ToSlash(filepath.Join(root, relName))
+}
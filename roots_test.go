@@ -0,0 +1,81 @@
+package pitreos
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoots(t *testing.T) {
+	roots, err := ParseRoots("blocks=/mnt/a/blocks,state=/mnt/b/state")
+	require.NoError(t, err)
+	assert.Equal(t, []Root{{Name: "blocks", Path: "/mnt/a/blocks"}, {Name: "state", Path: "/mnt/b/state"}}, roots)
+
+	for _, in := range []string{"", "blocks", "blocks=", "=/mnt/a", "a=/x,a=/y", "a/b=/x", "..=/x"} {
+		_, err := ParseRoots(in)
+		assert.Error(t, err, in)
+	}
+
+	assert.True(t, IsRootsSpec("blocks=/mnt/a/blocks"))
+	assert.False(t, IsRootsSpec("/mnt/a/blocks"))
+	assert.False(t, IsRootsSpec("/data/a=b"))
+	assert.False(t, IsRootsSpec("./a=b"))
+	assert.False(t, IsRootsSpec("=/mnt/a"))
+}
+
+func TestPITR_GenerateBackupFromRoots(t *testing.T) {
+	blocks := newTestSourceDir(t, map[string][]byte{"blocks.log": testContent(1024, 1), "reversible/shared.bin": testContent(10, 2)})
+	state := newTestSourceDir(t, map[string][]byte{"shared_memory.bin": testContent(2048, 3)})
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+
+	filter, err := NewIncludeThanExcludeFilter("", "reversible")
+	require.NoError(t, err)
+	roots := []Root{{Name: "blocks", Path: blocks}, {Name: "state", Path: state}}
+	require.NoError(t, pitr.GenerateBackupFromRoots(roots, "dev", nil, filter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+
+	bm, err := pitr.downloadBackupIndex(list[0])
+	require.NoError(t, err)
+	assert.Equal(t, roots, bm.Roots)
+
+	var names []string
+	for _, file := range bm.Files {
+		names = append(names, file.Root+":"+file.FileName)
+	}
+	assert.Equal(t, []string{"blocks:blocks/blocks.log", "state:state/shared_memory.bin"}, names)
+
+	// Each root to its own destination
+	restoreBlocks := newTestSourceDir(t, nil)
+	restoreState := filepath.Join(newTestSourceDir(t, nil), "state")
+	require.NoError(t, pitr.RestoreFromBackupToRoots([]Root{{Name: "blocks", Path: restoreBlocks}, {Name: "state", Path: restoreState}}, list[0], AllFileFilter))
+	assertSameFiles(t, blocks, restoreBlocks, "blocks.log")
+	assertSameFiles(t, state, restoreState, "shared_memory.bin")
+
+	// Only some roots
+	restoreBlocks = newTestSourceDir(t, nil)
+	require.NoError(t, pitr.RestoreFromBackupToRoots([]Root{{Name: "blocks", Path: restoreBlocks}}, list[0], AllFileFilter))
+	files, err := ioutil.ReadDir(restoreBlocks)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "blocks.log", files[0].Name())
+
+	err = pitr.RestoreFromBackupToRoots([]Root{{Name: "missing", Path: restoreBlocks}}, list[0], AllFileFilter)
+	assert.Error(t, err)
+
+	// Roots as subdirectories
+	restoreDir := newTestSourceDir(t, nil)
+	require.NoError(t, pitr.RestoreFromBackup(restoreDir, list[0], AllFileFilter))
+	assertSameFiles(t, blocks, filepath.Join(restoreDir, "blocks"), "blocks.log")
+	assertSameFiles(t, state, filepath.Join(restoreDir, "state"), "shared_memory.bin")
+	_, err = os.Stat(filepath.Join(restoreDir, "blocks", "reversible"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,145 @@
+package pitreos
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// NewBackupsHandler serves the backups of `p` read-only over HTTP:
+//
+//	GET /backups[?prefix=2018-08&tag=prod&limit=100&offset=0]  backups with their metadata, as JSON
+//	GET /backups/{backup}                                      the backup index, as JSON
+//	GET /backups/{backup}/files/{filename}                     the content of a file, with Range support
+//
+// Files are assembled from their chunks on the fly, so fetching a single
+// file from a backup doesn't require restoring it.
+func NewBackupsHandler(p *PITR) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.URL.Path == "/backups" || r.URL.Path == "/backups/" {
+			p.serveBackupList(w, r)
+			return
+		}
+
+		rest := strings.TrimPrefix(r.URL.Path, "/backups/")
+		if rest == r.URL.Path {
+			http.NotFound(w, r)
+			return
+		}
+
+		parts := strings.SplitN(rest, "/", 3)
+		switch {
+		case len(parts) == 1:
+			p.serveBackupIndex(w, r, parts[0])
+		case len(parts) == 3 && parts[1] == "files" && parts[2] != "":
+			p.serveBackupFile(w, r, parts[0], parts[2])
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (p *PITR) serveBackupList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := 100
+	offset := 0
+	for param, value := range map[string]*int{"limit": &limit, "offset": &offset} {
+		if query.Get(param) == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(query.Get(param))
+		if err != nil || n < 0 {
+			http.Error(w, "invalid "+param, http.StatusBadRequest)
+			return
+		}
+		*value = n
+	}
+
+	var list []*ListableBackup
+	var err error
+	if tag := query.Get("tag"); tag != "" {
+		list, err = p.ListTaggedBackups(limit, offset, query.Get("prefix"), tag, true)
+	} else {
+		list, err = p.ListBackups(limit, offset, query.Get("prefix"), true)
+	}
+	if err != nil {
+		serveError(w, "listing backups", err)
+		return
+	}
+	if list == nil {
+		list = []*ListableBackup{}
+	}
+
+	serveJSON(w, list)
+}
+
+func (p *PITR) serveBackupIndex(w http.ResponseWriter, r *http.Request, backupName string) {
+	bm, found := p.serveableBackupIndex(w, r, backupName)
+	if !found {
+		return
+	}
+
+	serveJSON(w, bm)
+}
+
+func (p *PITR) serveBackupFile(w http.ResponseWriter, r *http.Request, backupName, filename string) {
+	bm, found := p.serveableBackupIndex(w, r, backupName)
+	if !found {
+		return
+	}
+
+	file, err := bm.findFileIndex(filename)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", file.Date, p.newFileReader(file))
+}
+
+func (p *PITR) serveableBackupIndex(w http.ResponseWriter, r *http.Request, backupName string) (*BackupIndex, bool) {
+	exists, err := p.storage.ListBackups(1, backupName)
+	if err != nil {
+		serveError(w, "listing backups", err)
+		return nil, false
+	}
+	if len(exists) == 0 || exists[0] != backupName {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	bm, err := p.downloadBackupIndex(backupName)
+	if err != nil {
+		serveError(w, "reading backup index", err)
+		return nil, false
+	}
+	return bm, true
+}
+
+func serveJSON(w http.ResponseWriter, v interface{}) {
+	cnt, err := json.Marshal(v)
+	if err != nil {
+		serveError(w, "encoding response", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(cnt)
+}
+
+func serveError(w http.ResponseWriter, msg string, err error) {
+	zlog.Warn("cannot serve request", zap.String("error_context", msg), zap.Error(err))
+	http.Error(w, msg, http.StatusInternalServerError)
+}
@@ -0,0 +1,101 @@
+package pitreos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupsHandler(t *testing.T) {
+	// Second MiB is all zeros, so stored as an empty chunk
+	content := testContent(3*1024*1024+100, 1)
+	for i := 1024 * 1024; i < 2*1024*1024; i++ {
+		content[i] = 0
+	}
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	source := newTestSourceDir(t, map[string][]byte{
+		"data/a.bin": content,
+		"config.ini": []byte("p2p-peer-address = 1.2.3.4:9876\n"),
+	})
+	require.NoError(t, pitr.GenerateBackup(source, "dev", map[string]interface{}{"block_num": 42}, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+	backupName := list[0]
+
+	server := httptest.NewServer(NewBackupsHandler(pitr))
+	defer server.Close()
+
+	get := func(path string, headers ...string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		require.NoError(t, err)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, body
+	}
+
+	resp, body := get("/backups")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var backups []*ListableBackup
+	require.NoError(t, json.Unmarshal(body, &backups))
+	require.Len(t, backups, 1)
+	assert.Equal(t, backupName, backups[0].Name)
+	assert.Equal(t, float64(42), backups[0].Meta["block_num"])
+
+	resp, body = get("/backups?offset=1")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "[]", string(body))
+
+	resp, body = get("/backups/" + backupName)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var bm BackupIndex
+	require.NoError(t, json.Unmarshal(body, &bm))
+	assert.Equal(t, "v3", bm.Version)
+	assert.Len(t, bm.Files, 2)
+
+	resp, body = get("/backups/" + backupName + "/files/config.ini")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "p2p-peer-address = 1.2.3.4:9876\n", string(body))
+
+	resp, body = get("/backups/" + backupName + "/files/data/a.bin")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, body)
+
+	// Range spanning a full chunk, an empty chunk and a partial chunk
+	start, end := 1024*1024-10, 2*1024*1024+10
+	resp, body = get("/backups/"+backupName+"/files/data/a.bin", "Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[start:end+1], body)
+
+	resp, body = get("/backups/"+backupName+"/files/data/a.bin", "Range", "bytes=-50")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[len(content)-50:], body)
+
+	for _, path := range []string{
+		"/backups/" + backupName + "/files/missing",
+		"/backups/" + backupName[:10],
+		"/backups/" + backupName + "/other",
+		"/backups/../indexes/" + backupName,
+		"/other",
+	} {
+		resp, _ := get(path)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+}
@@ -0,0 +1,110 @@
+package pitreos
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// SnapshotMode selects whether files are cloned before being backed up, so
+// that the chunks of a file being written to, like the state of a running
+// nodeos, are all read from the same point in time.
+type SnapshotMode string
+
+const (
+	// SnapshotOff backs up files as they are, while they may change.
+	SnapshotOff SnapshotMode = "off"
+
+	// SnapshotReflink backs up a reflink clone of each file, failing on
+	// filesystems not supporting them.
+	SnapshotReflink SnapshotMode = "reflink"
+
+	// SnapshotAuto backs up a reflink clone of each file when the
+	// filesystem supports them, and the file as it is otherwise.
+	SnapshotAuto SnapshotMode = "auto"
+)
+
+// ErrReflinkUnsupported is returned when snapshotting files on a
+// filesystem without reflinks. On Linux, XFS (formatted with
+// `reflink=1`) and Btrfs support them.
+var ErrReflinkUnsupported = errors.New("reflinks not supported by the filesystem")
+
+// snapshotFilePrefix prefixes the clones of files, created next to them.
+// Clones left behind by a crash are not backed up.
+const snapshotFilePrefix = ".pitreos-snapshot-"
+
+func ParseSnapshotMode(mode string) (SnapshotMode, error) {
+	switch SnapshotMode(mode) {
+	case "", SnapshotOff:
+		return SnapshotOff, nil
+	case SnapshotReflink, SnapshotAuto:
+		return SnapshotMode(mode), nil
+	}
+	return "", fmt.Errorf("invalid snapshot mode %q, use one of: off, reflink, auto", mode)
+}
+
+func isSnapshotFile(filePath string) bool {
+	return strings.HasPrefix(filepath.Base(filePath), snapshotFilePrefix)
+}
+
+// OpenSnapshot opens the file like Open, then replaces it with a reflink
+// clone, unless `mode` is SnapshotOff. The clone shares the blocks of the
+// file, so is instant and takes no space, until the file is written to.
+// In SnapshotAuto mode, files that can't be cloned, on filesystems
+// without reflinks or in directories where no clone can be created, are
+// kept open as is, and `cloned` is false.
+//
+// The clone is deleted as soon as it is open, so it goes away when the
+// file is closed.
+func (f *FileOps) OpenSnapshot(mode SnapshotMode) (cloned bool, err error) {
+	if err := f.Open(); err != nil {
+		return false, err
+	}
+	if mode == "" || mode == SnapshotOff {
+		return false, nil
+	}
+
+	clone, err := f.clone()
+	if mode == SnapshotAuto && cloneUnsupported(err) {
+		zlog.Debug("cannot snapshot file, backing it up as is", zap.String("file_path", f.filePath), zap.Error(err))
+		return false, nil
+	}
+	if err != nil {
+		f.file.Close()
+		return false, fmt.Errorf("snapshot of %q: %w", f.filePath, err)
+	}
+
+	f.file.Close()
+	f.file = clone
+	return true, nil
+}
+
+// cloneUnsupported tells whether a clone failed because of where the file
+// is: on a filesystem without reflinks, or read-only, or in a directory
+// the process can't write to.
+func cloneUnsupported(err error) bool {
+	return errors.Is(err, ErrReflinkUnsupported) || errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EROFS)
+}
+
+func (f *FileOps) clone() (*os.File, error) {
+	clonePath := filepath.Join(filepath.Dir(f.filePath), fmt.Sprintf("%s%s-%s", snapshotFilePrefix, filepath.Base(f.filePath), randomSuffix()))
+	clone, err := os.OpenFile(clonePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(clonePath); err != nil {
+		clone.Close()
+		return nil, err
+	}
+
+	if err := cloneFile(clone, f.file); err != nil {
+		clone.Close()
+		return nil, err
+	}
+	return clone, nil
+}
@@ -0,0 +1,164 @@
+package pitreos
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reflinkSupported reports whether the filesystem of `dir` supports
+// reflinks: the temporary directory usually doesn't.
+func reflinkSupported(t *testing.T, dir string) bool {
+	src, err := ioutil.TempFile(dir, "src")
+	require.NoError(t, err)
+	defer src.Close()
+	dst, err := ioutil.TempFile(dir, "dst")
+	require.NoError(t, err)
+	defer dst.Close()
+
+	err = cloneFile(dst, src)
+	require.NoError(t, os.Remove(src.Name()))
+	require.NoError(t, os.Remove(dst.Name()))
+	if err == ErrReflinkUnsupported {
+		return false
+	}
+	require.NoError(t, err)
+	return true
+}
+
+func TestParseSnapshotMode(t *testing.T) {
+	for in, expected := range map[string]SnapshotMode{"": SnapshotOff, "off": SnapshotOff, "reflink": SnapshotReflink, "auto": SnapshotAuto} {
+		mode, err := ParseSnapshotMode(in)
+		require.NoError(t, err)
+		assert.Equal(t, expected, mode)
+	}
+
+	_, err := ParseSnapshotMode("copy")
+	assert.Error(t, err)
+}
+
+func TestFileOps_OpenSnapshot(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{"state.bin": testContent(1000, 1)})
+	if reflinkSupported(t, source) {
+		t.Skip("temporary directory supports reflinks, see TestFileOps_OpenSnapshot_Reflink")
+	}
+	filePath := filepath.Join(source, "state.bin")
+
+	f := NewFileOps(filePath, false)
+	_, err := f.OpenSnapshot(SnapshotReflink)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ErrReflinkUnsupported.Error())
+
+	// Auto falls back to the file itself
+	cloned, err := f.OpenSnapshot(SnapshotAuto)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.False(t, cloned)
+	assert.Equal(t, filePath, f.file.Name())
+
+	entries, err := ioutil.ReadDir(source)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestFileOps_OpenSnapshot_ReadOnlyDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	source := newTestSourceDir(t, map[string][]byte{"state.bin": testContent(1000, 1)})
+	require.NoError(t, os.Chmod(source, 0500))
+	defer os.Chmod(source, 0700)
+	filePath := filepath.Join(source, "state.bin")
+
+	f := NewFileOps(filePath, false)
+	_, err := f.OpenSnapshot(SnapshotReflink)
+	require.Error(t, err)
+
+	// Auto backs up the file as is, like without reflinks
+	cloned, err := f.OpenSnapshot(SnapshotAuto)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.False(t, cloned)
+	assert.Equal(t, filePath, f.file.Name())
+}
+
+// TestFileOps_OpenSnapshot_Reflink needs PITREOS_TEST_REFLINK_DIR to point
+// to a directory on a filesystem supporting reflinks, like a loopback
+// mount of an XFS image formatted with `mkfs.xfs -m reflink=1`, or Btrfs.
+func TestFileOps_OpenSnapshot_Reflink(t *testing.T) {
+	dir := os.Getenv("PITREOS_TEST_REFLINK_DIR")
+	if dir == "" {
+		t.Skip("PITREOS_TEST_REFLINK_DIR not set")
+	}
+	source, err := ioutil.TempDir(dir, "pitreos-reflink")
+	require.NoError(t, err)
+	defer os.RemoveAll(source)
+	require.True(t, reflinkSupported(t, source), "%s doesn't support reflinks", dir)
+
+	filePath := filepath.Join(source, "state.bin")
+	require.NoError(t, ioutil.WriteFile(filePath, testContent(1000, 1), 0644))
+
+	f := NewFileOps(filePath, false)
+	cloned, err := f.OpenSnapshot(SnapshotReflink)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.True(t, cloned)
+
+	// Writes to the file after the snapshot don't show in it
+	require.NoError(t, ioutil.WriteFile(filePath, testContent(1000, 2), 0644))
+	data, empty, err := f.getLocalChunk(0, 1000)
+	require.NoError(t, err)
+	assert.False(t, empty)
+	assert.Equal(t, testContent(1000, 1), data)
+
+	// The clone is gone as soon as it is open
+	entries, err := ioutil.ReadDir(source)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "state.bin", entries[0].Name())
+
+	// And backups go through it
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.Snapshot = SnapshotReflink
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	dest, err := ioutil.TempDir("", "pitreos-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	latest, err := pitr.GetLatestBackup("dev")
+	require.NoError(t, err)
+	require.NoError(t, pitr.RestoreFromBackup(dest, latest, AllFileFilter))
+	assertSameFiles(t, source, dest, "state.bin")
+}
+
+func TestPITR_GenerateBackup_Snapshot(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{
+		"state.bin":                        testContent(1000, 1),
+		snapshotFilePrefix + "state.bin-x": testContent(1000, 2),
+	})
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	pitr.Snapshot = SnapshotAuto
+	require.NoError(t, pitr.GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	list, err := storage.ListBackups(10, "")
+	require.NoError(t, err)
+	bm, err := pitr.downloadBackupIndex(list[0])
+	require.NoError(t, err)
+
+	// Clones left over by a crash aren't backed up
+	require.Len(t, bm.Files, 1)
+	assert.Equal(t, "state.bin", bm.Files[0].FileName)
+
+	dest, err := ioutil.TempDir("", "pitreos-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	require.NoError(t, pitr.RestoreFromBackup(dest, list[0], AllFileFilter))
+	assertSameFiles(t, source, dest, "state.bin")
+}
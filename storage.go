@@ -2,12 +2,17 @@ package pitreos
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/url"
+	"os"
 	"path"
 	"strings"
 	"time"
 
+	gcs "cloud.google.com/go/storage"
 	"github.com/dfuse-io/dstore"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
@@ -24,6 +29,69 @@ type Storage interface {
 	SetTimeout(timeout time.Duration)
 }
 
+// ConditionalChunkWriter is implemented by storages able to create a
+// chunk only when it doesn't exist yet, in a single atomic operation.
+// Backups use it instead of ChunkExists followed by WriteChunk.
+type ConditionalChunkWriter interface {
+	WriteChunkIfAbsent(hash string, content []byte) (written bool, err error)
+}
+
+// ChunkRangeOpener is implemented by storages able to read part of a
+// chunk without transferring it whole.
+type ChunkRangeOpener interface {
+	OpenChunkRange(hash string, offset, length int64) (io.ReadCloser, error)
+}
+
+// conditionalSupport is implemented by storages wrapping others, like
+// PeerStorage and ReplicatedStorage. They have the methods of
+// ConditionalLockStorage and ConditionalRefStorage, but only honor them
+// when the storages they wrap do.
+type conditionalSupport interface {
+	supportsConditionalLocks() bool
+	supportsConditionalRefs() bool
+}
+
+var errConditionalUnsupported = errors.New("conditional writes not supported by storage")
+
+// writeChunkIfAbsent creates the chunk unless `storage` already has it,
+// atomically when it is a ConditionalChunkWriter.
+func writeChunkIfAbsent(storage Storage, hash string, content []byte) (written bool, err error) {
+	if cw, ok := storage.(ConditionalChunkWriter); ok {
+		return cw.WriteChunkIfAbsent(hash, content)
+	}
+
+	exists, err := storage.ChunkExists(hash)
+	if err != nil || exists {
+		return false, err
+	}
+	return true, storage.WriteChunk(hash, content)
+}
+
+// isNotFound tells whether `err` reports a missing object, as opposed to
+// a failure of the storage itself.
+func isNotFound(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, gcs.ErrObjectNotExist) || isS3NotFound(err)
+}
+
+// NewStorage creates the Storage matching the scheme of `baseURL`.
+// Native implementations are used when available, everything else goes
+// through `dstore`.
+func NewStorage(ctx context.Context, baseURL string) (Storage, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return NewS3Storage(ctx, baseURL)
+	case "sftp":
+		return NewSFTPStorage(ctx, baseURL)
+	}
+
+	return NewDStoreStorage(ctx, baseURL)
+}
+
 type DStoreStorage struct {
 	store   dstore.Store
 	ctx     context.Context
@@ -79,6 +147,18 @@ func (s *DStoreStorage) indexPath(name string) string {
 	return path.Join("indexes", fmt.Sprintf("%s.yaml.gz", name))
 }
 
+func (s *DStoreStorage) metaPath(name string) string {
+	return path.Join("meta", fmt.Sprintf("%s.json", name))
+}
+
+func (s *DStoreStorage) refPath(name string) string {
+	return path.Join("refs", name)
+}
+
+func (s *DStoreStorage) lockPath(name string) string {
+	return path.Join("locks", fmt.Sprintf("%s.json", name))
+}
+
 func (s *DStoreStorage) chunkPath(hash string) string {
 	return path.Join("chunks", hash)
 }
@@ -88,6 +168,62 @@ func (s *DStoreStorage) WriteBackupIndex(name string, content []byte) (err error
 	return s.store.WriteObject(s.ctx, s.indexPath(name), br)
 }
 
+func (s *DStoreStorage) OpenBackupMeta(name string) (io.ReadCloser, error) {
+	return s.openExisting(s.metaPath(name))
+}
+
+func (s *DStoreStorage) WriteBackupMeta(name string, content []byte) error {
+	return s.store.WriteObject(s.ctx, s.metaPath(name), bytes.NewReader(content))
+}
+
+func (s *DStoreStorage) OpenRef(name string) (io.ReadCloser, error) {
+	return s.openExisting(s.refPath(name))
+}
+
+func (s *DStoreStorage) WriteRef(name string, content []byte) error {
+	return s.store.WriteObject(s.ctx, s.refPath(name), bytes.NewReader(content))
+}
+
+func (s *DStoreStorage) ListLocks() (out []string, err error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	files, err := s.store.ListFiles(ctx, "locks/", "", math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		out = append(out, strings.TrimSuffix(strings.TrimPrefix(f, "locks/"), ".json"))
+	}
+	return out, nil
+}
+
+func (s *DStoreStorage) OpenLock(name string) (io.ReadCloser, error) {
+	return s.openExisting(s.lockPath(name))
+}
+
+func (s *DStoreStorage) WriteLock(name string, content []byte) error {
+	return s.store.WriteObject(s.ctx, s.lockPath(name), bytes.NewReader(content))
+}
+
+func (s *DStoreStorage) DeleteLock(name string) error {
+	return s.store.DeleteObject(s.ctx, s.lockPath(name))
+}
+
+// openExisting opens objects which may not exist, like refs and locks,
+// checking first: some stores, like Azure's, exit the process when asked
+// to open a missing object. Missing objects yield os.ErrNotExist.
+func (s *DStoreStorage) openExisting(objectPath string) (io.ReadCloser, error) {
+	exists, err := s.store.FileExists(s.ctx, objectPath)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: objectPath, Err: os.ErrNotExist}
+	}
+	return s.store.OpenObject(s.ctx, objectPath)
+}
+
 func (s *DStoreStorage) WriteChunk(hash string, content []byte) (err error) {
 	br := bytes.NewBuffer(content)
 	return s.store.WriteObject(s.ctx, s.chunkPath(hash), br)
@@ -0,0 +1,324 @@
+package pitreos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errReadOnlyStorage = errors.New("storage is read-only")
+
+var chunkHashRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// NewChunkHandler serves the chunks of `storage` read-only over HTTP, as
+// `GET /chunks/{sha3}` (uncompressed content) and `HEAD /chunks/{sha3}`.
+// It is meant to expose a node's CacheStorage to its neighbors, which
+// read it through an HTTPStorage.
+func NewChunkHandler(storage Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		hash := strings.TrimPrefix(r.URL.Path, "/chunks/")
+		if hash == r.URL.Path || !chunkHashRegexp.MatchString(hash) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method == http.MethodHead {
+			exists, err := storage.ChunkExists(hash)
+			if err != nil {
+				zlog.Warn("cannot check chunk existence", zap.String("hash", hash), zap.Error(err))
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.NotFound(w, r)
+			}
+			return
+		}
+
+		content, err := readVerifiedChunk(storage, hash)
+		if err != nil {
+			zlog.Debug("cannot serve chunk", zap.String("hash", hash), zap.Error(err))
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if _, err := w.Write(content); err != nil {
+			zlog.Debug("cannot send chunk", zap.String("hash", hash), zap.Error(err))
+		}
+	})
+}
+
+// HTTPStorage reads chunks from a remote `NewChunkHandler`, like the one
+// started by `pitreos serve-cache`. It is read-only, and has no backup
+// indexes: use it as a peer of a PeerStorage.
+type HTTPStorage struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewHTTPStorage(baseURL string) *HTTPStorage {
+	return &HTTPStorage{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *HTTPStorage) SetTimeout(timeout time.Duration) {
+	s.client.Timeout = timeout
+}
+
+func (s *HTTPStorage) ListBackups(limit int, prefix string) ([]string, error) {
+	return nil, nil
+}
+
+func (s *HTTPStorage) OpenBackupIndex(name string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("backup indexes are not served over http")
+}
+
+func (s *HTTPStorage) WriteBackupIndex(name string, content []byte) error {
+	return errReadOnlyStorage
+}
+
+func (s *HTTPStorage) WriteChunk(hash string, content []byte) error {
+	return errReadOnlyStorage
+}
+
+func (s *HTTPStorage) chunkURL(hash string) string {
+	return fmt.Sprintf("%s/chunks/%s", s.baseURL, hash)
+}
+
+func (s *HTTPStorage) OpenChunk(hash string) (io.ReadCloser, error) {
+	resp, err := s.client.Get(s.chunkURL(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching chunk %q from %s: %s", hash, s.baseURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *HTTPStorage) ChunkExists(hash string) (bool, error) {
+	resp, err := s.client.Head(s.chunkURL(hash))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("checking chunk %q on %s: %s", hash, s.baseURL, resp.Status)
+}
+
+// PeerStorage reads chunks from `peers` first, and falls back to
+// `remote` when none of them has the chunk, or serves it corrupted.
+// Everything else, including writes, goes to `remote`: methods of the
+// optional storage interfaces fail when `remote` doesn't implement them.
+type PeerStorage struct {
+	Storage
+	peers []Storage
+}
+
+func NewPeerStorage(remote Storage, peers ...Storage) *PeerStorage {
+	return &PeerStorage{
+		Storage: remote,
+		peers:   peers,
+	}
+}
+
+func (s *PeerStorage) OpenChunk(hash string) (io.ReadCloser, error) {
+	for _, peer := range s.peers {
+		content, err := readVerifiedChunk(peer, hash)
+		if err != nil {
+			zlog.Debug("chunk not available from peer", zap.String("hash", hash), zap.Error(err))
+			continue
+		}
+
+		zlog.Debug("chunk read from peer", zap.String("hash", hash))
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+
+	return s.Storage.OpenChunk(hash)
+}
+
+// OpenChunkRange reads the chunk whole from peers, which are close, and
+// only part of it from `remote`, when it supports that.
+func (s *PeerStorage) OpenChunkRange(hash string, offset, length int64) (io.ReadCloser, error) {
+	rangeOpener, ok := s.Storage.(ChunkRangeOpener)
+	if !ok {
+		return openChunkRange(s, hash, offset, length)
+	}
+
+	for _, peer := range s.peers {
+		content, err := readVerifiedChunk(peer, hash)
+		if err != nil {
+			zlog.Debug("chunk not available from peer", zap.String("hash", hash), zap.Error(err))
+			continue
+		}
+		return chunkContentRange(content, offset, length)
+	}
+
+	return rangeOpener.OpenChunkRange(hash, offset, length)
+}
+
+// WriteChunkIfAbsent is forwarded to `remote`, so the embedded Storage
+// doesn't hide it.
+func (s *PeerStorage) WriteChunkIfAbsent(hash string, content []byte) (bool, error) {
+	return writeChunkIfAbsent(s.Storage, hash, content)
+}
+
+// Conditional writes of locks and refs go to `remote`, when it supports
+// them.
+func (s *PeerStorage) supportsConditionalLocks() bool {
+	_, ok := asConditionalLockStorage(s.Storage)
+	return ok
+}
+
+func (s *PeerStorage) supportsConditionalRefs() bool {
+	_, ok := asConditionalRefStorage(s.Storage)
+	return ok
+}
+
+func (s *PeerStorage) OpenLockVersion(name string) (io.ReadCloser, string, error) {
+	conditional, ok := asConditionalLockStorage(s.Storage)
+	if !ok {
+		return nil, "", errConditionalUnsupported
+	}
+	return conditional.OpenLockVersion(name)
+}
+
+func (s *PeerStorage) WriteLockIfVersion(name string, content []byte, version string) (bool, error) {
+	conditional, ok := asConditionalLockStorage(s.Storage)
+	if !ok {
+		return false, errConditionalUnsupported
+	}
+	return conditional.WriteLockIfVersion(name, content, version)
+}
+
+func (s *PeerStorage) OpenRefVersion(name string) (io.ReadCloser, string, error) {
+	conditional, ok := asConditionalRefStorage(s.Storage)
+	if !ok {
+		return nil, "", errConditionalUnsupported
+	}
+	return conditional.OpenRefVersion(name)
+}
+
+func (s *PeerStorage) WriteRefIfVersion(name string, content []byte, version string) (bool, error) {
+	conditional, ok := asConditionalRefStorage(s.Storage)
+	if !ok {
+		return false, errConditionalUnsupported
+	}
+	return conditional.WriteRefIfVersion(name, content, version)
+}
+
+// openChunkRange reads part of a chunk from storages only able to read it
+// whole.
+func openChunkRange(storage Storage, hash string, offset, length int64) (io.ReadCloser, error) {
+	content, err := readAllAndClose(storage.OpenChunk(hash))
+	if err != nil {
+		return nil, err
+	}
+	return chunkContentRange(content, offset, length)
+}
+
+func chunkContentRange(content []byte, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 || offset > int64(len(content)) {
+		return nil, fmt.Errorf("range %d-%d out of chunk of %d bytes", offset, offset+length, len(content))
+	}
+	end := offset + length
+	if end > int64(len(content)) {
+		end = int64(len(content))
+	}
+	return ioutil.NopCloser(bytes.NewReader(content[offset:end])), nil
+}
+
+func (s *PeerStorage) unsupported(what string) error {
+	return fmt.Errorf("%s not supported by %T", what, s.Storage)
+}
+
+func (s *PeerStorage) OpenBackupMeta(name string) (io.ReadCloser, error) {
+	metaStorage, ok := s.Storage.(BackupMetaStorage)
+	if !ok {
+		return nil, s.unsupported("backup metadata")
+	}
+	return metaStorage.OpenBackupMeta(name)
+}
+
+func (s *PeerStorage) WriteBackupMeta(name string, content []byte) error {
+	metaStorage, ok := s.Storage.(BackupMetaStorage)
+	if !ok {
+		return s.unsupported("backup metadata")
+	}
+	return metaStorage.WriteBackupMeta(name, content)
+}
+
+func (s *PeerStorage) OpenRef(name string) (io.ReadCloser, error) {
+	refStorage, ok := s.Storage.(RefStorage)
+	if !ok {
+		return nil, s.unsupported("refs")
+	}
+	return refStorage.OpenRef(name)
+}
+
+func (s *PeerStorage) WriteRef(name string, content []byte) error {
+	refStorage, ok := s.Storage.(RefStorage)
+	if !ok {
+		return s.unsupported("refs")
+	}
+	return refStorage.WriteRef(name, content)
+}
+
+func (s *PeerStorage) ListLocks() ([]string, error) {
+	lockStorage, ok := s.Storage.(LockStorage)
+	if !ok {
+		return nil, s.unsupported("locks")
+	}
+	return lockStorage.ListLocks()
+}
+
+func (s *PeerStorage) OpenLock(name string) (io.ReadCloser, error) {
+	lockStorage, ok := s.Storage.(LockStorage)
+	if !ok {
+		return nil, s.unsupported("locks")
+	}
+	return lockStorage.OpenLock(name)
+}
+
+func (s *PeerStorage) WriteLock(name string, content []byte) error {
+	lockStorage, ok := s.Storage.(LockStorage)
+	if !ok {
+		return s.unsupported("locks")
+	}
+	return lockStorage.WriteLock(name, content)
+}
+
+func (s *PeerStorage) DeleteLock(name string) error {
+	lockStorage, ok := s.Storage.(LockStorage)
+	if !ok {
+		return s.unsupported("locks")
+	}
+	return lockStorage.DeleteLock(name)
+}
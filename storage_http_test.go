@@ -0,0 +1,168 @@
+package pitreos
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestHTTPStorage_ChunkHandler(t *testing.T) {
+	cache, _ := newTestCacheStorage(t, 0)
+	server := httptest.NewServer(NewChunkHandler(cache))
+	defer server.Close()
+
+	content := []byte("some chunk")
+	hash := fmt.Sprintf("%x", sha3.Sum256(content))
+	storage := NewHTTPStorage(server.URL + "/")
+
+	exists, err := storage.ChunkExists(hash)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = storage.OpenChunk(hash)
+	assert.Error(t, err)
+
+	require.NoError(t, cache.WriteChunk(hash, content))
+
+	exists, err = storage.ChunkExists(hash)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	cnt, err := readAllAndClose(storage.OpenChunk(hash))
+	require.NoError(t, err)
+	assert.Equal(t, content, cnt)
+
+	assert.Equal(t, errReadOnlyStorage, storage.WriteChunk(hash, content))
+
+	for _, path := range []string{"/chunks/../stats.json", "/chunks/" + hash[:10], "/stats.json"} {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+
+	resp, err := http.Post(server.URL+"/chunks/"+hash, "application/octet-stream", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestPeerStorage_OpenChunk(t *testing.T) {
+	remote := newTestLocalStorage(t)
+	content := []byte("some chunk")
+	hash := fmt.Sprintf("%x", sha3.Sum256(content))
+	require.NoError(t, remote.WriteChunk(hash, content))
+
+	// Serves a corrupted chunk
+	corrupted := newTestLocalStorage(t)
+	require.NoError(t, corrupted.WriteChunk(hash, []byte("corrupted")))
+
+	// Down
+	down := NewHTTPStorage("http://127.0.0.1:1")
+	down.SetTimeout(time.Second)
+
+	storage := NewPeerStorage(remote, down, corrupted)
+	cnt, err := readAllAndClose(storage.OpenChunk(hash))
+	require.NoError(t, err)
+	assert.Equal(t, content, cnt)
+
+	// Read from the peer when it has the chunk
+	peer := newTestLocalStorage(t)
+	require.NoError(t, peer.WriteChunk(hash, content))
+	storage = NewPeerStorage(newTestLocalStorage(t), down, peer)
+	cnt, err = readAllAndClose(storage.OpenChunk(hash))
+	require.NoError(t, err)
+	assert.Equal(t, content, cnt)
+}
+
+func TestPeerStorage_OptionalInterfaces(t *testing.T) {
+	content := []byte("some chunk")
+	hash := fmt.Sprintf("%x", sha3.Sum256(content))
+
+	_, remote := newTestS3Storage(t, "")
+	storage := NewPeerStorage(remote, NewHTTPStorage("http://127.0.0.1:1"))
+
+	written, err := storage.WriteChunkIfAbsent(hash, content)
+	require.NoError(t, err)
+	assert.True(t, written)
+	written, err = storage.WriteChunkIfAbsent(hash, content)
+	require.NoError(t, err)
+	assert.False(t, written)
+
+	cnt, err := readAllAndClose(storage.OpenChunkRange(hash, 5, 5))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("chunk"), cnt)
+
+	// Remotes without conditional writes or range reads
+	peer := newTestLocalStorage(t)
+	require.NoError(t, peer.WriteChunk(hash, content))
+	storage = NewPeerStorage(newTestLocalStorage(t), peer)
+
+	cnt, err = readAllAndClose(storage.OpenChunkRange(hash, 0, 4))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("some"), cnt)
+
+	written, err = storage.WriteChunkIfAbsent(hash, content)
+	require.NoError(t, err)
+	assert.True(t, written)
+	written, err = storage.WriteChunkIfAbsent(hash, content)
+	require.NoError(t, err)
+	assert.False(t, written)
+
+	// Remotes without metadata objects, refs or locks
+	storage = NewPeerStorage(NewHTTPStorage("http://127.0.0.1:1"))
+	assert.Error(t, storage.WriteBackupMeta("b1", []byte("{}")))
+	assert.Error(t, storage.WriteRef("dev/latest", []byte("b1")))
+	assert.Error(t, storage.WriteLock("dev", []byte("{}")))
+	_, err = storage.OpenBackupMeta("b1")
+	assert.Error(t, err)
+}
+
+func TestPITR_RestoreFromPeer(t *testing.T) {
+	remote := newTestLocalStorage(t)
+	source := newTestSourceDir(t, map[string][]byte{"a.bin": testContent(3*1024*1024+10, 1)})
+	require.NoError(t, New(1, 2, time.Minute, remote).GenerateBackup(source, "dev", nil, AllFileFilter))
+
+	list, err := remote.ListBackups(10, "")
+	require.NoError(t, err)
+
+	peerCache, _ := newTestCacheStorage(t, 0)
+	peerPITR := New(1, 2, time.Minute, remote)
+	peerPITR.SetCacheStorage(peerCache)
+	_, _, err = peerPITR.WarmCache(list[0], AllFileFilter)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(NewChunkHandler(peerCache))
+	defer server.Close()
+
+	// Chunks are all read from the peer
+	counting := &countingStorage{Storage: remote}
+	pitr := New(1, 2, time.Minute, NewPeerStorage(counting, NewHTTPStorage(server.URL)))
+
+	restoreDir := newTestSourceDir(t, nil)
+	require.NoError(t, pitr.RestoreFromBackup(restoreDir, list[0], AllFileFilter))
+	assertSameFiles(t, source, restoreDir, "a.bin")
+	assert.Equal(t, int64(0), counting.openedChunks)
+
+	stats, err := peerCache.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), stats.Hits)
+}
+
+type countingStorage struct {
+	Storage
+	openedChunks int64
+}
+
+func (s *countingStorage) OpenChunk(hash string) (io.ReadCloser, error) {
+	atomic.AddInt64(&s.openedChunks, 1)
+	return s.Storage.OpenChunk(hash)
+}
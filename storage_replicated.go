@@ -0,0 +1,695 @@
+package pitreos
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abourget/llerrgroup"
+	"github.com/ghodss/yaml"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
+)
+
+// unhealthyBackoff is how long a replica that failed a read is tried
+// last, after the healthy ones.
+var unhealthyBackoff = 30 * time.Second
+
+// ReplicatedStorage writes indexes and chunks to several Storage
+// backends, and reads from any of them.
+//
+// A write succeeds when at least `quorum` backends accepted it. Reads go
+// to the first healthy backend (in the order given) unless ReadFastest
+// is set, in which case all backends are queried at once and the first
+// to answer wins. Failed reads fall back to the other backends.
+//
+// Conditional writes of locks and refs are made on the primary, which
+// arbitrates concurrent writers, then copied to the other backends.
+type ReplicatedStorage struct {
+	backends []Storage
+	quorum   int
+
+	ReadFastest bool
+
+	healthLock     sync.Mutex
+	unhealthyUntil []time.Time
+}
+
+// NewReplicatedStorage replicates on `backends`, the first one being
+// the primary. A `quorum` of 0 means all backends must acknowledge writes.
+func NewReplicatedStorage(quorum int, backends ...Storage) (*ReplicatedStorage, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("replicated storage needs at least one backend")
+	}
+	if quorum == 0 {
+		quorum = len(backends)
+	}
+	if quorum < 0 || quorum > len(backends) {
+		return nil, fmt.Errorf("invalid write quorum %d, must be between 1 and %d", quorum, len(backends))
+	}
+
+	return &ReplicatedStorage{
+		backends:       backends,
+		quorum:         quorum,
+		unhealthyUntil: make([]time.Time, len(backends)),
+	}, nil
+}
+
+// Backends returns the replicated Storage backends, primary first.
+func (r *ReplicatedStorage) Backends() []Storage {
+	return r.backends
+}
+
+func (r *ReplicatedStorage) SetTimeout(timeout time.Duration) {
+	for _, backend := range r.backends {
+		backend.SetTimeout(timeout)
+	}
+}
+
+// ListBackups merges the backups found on all reachable replicas.
+func (r *ReplicatedStorage) ListBackups(limit int, prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	var lastErr error
+	var answered int
+
+	for i, backend := range r.backends {
+		list, err := backend.ListBackups(limit, prefix)
+		if err != nil {
+			zlog.Warn("replica failed listing backups", zap.Int("replica", i), zap.Error(err))
+			r.markUnhealthy(i)
+			lastErr = err
+			continue
+		}
+		answered++
+
+		for _, name := range list {
+			seen[name] = true
+		}
+	}
+
+	if answered == 0 {
+		return nil, fmt.Errorf("no replica could list backups: %w", lastErr)
+	}
+
+	out := make([]string, 0, len(seen))
+	for name := range seen {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (r *ReplicatedStorage) OpenBackupIndex(name string) (io.ReadCloser, error) {
+	return r.read(func(backend Storage) (io.ReadCloser, error) {
+		return backend.OpenBackupIndex(name)
+	})
+}
+
+func (r *ReplicatedStorage) WriteBackupIndex(name string, content []byte) error {
+	return r.write(fmt.Sprintf("backup index %q", name), func(backend Storage) error {
+		return backend.WriteBackupIndex(name, content)
+	})
+}
+
+// OpenBackupMeta and WriteBackupMeta only involve replicas supporting
+// backup metadata objects.
+func (r *ReplicatedStorage) OpenBackupMeta(name string) (io.ReadCloser, error) {
+	return r.read(func(backend Storage) (io.ReadCloser, error) {
+		metaStorage, ok := backend.(BackupMetaStorage)
+		if !ok {
+			return nil, fmt.Errorf("backup metadata not supported")
+		}
+		return metaStorage.OpenBackupMeta(name)
+	})
+}
+
+func (r *ReplicatedStorage) WriteBackupMeta(name string, content []byte) error {
+	return r.write(fmt.Sprintf("backup meta %q", name), func(backend Storage) error {
+		metaStorage, ok := backend.(BackupMetaStorage)
+		if !ok {
+			return nil
+		}
+		return metaStorage.WriteBackupMeta(name, content)
+	})
+}
+
+// OpenRef and WriteRef only involve replicas supporting refs.
+func (r *ReplicatedStorage) OpenRef(name string) (io.ReadCloser, error) {
+	return r.read(func(backend Storage) (io.ReadCloser, error) {
+		refStorage, ok := backend.(RefStorage)
+		if !ok {
+			return nil, fmt.Errorf("refs not supported")
+		}
+		return refStorage.OpenRef(name)
+	})
+}
+
+func (r *ReplicatedStorage) WriteRef(name string, content []byte) error {
+	return r.write(fmt.Sprintf("ref %q", name), func(backend Storage) error {
+		refStorage, ok := backend.(RefStorage)
+		if !ok {
+			return nil
+		}
+		return refStorage.WriteRef(name, content)
+	})
+}
+
+// Locks are held on every replica supporting them, and listed from all
+// of them.
+func (r *ReplicatedStorage) ListLocks() ([]string, error) {
+	seen := make(map[string]bool)
+	for i, backend := range r.backends {
+		lockStorage, ok := backend.(LockStorage)
+		if !ok {
+			continue
+		}
+
+		names, err := lockStorage.ListLocks()
+		if err != nil {
+			return nil, fmt.Errorf("listing locks of replica %d: %w", i, err)
+		}
+		for _, name := range names {
+			seen[name] = true
+		}
+	}
+
+	out := make([]string, 0, len(seen))
+	for name := range seen {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (r *ReplicatedStorage) OpenLock(name string) (io.ReadCloser, error) {
+	return r.read(func(backend Storage) (io.ReadCloser, error) {
+		lockStorage, ok := backend.(LockStorage)
+		if !ok {
+			return nil, fmt.Errorf("locks not supported")
+		}
+		return lockStorage.OpenLock(name)
+	})
+}
+
+func (r *ReplicatedStorage) WriteLock(name string, content []byte) error {
+	return r.write(fmt.Sprintf("lock %q", name), func(backend Storage) error {
+		lockStorage, ok := backend.(LockStorage)
+		if !ok {
+			return nil
+		}
+		return lockStorage.WriteLock(name, content)
+	})
+}
+
+func (r *ReplicatedStorage) DeleteLock(name string) error {
+	return r.write(fmt.Sprintf("lock %q", name), func(backend Storage) error {
+		lockStorage, ok := backend.(LockStorage)
+		if !ok {
+			return nil
+		}
+		return lockStorage.DeleteLock(name)
+	})
+}
+
+// Conditional writes of locks and refs are arbitrated by the primary,
+// when it supports them: once won on the primary, the object is copied
+// to the other replicas.
+func (r *ReplicatedStorage) supportsConditionalLocks() bool {
+	_, ok := asConditionalLockStorage(r.backends[0])
+	return ok
+}
+
+func (r *ReplicatedStorage) supportsConditionalRefs() bool {
+	_, ok := asConditionalRefStorage(r.backends[0])
+	return ok
+}
+
+func (r *ReplicatedStorage) OpenLockVersion(name string) (io.ReadCloser, string, error) {
+	primary, ok := asConditionalLockStorage(r.backends[0])
+	if !ok {
+		return nil, "", errConditionalUnsupported
+	}
+	return primary.OpenLockVersion(name)
+}
+
+func (r *ReplicatedStorage) WriteLockIfVersion(name string, content []byte, version string) (bool, error) {
+	primary, ok := asConditionalLockStorage(r.backends[0])
+	if !ok {
+		return false, errConditionalUnsupported
+	}
+
+	written, err := primary.WriteLockIfVersion(name, content, version)
+	if err != nil || !written {
+		return written, err
+	}
+	r.copyToSecondaries(fmt.Sprintf("lock %q", name), func(backend Storage) error {
+		if lockStorage, ok := backend.(LockStorage); ok {
+			return lockStorage.WriteLock(name, content)
+		}
+		return nil
+	})
+	return true, nil
+}
+
+func (r *ReplicatedStorage) OpenRefVersion(name string) (io.ReadCloser, string, error) {
+	primary, ok := asConditionalRefStorage(r.backends[0])
+	if !ok {
+		return nil, "", errConditionalUnsupported
+	}
+	return primary.OpenRefVersion(name)
+}
+
+func (r *ReplicatedStorage) WriteRefIfVersion(name string, content []byte, version string) (bool, error) {
+	primary, ok := asConditionalRefStorage(r.backends[0])
+	if !ok {
+		return false, errConditionalUnsupported
+	}
+
+	written, err := primary.WriteRefIfVersion(name, content, version)
+	if err != nil || !written {
+		return written, err
+	}
+	r.copyToSecondaries(fmt.Sprintf("ref %q", name), func(backend Storage) error {
+		if refStorage, ok := backend.(RefStorage); ok {
+			return refStorage.WriteRef(name, content)
+		}
+		return nil
+	})
+	return true, nil
+}
+
+// copyToSecondaries writes to all replicas but the primary. Failures are
+// only logged, the primary holding the object.
+func (r *ReplicatedStorage) copyToSecondaries(what string, f func(backend Storage) error) {
+	var wg sync.WaitGroup
+	for i, backend := range r.backends[1:] {
+		wg.Add(1)
+		go func(i int, backend Storage) {
+			defer wg.Done()
+			if err := f(backend); err != nil {
+				zlog.Warn("replica failed writing", zap.Int("replica", i), zap.String("object", what), zap.Error(err))
+				r.markUnhealthy(i)
+			}
+		}(i+1, backend)
+	}
+	wg.Wait()
+}
+
+// WriteChunkIfAbsent creates the chunk on the replicas missing it, and
+// reports whether any of them was.
+func (r *ReplicatedStorage) WriteChunkIfAbsent(hash string, content []byte) (bool, error) {
+	var written int32
+	err := r.write(fmt.Sprintf("chunk %q", hash), func(backend Storage) error {
+		backendWritten, err := writeChunkIfAbsent(backend, hash, content)
+		if backendWritten {
+			atomic.StoreInt32(&written, 1)
+		}
+		return err
+	})
+	return atomic.LoadInt32(&written) == 1, err
+}
+
+func (r *ReplicatedStorage) OpenChunk(hash string) (io.ReadCloser, error) {
+	return r.read(func(backend Storage) (io.ReadCloser, error) {
+		return backend.OpenChunk(hash)
+	})
+}
+
+func (r *ReplicatedStorage) WriteChunk(hash string, content []byte) error {
+	return r.write(fmt.Sprintf("chunk %q", hash), func(backend Storage) error {
+		return backend.WriteChunk(hash, content)
+	})
+}
+
+// ChunkExists reports whether the chunk exists on every replica, so that
+// backups upload chunks missing from any of them.
+func (r *ReplicatedStorage) ChunkExists(hash string) (bool, error) {
+	for i, backend := range r.backends {
+		exists, err := backend.ChunkExists(hash)
+		if err != nil {
+			zlog.Warn("replica failed checking chunk existence", zap.Int("replica", i), zap.String("hash", hash), zap.Error(err))
+			r.markUnhealthy(i)
+			return false, nil
+		}
+		if !exists {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (r *ReplicatedStorage) write(what string, f func(backend Storage) error) error {
+	errs := make([]error, len(r.backends))
+
+	var wg sync.WaitGroup
+	for i, backend := range r.backends {
+		wg.Add(1)
+		go func(i int, backend Storage) {
+			defer wg.Done()
+			errs[i] = f(backend)
+		}(i, backend)
+	}
+	wg.Wait()
+
+	var failures []string
+	for i, err := range errs {
+		if err != nil {
+			zlog.Warn("replica failed writing", zap.Int("replica", i), zap.String("object", what), zap.Error(err))
+			r.markUnhealthy(i)
+			failures = append(failures, fmt.Sprintf("replica %d: %s", i, err))
+		}
+	}
+
+	if written := len(r.backends) - len(failures); written < r.quorum {
+		return fmt.Errorf("writing %s: only %d replicas written, quorum is %d: %s", what, written, r.quorum, strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+func (r *ReplicatedStorage) read(f func(backend Storage) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if r.ReadFastest {
+		return r.readFastest(f)
+	}
+
+	var errs []string
+	var notFound int
+	for _, i := range r.readOrder() {
+		out, err := f(r.backends[i])
+		if err == nil {
+			return out, nil
+		}
+
+		zlog.Debug("replica failed reading, trying next one", zap.Int("replica", i), zap.Error(err))
+		errs = append(errs, fmt.Sprintf("replica %d: %s", i, err))
+		// A missing object is no sign of an unhealthy replica, which may
+		// not have been written to yet
+		if isNotFound(err) {
+			notFound++
+		} else {
+			r.markUnhealthy(i)
+		}
+	}
+
+	return nil, readError(errs, notFound)
+}
+
+func (r *ReplicatedStorage) readFastest(f func(backend Storage) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	type result struct {
+		replica int
+		reader  io.ReadCloser
+		err     error
+	}
+
+	results := make(chan result, len(r.backends))
+	for i, backend := range r.backends {
+		go func(i int, backend Storage) {
+			reader, err := f(backend)
+			results <- result{i, reader, err}
+		}(i, backend)
+	}
+
+	var errs []string
+	var notFound int
+	for range r.backends {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, fmt.Sprintf("replica %d: %s", res.replica, res.err))
+			if isNotFound(res.err) {
+				notFound++
+			} else {
+				r.markUnhealthy(res.replica)
+			}
+			continue
+		}
+
+		// Close the slower ones as they come in, still keeping track of
+		// the failing replicas
+		go func(remaining int) {
+			for i := 0; i < remaining; i++ {
+				other := <-results
+				switch {
+				case other.err == nil:
+					other.reader.Close()
+				case !isNotFound(other.err):
+					zlog.Debug("slower replica failed reading", zap.Int("replica", other.replica), zap.Error(other.err))
+					r.markUnhealthy(other.replica)
+				}
+			}
+		}(len(r.backends) - len(errs) - 1)
+
+		return res.reader, nil
+	}
+
+	return nil, readError(errs, notFound)
+}
+
+// readError reports the failures of all replicas, as not found when none
+// of them has the object.
+func readError(errs []string, notFound int) error {
+	if notFound == len(errs) {
+		return fmt.Errorf("not found on any replica: %s: %w", strings.Join(errs, ", "), os.ErrNotExist)
+	}
+	return fmt.Errorf("no replica could be read: %s", strings.Join(errs, ", "))
+}
+
+// readOrder returns the healthy replicas first, in their configured
+// order, followed by the ones that failed recently.
+func (r *ReplicatedStorage) readOrder() []int {
+	r.healthLock.Lock()
+	defer r.healthLock.Unlock()
+
+	now := time.Now()
+	var healthy, unhealthy []int
+	for i := range r.backends {
+		if now.Before(r.unhealthyUntil[i]) {
+			unhealthy = append(unhealthy, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (r *ReplicatedStorage) markUnhealthy(replica int) {
+	r.healthLock.Lock()
+	defer r.healthLock.Unlock()
+
+	r.unhealthyUntil[replica] = time.Now().Add(unhealthyBackoff)
+}
+
+// RepairReport summarizes what Repair found missing on each replica.
+type RepairReport struct {
+	Backups        int
+	Chunks         int
+	MissingIndexes []int
+	MissingChunks  []int
+	CopiedIndexes  int
+	CopiedChunks   int
+	LostChunks     []string
+}
+
+// Repair finds backup indexes, and chunks referenced by them, that are
+// missing from any replica, and copies them over from a replica having
+// them. Chunks are verified against their hash before being copied, and
+// read from the next replica having them when corrupted. With
+// `dryRun`, only the report is produced.
+func (r *ReplicatedStorage) Repair(threads int, dryRun bool) (*RepairReport, error) {
+	report := &RepairReport{
+		MissingIndexes: make([]int, len(r.backends)),
+		MissingChunks:  make([]int, len(r.backends)),
+	}
+
+	holders := make(map[string][]int)
+	for i, backend := range r.backends {
+		list, err := backend.ListBackups(math.MaxInt32, "")
+		if err != nil {
+			return nil, fmt.Errorf("listing backups of replica %d: %w", i, err)
+		}
+		for _, name := range list {
+			holders[name] = append(holders[name], i)
+		}
+	}
+
+	var names []string
+	for name := range holders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	report.Backups = len(names)
+
+	chunks := make(map[string]bool)
+	for _, name := range names {
+		content, bi, err := r.readRepairIndex(name, holders[name])
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range bi.Files {
+			for _, chunk := range file.Chunks {
+				if !chunk.IsEmpty && chunk.ContentSHA != "" {
+					chunks[chunk.ContentSHA] = true
+				}
+			}
+		}
+
+		for i, backend := range r.backends {
+			if intsContain(holders[name], i) {
+				continue
+			}
+
+			report.MissingIndexes[i]++
+			zlog.Info("backup index missing from replica", zap.String("name", name), zap.Int("replica", i))
+			if dryRun {
+				continue
+			}
+			if err := backend.WriteBackupIndex(name, content); err != nil {
+				return nil, fmt.Errorf("copying backup index %q to replica %d: %w", name, i, err)
+			}
+			if err := writeBackupMeta(backend, name, bi); err != nil {
+				return nil, fmt.Errorf("copying backup index %q to replica %d: %w", name, i, err)
+			}
+			if err := updateLatestRef(backend, name); err != nil {
+				return nil, fmt.Errorf("copying backup index %q to replica %d: %w", name, i, err)
+			}
+			report.CopiedIndexes++
+		}
+	}
+	report.Chunks = len(chunks)
+
+	var lock sync.Mutex
+	eg := llerrgroup.New(threads)
+	for hash := range chunks {
+		if eg.Stop() {
+			break
+		}
+
+		hash := hash
+		eg.Go(func() error {
+			var have, missing []int
+			for i, backend := range r.backends {
+				exists, err := backend.ChunkExists(hash)
+				if err != nil {
+					return fmt.Errorf("checking chunk %q on replica %d: %w", hash, i, err)
+				}
+				if exists {
+					have = append(have, i)
+				} else {
+					missing = append(missing, i)
+				}
+			}
+
+			lock.Lock()
+			for _, i := range missing {
+				report.MissingChunks[i]++
+			}
+			if len(have) == 0 {
+				report.LostChunks = append(report.LostChunks, hash)
+			}
+			lock.Unlock()
+
+			if len(missing) == 0 || len(have) == 0 || dryRun {
+				return nil
+			}
+
+			content, from, err := r.readRepairChunk(hash, have)
+			if err != nil {
+				return err
+			}
+
+			for _, i := range missing {
+				zlog.Debug("copying chunk to replica", zap.String("hash", hash), zap.Int("from", from), zap.Int("to", i))
+				if err := r.backends[i].WriteChunk(hash, content); err != nil {
+					return fmt.Errorf("copying chunk %q to replica %d: %w", hash, i, err)
+				}
+
+				lock.Lock()
+				report.CopiedChunks++
+				lock.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(report.LostChunks)
+	return report, nil
+}
+
+// readRepairIndex reads and decodes a backup index from the first of the
+// replicas `have` holding a readable copy of it.
+func (r *ReplicatedStorage) readRepairIndex(name string, have []int) ([]byte, *BackupIndex, error) {
+	var errs []string
+	for _, i := range have {
+		content, err := readAllAndClose(r.backends[i].OpenBackupIndex(name))
+		if err == nil {
+			var bi *BackupIndex
+			if err = yaml.Unmarshal(content, &bi); err == nil {
+				return content, bi, nil
+			}
+		}
+
+		zlog.Warn("cannot read backup index from replica, trying next one", zap.String("name", name), zap.Int("replica", i), zap.Error(err))
+		errs = append(errs, fmt.Sprintf("replica %d: %s", i, err))
+	}
+	return nil, nil, fmt.Errorf("reading backup index %q: %s", name, strings.Join(errs, ", "))
+}
+
+// readRepairChunk reads a chunk from the first of the replicas `have`
+// holding a copy matching its hash, also returning that replica.
+func (r *ReplicatedStorage) readRepairChunk(hash string, have []int) ([]byte, int, error) {
+	var errs []string
+	for _, i := range have {
+		content, err := readVerifiedChunk(r.backends[i], hash)
+		if err == nil {
+			return content, i, nil
+		}
+
+		zlog.Warn("cannot read chunk from replica, trying next one", zap.String("hash", hash), zap.Int("replica", i), zap.Error(err))
+		errs = append(errs, fmt.Sprintf("replica %d: %s", i, err))
+	}
+	return nil, 0, fmt.Errorf("no valid copy of chunk %q: %s", hash, strings.Join(errs, ", "))
+}
+
+// readVerifiedChunk downloads a chunk and checks its content against its
+// sha3 hash.
+func readVerifiedChunk(storage Storage, hash string) ([]byte, error) {
+	content, err := readAllAndClose(storage.OpenChunk(hash))
+	if err != nil {
+		return nil, fmt.Errorf("reading chunk %q: %w", hash, err)
+	}
+
+	if shasum := fmt.Sprintf("%x", sha3.Sum256(content)); shasum != hash {
+		return nil, fmt.Errorf("%w for chunk, got %s, expected %s", errInvalidChunkHash, shasum, hash)
+	}
+	return content, nil
+}
+
+func readAllAndClose(reader io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func intsContain(a []int, x int) bool {
+	for _, n := range a {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
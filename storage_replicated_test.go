@@ -0,0 +1,253 @@
+package pitreos
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestReplicatedStorage_WriteQuorum(t *testing.T) {
+	a, b := newTestLocalStorage(t), newTestLocalStorage(t)
+	broken := &brokenStorage{}
+
+	replicated, err := NewReplicatedStorage(2, a, broken, b)
+	require.NoError(t, err)
+
+	require.NoError(t, replicated.WriteChunk("hash.1", []byte{1, 2, 3}))
+	for _, backend := range []Storage{a, b} {
+		exists, err := backend.ChunkExists("hash.1")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	}
+
+	// A chunk missing from any replica is reported missing
+	exists, err := replicated.ChunkExists("hash.1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	replicated, err = NewReplicatedStorage(0, a, broken, b)
+	require.NoError(t, err)
+	assert.Error(t, replicated.WriteChunk("hash.2", []byte{1, 2, 3}))
+}
+
+func TestReplicatedStorage_WriteChunkIfAbsent(t *testing.T) {
+	_, s3 := newTestS3Storage(t, "")
+	local := newTestLocalStorage(t)
+	require.NoError(t, local.WriteChunk("hash.1", []byte{1, 2, 3}))
+
+	replicated, err := NewReplicatedStorage(0, s3, local)
+	require.NoError(t, err)
+
+	// Written while missing from any replica
+	written, err := replicated.WriteChunkIfAbsent("hash.1", []byte{1, 2, 3})
+	require.NoError(t, err)
+	assert.True(t, written)
+	exists, err := s3.ChunkExists("hash.1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	written, err = replicated.WriteChunkIfAbsent("hash.1", []byte{1, 2, 3})
+	require.NoError(t, err)
+	assert.False(t, written)
+}
+
+func TestReplicatedStorage_ReadFallback(t *testing.T) {
+	a, b := newTestLocalStorage(t), newTestLocalStorage(t)
+	require.NoError(t, b.WriteChunk("hash.1", []byte{1, 2, 3}))
+
+	for _, fastest := range []bool{false, true} {
+		replicated, err := NewReplicatedStorage(1, &brokenStorage{}, a, b)
+		require.NoError(t, err)
+		replicated.ReadFastest = fastest
+
+		content, err := readAllAndClose(replicated.OpenChunk("hash.1"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{1, 2, 3}, content)
+
+		_, err = replicated.OpenChunk("hash.2")
+		assert.Error(t, err)
+	}
+}
+
+func TestReplicatedStorage_ReadNotFound(t *testing.T) {
+	for _, fastest := range []bool{false, true} {
+		a, b := newTestLocalStorage(t), newTestLocalStorage(t)
+		require.NoError(t, b.WriteChunk("hash.1", []byte{1, 2, 3}))
+
+		replicated, err := NewReplicatedStorage(1, a, &brokenStorage{}, b)
+		require.NoError(t, err)
+		replicated.ReadFastest = fastest
+
+		content, err := readAllAndClose(replicated.OpenChunk("hash.1"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{1, 2, 3}, content)
+
+		// Only failing replicas are marked unhealthy, not those missing
+		// the chunk
+		_, err = replicated.OpenChunk("hash.2")
+		assert.Error(t, err)
+		assert.Equal(t, []int{0, 2, 1}, replicated.readOrder())
+	}
+}
+
+func TestReplicatedStorage_ReadFastest_SlowerFailures(t *testing.T) {
+	a := newTestLocalStorage(t)
+	require.NoError(t, a.WriteChunk("hash.1", []byte{1, 2, 3}))
+
+	replicated, err := NewReplicatedStorage(1, &slowBrokenStorage{}, a)
+	require.NoError(t, err)
+	replicated.ReadFastest = true
+
+	content, err := readAllAndClose(replicated.OpenChunk("hash.1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, content)
+
+	// The slower replica failed after the read returned
+	assert.Eventually(t, func() bool { return replicated.readOrder()[0] == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestReplicatedStorage_ReadOrder(t *testing.T) {
+	replicated, err := NewReplicatedStorage(1, &brokenStorage{}, &brokenStorage{}, &brokenStorage{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []int{0, 1, 2}, replicated.readOrder())
+
+	replicated.markUnhealthy(0)
+	assert.Equal(t, []int{1, 2, 0}, replicated.readOrder())
+
+	replicated.unhealthyUntil[0] = time.Now().Add(-time.Second)
+	assert.Equal(t, []int{0, 1, 2}, replicated.readOrder())
+}
+
+func TestReplicatedStorage_ListBackups(t *testing.T) {
+	a, b := newTestLocalStorage(t), newTestLocalStorage(t)
+	require.NoError(t, a.WriteBackupIndex("b1", nil))
+	require.NoError(t, a.WriteBackupIndex("b3", nil))
+	require.NoError(t, b.WriteBackupIndex("b2", nil))
+	require.NoError(t, b.WriteBackupIndex("b3", nil))
+
+	replicated, err := NewReplicatedStorage(1, a, &brokenStorage{}, b)
+	require.NoError(t, err)
+
+	list, err := replicated.ListBackups(10, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1", "b2", "b3"}, list)
+
+	list, err = replicated.ListBackups(2, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1", "b2"}, list)
+}
+
+func TestReplicatedStorage_Repair(t *testing.T) {
+	a, b := newTestLocalStorage(t), newTestLocalStorage(t)
+
+	chunk1, chunk2 := []byte("chunk one"), []byte("chunk two")
+	hash1, hash2 := fmt.Sprintf("%x", sha3.Sum256(chunk1)), fmt.Sprintf("%x", sha3.Sum256(chunk2))
+
+	index, err := yaml.Marshal(&BackupIndex{
+		Version: "v3",
+		Files: []*FileIndex{{
+			FileName: "file",
+			Chunks: []*ChunkDef{
+				{Start: 0, End: 8, ContentSHA: hash1},
+				{Start: 9, End: 17, ContentSHA: hash2},
+				{Start: 18, End: 26, IsEmpty: true},
+			},
+		}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, a.WriteBackupIndex("b1", index))
+	require.NoError(t, a.WriteChunk(hash1, chunk1))
+	require.NoError(t, b.WriteChunk(hash2, chunk2))
+
+	replicated, err := NewReplicatedStorage(0, a, b)
+	require.NoError(t, err)
+
+	report, err := replicated.Repair(2, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Backups)
+	assert.Equal(t, 2, report.Chunks)
+	assert.Equal(t, []int{0, 1}, report.MissingIndexes)
+	assert.Equal(t, []int{1, 1}, report.MissingChunks)
+	assert.Equal(t, 0, report.CopiedChunks)
+
+	report, err = replicated.Repair(2, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.CopiedIndexes)
+	assert.Equal(t, 2, report.CopiedChunks)
+	assert.Empty(t, report.LostChunks)
+
+	list, err := b.ListBackups(10, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1"}, list)
+
+	content, err := readAllAndClose(a.OpenChunk(hash2))
+	require.NoError(t, err)
+	assert.Equal(t, chunk2, content)
+
+	report, err = replicated.Repair(2, false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.CopiedIndexes+report.CopiedChunks)
+
+	// A corrupted copy is skipped for the next replica having the chunk
+	c := newTestLocalStorage(t)
+	require.NoError(t, a.WriteChunk(hash1, []byte("corrupted")))
+
+	replicated, err = NewReplicatedStorage(0, a, b, c)
+	require.NoError(t, err)
+	report, err = replicated.Repair(2, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.CopiedChunks)
+
+	content, err = readAllAndClose(c.OpenChunk(hash1))
+	require.NoError(t, err)
+	assert.Equal(t, chunk1, content)
+}
+
+func newTestLocalStorage(t *testing.T) *DStoreStorage {
+	dir, err := ioutil.TempDir("", "pitreos-storage")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	storage, err := NewDStoreStorage(context.Background(), "file://"+dir)
+	require.NoError(t, err)
+	return storage
+}
+
+// brokenStorage fails every operation, like an unreachable replica.
+type brokenStorage struct{}
+
+var errBrokenStorage = fmt.Errorf("storage unreachable")
+
+func (s *brokenStorage) ListBackups(limit int, prefix string) ([]string, error) {
+	return nil, errBrokenStorage
+}
+func (s *brokenStorage) OpenBackupIndex(name string) (io.ReadCloser, error) {
+	return nil, errBrokenStorage
+}
+func (s *brokenStorage) WriteBackupIndex(name string, content []byte) error { return errBrokenStorage }
+func (s *brokenStorage) OpenChunk(hash string) (io.ReadCloser, error)       { return nil, errBrokenStorage }
+func (s *brokenStorage) WriteChunk(hash string, content []byte) error       { return errBrokenStorage }
+func (s *brokenStorage) ChunkExists(hash string) (bool, error)              { return false, errBrokenStorage }
+func (s *brokenStorage) SetTimeout(timeout time.Duration)                   {}
+
+// slowBrokenStorage fails reading chunks after a while, like a replica
+// timing out.
+type slowBrokenStorage struct {
+	brokenStorage
+}
+
+func (s *slowBrokenStorage) OpenChunk(hash string) (io.ReadCloser, error) {
+	time.Sleep(50 * time.Millisecond)
+	return nil, errBrokenStorage
+}
@@ -0,0 +1,535 @@
+package pitreos
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+// S3Storage talks directly to S3-compatible object stores (AWS S3, MinIO,
+// Ceph, ...), without going through `dstore`, to use features like
+// conditional writes, multipart uploads, ranged reads and storage classes.
+//
+// Layout is the same as DStoreStorage: `indexes/{name}.yaml.gz` and
+// `chunks/{sha3}`, gzip compressed unless `compression=none` is given.
+//
+// URL format:
+//
+//	s3://bucket/path?region=us-east-1[&endpoint=http://localhost:9000][&path_style=true]
+//	    [&compression=gzip|none][&chunk_class=STANDARD_IA][&index_class=STANDARD]
+//	    [&part_size_mib=16]
+//
+// Storage classes are only set when given, so objects get the bucket's
+// default class otherwise: MinIO and Ceph reject AWS-only classes.
+type S3Storage struct {
+	ctx     context.Context
+	timeout time.Duration
+
+	bucket      string
+	basePath    string
+	compression string
+
+	// ChunkStorageClass is the storage class for chunks, rarely read once
+	// written, like STANDARD_IA on AWS. Empty for the bucket's default.
+	ChunkStorageClass string
+	// IndexStorageClass is the storage class for backup indexes, read on
+	// every list and restore. Empty for the bucket's default.
+	IndexStorageClass string
+
+	service  *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func NewS3Storage(ctx context.Context, baseURL string) (*S3Storage, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("specify s3 bucket like: s3://bucket/path?region=us-east-1")
+	}
+
+	query := u.Query()
+	region := query.Get("region")
+	if region == "" {
+		return nil, fmt.Errorf("specify s3 bucket like: s3://bucket/path?region=us-east-1")
+	}
+
+	config := &aws.Config{Region: aws.String(region)}
+	if endpoint := query.Get("endpoint"); endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	if pathStyle, _ := strconv.ParseBool(query.Get("path_style")); pathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	compression := query.Get("compression")
+	switch compression {
+	case "":
+		compression = "gzip"
+	case "gzip", "none":
+	default:
+		return nil, fmt.Errorf("unsupported s3 compression %q, use 'gzip' or 'none'", compression)
+	}
+
+	partSize := s3manager.DefaultUploadPartSize * 3
+	if v := query.Get("part_size_mib"); v != "" {
+		mib, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid part_size_mib %q: %s", v, err)
+		}
+		partSize = mib * 1024 * 1024
+	}
+	if partSize < s3manager.MinUploadPartSize {
+		return nil, fmt.Errorf("part_size_mib must be at least %d", s3manager.MinUploadPartSize/1024/1024)
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching AWS session info from env: %s", err)
+	}
+
+	service := s3.New(sess)
+	uploader := s3manager.NewUploaderWithClient(service, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+	})
+
+	return &S3Storage{
+		ctx:               ctx,
+		timeout:           time.Minute * 30,
+		bucket:            u.Host,
+		basePath:          strings.Trim(u.Path, "/"),
+		compression:       compression,
+		ChunkStorageClass: query.Get("chunk_class"),
+		IndexStorageClass: query.Get("index_class"),
+		service:           service,
+		uploader:          uploader,
+	}, nil
+}
+
+func (s *S3Storage) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+func (s *S3Storage) indexPath(name string) string {
+	return path.Join(s.basePath, "indexes", fmt.Sprintf("%s.yaml.gz", name))
+}
+
+func (s *S3Storage) metaPath(name string) string {
+	return path.Join(s.basePath, "meta", fmt.Sprintf("%s.json", name))
+}
+
+func (s *S3Storage) refPath(name string) string {
+	return path.Join(s.basePath, "refs", name)
+}
+
+func (s *S3Storage) lockPath(name string) string {
+	return path.Join(s.basePath, "locks", fmt.Sprintf("%s.json", name))
+}
+
+func (s *S3Storage) chunkPath(hash string) string {
+	return path.Join(s.basePath, "chunks", hash)
+}
+
+func (s *S3Storage) ListBackups(limit int, prefix string) (out []string, err error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	indexesPrefix := path.Join(s.basePath, "indexes") + "/"
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(indexesPrefix + prefix),
+	}
+
+	err = s.service.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			if !strings.HasSuffix(key, ".yaml.gz") {
+				continue
+			}
+
+			out = append(out, strings.TrimSuffix(strings.TrimPrefix(key, indexesPrefix), ".yaml.gz"))
+			if len(out) >= limit {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing objects: %s", err)
+	}
+
+	return out, nil
+}
+
+func (s *S3Storage) OpenBackupIndex(name string) (io.ReadCloser, error) {
+	objectPath := s.indexPath(name)
+	zlog.Debug("Trying to open backup index", zap.String("name", name), zap.String("path", objectPath))
+
+	reader, err := s.getObject(objectPath, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return NewGZipReadCloser(reader)
+}
+
+func (s *S3Storage) WriteBackupIndex(name string, content []byte) error {
+	compressed, err := gzipBytes(content)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.putObject(s.indexPath(name), compressed, s.IndexStorageClass, false)
+	return err
+}
+
+func (s *S3Storage) OpenBackupMeta(name string) (io.ReadCloser, error) {
+	return s.getObject(s.metaPath(name), "")
+}
+
+func (s *S3Storage) WriteBackupMeta(name string, content []byte) error {
+	_, err := s.putObject(s.metaPath(name), content, s.IndexStorageClass, false)
+	return err
+}
+
+func (s *S3Storage) OpenRef(name string) (io.ReadCloser, error) {
+	return s.getObject(s.refPath(name), "")
+}
+
+func (s *S3Storage) WriteRef(name string, content []byte) error {
+	_, err := s.putObject(s.refPath(name), content, s.IndexStorageClass, false)
+	return err
+}
+
+// OpenRefVersion returns the ref along with its ETag.
+func (s *S3Storage) OpenRefVersion(name string) (io.ReadCloser, string, error) {
+	return s.getObjectVersion(s.refPath(name), "")
+}
+
+// WriteRefIfVersion writes the ref under the same preconditions as
+// WriteLockIfVersion.
+func (s *S3Storage) WriteRefIfVersion(name string, content []byte, version string) (bool, error) {
+	return s.putObjectIfVersion(s.refPath(name), content, s.IndexStorageClass, version)
+}
+
+func (s *S3Storage) ListLocks() (out []string, err error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	locksPrefix := path.Join(s.basePath, "locks") + "/"
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(locksPrefix),
+	}
+
+	err = s.service.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			if strings.HasSuffix(key, ".json") {
+				out = append(out, strings.TrimSuffix(strings.TrimPrefix(key, locksPrefix), ".json"))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing objects: %s", err)
+	}
+	return out, nil
+}
+
+func (s *S3Storage) OpenLock(name string) (io.ReadCloser, error) {
+	return s.getObject(s.lockPath(name), "")
+}
+
+func (s *S3Storage) WriteLock(name string, content []byte) error {
+	_, err := s.putObject(s.lockPath(name), content, "", false)
+	return err
+}
+
+// OpenLockVersion returns the lock along with its ETag.
+func (s *S3Storage) OpenLockVersion(name string) (io.ReadCloser, string, error) {
+	return s.getObjectVersion(s.lockPath(name), "")
+}
+
+// WriteLockIfVersion writes the lock with an `If-None-Match: *`
+// precondition when `version` is empty, and `If-Match: {version}`
+// otherwise.
+func (s *S3Storage) WriteLockIfVersion(name string, content []byte, version string) (bool, error) {
+	return s.putObjectIfVersion(s.lockPath(name), content, "", version)
+}
+
+func (s *S3Storage) DeleteLock(name string) error {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	_, err := s.service.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.lockPath(name)),
+	})
+	return err
+}
+
+func (s *S3Storage) OpenChunk(hash string) (io.ReadCloser, error) {
+	reader, err := s.getObject(s.chunkPath(hash), "")
+	if err != nil {
+		return nil, err
+	}
+
+	if s.compression == "gzip" {
+		return NewGZipReadCloser(reader)
+	}
+	return reader, nil
+}
+
+// OpenChunkRange fetches `length` bytes of the chunk starting at
+// `offset`. With uncompressed chunks, only that range is transferred.
+func (s *S3Storage) OpenChunkRange(hash string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range of chunk %q: offset %d, length %d", hash, offset, length)
+	}
+	if length == 0 {
+		// No valid `Range` header selects zero bytes
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	if s.compression == "gzip" {
+		reader, err := s.OpenChunk(hash)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+			reader.Close()
+			return nil, fmt.Errorf("seeking in compressed chunk: %s", err)
+		}
+		return &readCloser{Reader: io.LimitReader(reader, length), Closer: reader}, nil
+	}
+
+	return s.getObject(s.chunkPath(hash), fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+}
+
+func (s *S3Storage) WriteChunk(hash string, content []byte) error {
+	_, err := s.WriteChunkIfAbsent(hash, content)
+	return err
+}
+
+// WriteChunkIfAbsent skips chunks already stored, found with a HEAD
+// request, far cheaper than uploading them again. Missing chunks are
+// uploaded with an `If-None-Match: *` precondition, so a concurrent
+// writer's chunk is never replaced.
+func (s *S3Storage) WriteChunkIfAbsent(hash string, content []byte) (bool, error) {
+	exists, err := s.ChunkExists(hash)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	if s.compression == "gzip" {
+		compressed, err := gzipBytes(content)
+		if err != nil {
+			return false, err
+		}
+		content = compressed
+	}
+
+	return s.putObject(s.chunkPath(hash), content, s.ChunkStorageClass, true)
+}
+
+func (s *S3Storage) ChunkExists(hash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	_, err := s.service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.chunkPath(hash)),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *S3Storage) getObject(key, byteRange string) (io.ReadCloser, error) {
+	reader, _, err := s.getObjectVersion(key, byteRange)
+	return reader, err
+}
+
+// getObjectVersion also returns the ETag of the object, used as its
+// version by conditional writes.
+func (s *S3Storage) getObjectVersion(key, byteRange string) (io.ReadCloser, string, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+
+	out, err := s.service.GetObjectWithContext(ctx, input)
+	if err != nil {
+		cancel()
+		return nil, "", fmt.Errorf("get object %q: %w", key, err)
+	}
+
+	return &readCloser{Reader: out.Body, Closer: closerFunc(func() error {
+		defer cancel()
+		return out.Body.Close()
+	})}, aws.StringValue(out.ETag), nil
+}
+
+// putObject uploads content, in multiple parts when larger than the
+// uploader's part size. Content-MD5 is computed by the SDK for every
+// part, and verified by the server.  With `ifAbsent`, an existing object
+// is left untouched and `false` is returned.
+func (s *S3Storage) putObject(key string, content []byte, storageClass string, ifAbsent bool) (written bool, err error) {
+	if ifAbsent {
+		return s.upload(key, content, storageClass, ifNoneMatchOption)
+	}
+	return s.upload(key, content, storageClass, nil)
+}
+
+// putObjectIfVersion only writes the object when it doesn't exist yet,
+// for an empty `version`, or when its ETag is still `version`.
+func (s *S3Storage) putObjectIfVersion(key string, content []byte, storageClass, version string) (written bool, err error) {
+	if version == "" {
+		return s.upload(key, content, storageClass, ifNoneMatchOption)
+	}
+	return s.upload(key, content, storageClass, ifMatchOption(version))
+}
+
+// upload puts the object, with the optional `precondition` set on the
+// requests creating it. A failed precondition returns `false`.
+func (s *S3Storage) upload(key string, content []byte, storageClass string, precondition request.Option) (written bool, err error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(content),
+	}
+	if storageClass != "" {
+		input.StorageClass = aws.String(storageClass)
+	}
+
+	var options []func(*s3manager.Uploader)
+	if precondition != nil {
+		options = append(options, s3manager.WithUploaderRequestOptions(precondition))
+	}
+
+	_, err = s.uploader.UploadWithContext(ctx, input, options...)
+	if err != nil {
+		if precondition != nil && isS3PreconditionFailed(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("uploading %q: %w", key, err)
+	}
+
+	return true, nil
+}
+
+// ifNoneMatchOption makes object creation conditional. It only applies
+// to the requests that actually create the object, not the individual
+// parts of a multipart upload.
+func ifNoneMatchOption(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "CompleteMultipartUpload":
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+}
+
+// ifMatchOption makes replacing an object conditional on its ETag.
+func ifMatchOption(etag string) request.Option {
+	return func(r *request.Request) {
+		switch r.Operation.Name {
+		case "PutObject", "CompleteMultipartUpload":
+			r.HTTPRequest.Header.Set("If-Match", etag)
+		}
+	}
+}
+
+func isS3NotFound(err error) bool {
+	if aerr, ok := unwrapAWSError(err); ok {
+		switch aerr.Code() {
+		case "NotFound", s3.ErrCodeNoSuchKey:
+			return true
+		}
+	}
+	return false
+}
+
+func isS3PreconditionFailed(err error) bool {
+	if reqErr, ok := unwrapAWSError(err); ok {
+		if failure, ok := reqErr.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusPreconditionFailed {
+			return true
+		}
+		return reqErr.Code() == "PreconditionFailed"
+	}
+	return false
+}
+
+func unwrapAWSError(err error) (awserr.Error, bool) {
+	for err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			// s3manager wraps failures of multipart uploads
+			if orig := aerr.OrigErr(); orig != nil && aerr.Code() == "MultipartUpload" {
+				err = orig
+				continue
+			}
+			return aerr, true
+		}
+
+		unwrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil, false
+		}
+		err = unwrapper.Unwrap()
+	}
+	return nil, false
+}
+
+func gzipBytes(content []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
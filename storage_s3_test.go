@@ -0,0 +1,407 @@
+package pitreos
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3Storage_WriteBackupIndex_ListBackups(t *testing.T) {
+	fake, storage := newTestS3Storage(t, "")
+
+	for _, name := range []string{"b1", "b2", "b3"} {
+		require.NoError(t, storage.WriteBackupIndex(name, []byte(name)))
+	}
+
+	out, err := storage.ListBackups(2, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1", "b2"}, out)
+
+	out, err = storage.ListBackups(10, "b3")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b3"}, out)
+
+	rc, err := storage.OpenBackupIndex("b2")
+	require.NoError(t, err)
+	cnt, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, []byte("b2"), cnt)
+
+	assert.Equal(t, "", fake.object("backups/indexes/b2.yaml.gz").storageClass)
+}
+
+func TestS3Storage_WriteChunkIfAbsent(t *testing.T) {
+	fake, storage := newTestS3Storage(t, "")
+
+	exists, err := storage.ChunkExists("hash.1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	written, err := storage.WriteChunkIfAbsent("hash.1", []byte{1, 2, 3})
+	require.NoError(t, err)
+	assert.True(t, written)
+
+	written, err = storage.WriteChunkIfAbsent("hash.1", []byte{4, 5, 6})
+	require.NoError(t, err)
+	assert.False(t, written)
+
+	exists, err = storage.ChunkExists("hash.1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	rc, err := storage.OpenChunk("hash.1")
+	require.NoError(t, err)
+	cnt, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, cnt)
+
+	assert.Equal(t, "", fake.object("backups/chunks/hash.1").storageClass)
+	assert.Equal(t, 1, fake.puts)
+}
+
+func TestS3Storage_StorageClasses(t *testing.T) {
+	fake, storage := newTestS3Storage(t, "&chunk_class=STANDARD_IA&index_class=STANDARD")
+
+	require.NoError(t, storage.WriteChunk("hash.1", []byte{1, 2, 3}))
+	require.NoError(t, storage.WriteRef("tag/latest", []byte("b1")))
+
+	assert.Equal(t, "STANDARD_IA", fake.object("backups/chunks/hash.1").storageClass)
+	assert.Equal(t, "STANDARD", fake.object("backups/refs/tag/latest").storageClass)
+}
+
+func TestS3Storage_Multipart(t *testing.T) {
+	fake, storage := newTestS3Storage(t, "&compression=none&part_size_mib=5")
+
+	content := make([]byte, 11*1024*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	written, err := storage.WriteChunkIfAbsent("bighash", content)
+	require.NoError(t, err)
+	assert.True(t, written)
+	assert.Equal(t, 3, fake.object("backups/chunks/bighash").parts)
+
+	written, err = storage.WriteChunkIfAbsent("bighash", content)
+	require.NoError(t, err)
+	assert.False(t, written)
+
+	rc, err := storage.OpenChunkRange("bighash", 6*1024*1024, 10)
+	require.NoError(t, err)
+	cnt, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, content[6*1024*1024:6*1024*1024+10], cnt)
+	assert.Equal(t, int64(10), fake.lastGetBytes)
+
+	cnt, err = readAllAndClose(storage.OpenChunkRange("bighash", 6*1024*1024, 0))
+	require.NoError(t, err)
+	assert.Empty(t, cnt)
+
+	_, err = storage.OpenChunkRange("bighash", 0, -1)
+	assert.Error(t, err)
+}
+
+func TestS3Storage_OpenChunkRange_Compressed(t *testing.T) {
+	_, storage := newTestS3Storage(t, "")
+
+	require.NoError(t, storage.WriteChunk("hash.1", []byte("hello world")))
+
+	rc, err := storage.OpenChunkRange("hash.1", 6, 5)
+	require.NoError(t, err)
+	cnt, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("world"), cnt)
+}
+
+func TestS3Storage_OpenChunk_NotFound(t *testing.T) {
+	_, storage := newTestS3Storage(t, "")
+
+	_, err := storage.OpenChunk("missing")
+	require.Error(t, err)
+}
+
+func newTestS3Storage(t *testing.T, extraQuery string) (*fakeS3, *S3Storage) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+
+	fake := newFakeS3("pitreos")
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	storage, err := NewS3Storage(context.Background(), fmt.Sprintf("s3://pitreos/backups?region=us-east-1&path_style=true&endpoint=%s%s", server.URL, extraQuery))
+	require.NoError(t, err)
+
+	return fake, storage
+}
+
+// fakeS3 is a minimal, in-memory, MinIO-style stand-in implementing the
+// subset of the S3 API used by S3Storage.
+type fakeS3 struct {
+	bucket string
+
+	lock         sync.Mutex
+	objects      map[string]*fakeS3Object
+	uploads      map[string]*fakeS3Upload
+	nextUploadID int
+	lastGetBytes int64
+	puts         int
+}
+
+type fakeS3Object struct {
+	content      []byte
+	storageClass string
+	parts        int
+	etag         string
+}
+
+type fakeS3Upload struct {
+	key          string
+	storageClass string
+	parts        map[int][]byte
+}
+
+func newFakeS3Object(content []byte, storageClass string, parts int) *fakeS3Object {
+	etag := fmt.Sprintf(`"%x"`, md5.Sum(content))
+	return &fakeS3Object{content: content, storageClass: storageClass, parts: parts, etag: etag}
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: map[string]*fakeS3Object{},
+		uploads: map[string]*fakeS3Upload{},
+	}
+}
+
+func (f *fakeS3) object(key string) *fakeS3Object {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.objects[key]
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	query := r.URL.Query()
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method == http.MethodGet && query.Get("list-type") == "2" {
+			f.list(w, query.Get("prefix"))
+			return
+		}
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+
+	key := parts[1]
+	switch {
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		f.nextUploadID++
+		uploadID := strconv.Itoa(f.nextUploadID)
+		f.uploads[uploadID] = &fakeS3Upload{key: key, storageClass: r.Header.Get("X-Amz-Storage-Class"), parts: map[int][]byte{}}
+		f.xml(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: f.bucket, Key: key, UploadId: uploadID})
+
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		upload := f.uploads[query.Get("uploadId")]
+		body, ok := f.readBody(w, r)
+		if upload == nil || !ok {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.parts[partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		upload := f.uploads[query.Get("uploadId")]
+		if upload == nil {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if !f.preconditionMet(r, key) {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		var numbers []int
+		for n := range upload.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+
+		var content []byte
+		for _, n := range numbers {
+			content = append(content, upload.parts[n]...)
+		}
+		f.objects[key] = newFakeS3Object(content, upload.storageClass, len(numbers))
+		delete(f.uploads, query.Get("uploadId"))
+
+		f.xml(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: f.bucket, Key: key, ETag: f.objects[key].etag})
+
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		if !f.preconditionMet(r, key) {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		body, ok := f.readBody(w, r)
+		if !ok {
+			return
+		}
+		f.puts++
+		f.objects[key] = newFakeS3Object(body, r.Header.Get("X-Amz-Storage-Class"), 1)
+		w.Header().Set("ETag", f.objects[key].etag)
+
+	case r.Method == http.MethodHead:
+		obj := f.objects[key]
+		if obj == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.content)))
+		w.Header().Set("ETag", obj.etag)
+
+	case r.Method == http.MethodGet:
+		obj := f.objects[key]
+		if obj == nil {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		content := obj.content
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || start > end || end >= len(content) {
+				f.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			content = content[start : end+1]
+			status = http.StatusPartialContent
+		}
+		f.lastGetBytes = int64(len(content))
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("ETag", obj.etag)
+		w.WriteHeader(status)
+		w.Write(content)
+
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// preconditionMet checks the `If-None-Match: *` and `If-Match`
+// preconditions of requests creating objects.
+func (f *fakeS3) preconditionMet(r *http.Request, key string) bool {
+	obj := f.objects[key]
+	if r.Header.Get("If-None-Match") == "*" && obj != nil {
+		return false
+	}
+	if etag := r.Header.Get("If-Match"); etag != "" && (obj == nil || obj.etag != etag) {
+		return false
+	}
+	return true
+}
+
+func (f *fakeS3) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "IncompleteBody")
+		return nil, false
+	}
+
+	if expected := r.Header.Get("Content-Md5"); expected != "" {
+		sum := md5.Sum(body)
+		if base64.StdEncoding.EncodeToString(sum[:]) != expected {
+			f.error(w, http.StatusBadRequest, "BadDigest")
+			return nil, false
+		}
+	}
+
+	return body, true
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key  string
+		Size int
+	}
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var contents []content
+	for _, key := range keys {
+		contents = append(contents, content{Key: key, Size: len(f.objects[key].content)})
+	}
+
+	f.xml(w, struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: f.bucket, Prefix: prefix, KeyCount: len(contents), Contents: contents})
+}
+
+func (f *fakeS3) xml(w http.ResponseWriter, v interface{}) {
+	buf := &bytes.Buffer{}
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(buf).Encode(v); err != nil {
+		f.error(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(buf.Bytes())
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
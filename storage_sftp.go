@@ -0,0 +1,561 @@
+package pitreos
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/context"
+)
+
+// SFTPStorage stores backups on a remote host over SFTP, using the same
+// layout as a `file://` DStoreStorage, so the backups can also be read
+// locally on that host.
+//
+// URL format:
+//
+//	sftp://user@host[:port]/absolute/path[?key=~/.ssh/id_rsa][&known_hosts=~/.ssh/known_hosts]
+//	    [&insecure_ignore_host_key=true]
+//
+// Only key-based authentication is supported. When `key` is not given,
+// `~/.ssh/id_ed25519`, `~/.ssh/id_ecdsa` and `~/.ssh/id_rsa` are tried.
+//
+// A single SSH connection is shared by all concurrent operations, and
+// re-established when lost. Operations taking longer than the timeout of
+// SetTimeout fail, and the next ones use a new connection: the previous
+// one is closed once the operations still using it are done. Files are
+// read whole when opened, within that timeout.
+type SFTPStorage struct {
+	ctx     context.Context
+	timeout time.Duration
+
+	addr     string
+	basePath string
+	config   *ssh.ClientConfig
+
+	lock sync.Mutex
+	conn *sftpConn
+}
+
+// sftpConn is an SSH connection, used by `users` operations. Connections
+// are only closed once unused, as pkg/sftp doesn't support closing a
+// client while requests are in flight.
+type sftpConn struct {
+	sshClient *ssh.Client
+	client    *sftp.Client
+	users     int
+	broken    bool
+}
+
+// close closes the SSH connection, which ends the sftp session too:
+// closing the client itself races with its own cleanup when the
+// connection was lost.
+func (c *sftpConn) close() error {
+	return c.sshClient.Close()
+}
+
+func NewSFTPStorage(ctx context.Context, baseURL string) (*SFTPStorage, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "sftp" || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("specify sftp storage like: sftp://user@host/path")
+	}
+
+	query := u.Query()
+
+	signer, err := loadSSHSigner(query.Get("key"))
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if insecure, _ := strconv.ParseBool(query.Get("insecure_ignore_host_key")); !insecure {
+		knownHostsFile := query.Get("known_hosts")
+		if knownHostsFile == "" {
+			knownHostsFile = "~/.ssh/known_hosts"
+		}
+		knownHostsFile, err = homedir.Expand(knownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		hostKeyCallback, err = knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading known hosts: %s", err)
+		}
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	basePath := u.Path
+	if basePath == "" {
+		basePath = "/"
+	}
+
+	return &SFTPStorage{
+		ctx:      ctx,
+		timeout:  time.Minute * 30,
+		addr:     addr,
+		basePath: basePath,
+		config: &ssh.ClientConfig{
+			User:            u.User.Username(),
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+func loadSSHSigner(keyFile string) (ssh.Signer, error) {
+	candidates := []string{keyFile}
+	if keyFile == "" {
+		candidates = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+	}
+
+	for _, candidate := range candidates {
+		filename, err := homedir.Expand(candidate)
+		if err != nil {
+			return nil, err
+		}
+
+		cnt, err := ioutil.ReadFile(filename)
+		if err != nil {
+			if os.IsNotExist(err) && keyFile == "" {
+				continue
+			}
+			return nil, fmt.Errorf("reading ssh key: %s", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(cnt)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ssh key %q: %s", filename, err)
+		}
+		return signer, nil
+	}
+
+	return nil, fmt.Errorf("no ssh key found, specify one with the 'key' URL parameter")
+}
+
+func (s *SFTPStorage) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+func (s *SFTPStorage) indexPath(name string) string {
+	if name == "" {
+		return path.Join(s.basePath, "indexes")
+	}
+	return path.Join(s.basePath, "indexes", fmt.Sprintf("%s.yaml.gz", name))
+}
+
+func (s *SFTPStorage) metaPath(name string) string {
+	return path.Join(s.basePath, "meta", fmt.Sprintf("%s.json", name))
+}
+
+func (s *SFTPStorage) refPath(name string) string {
+	return path.Join(s.basePath, "refs", name)
+}
+
+func (s *SFTPStorage) lockPath(name string) string {
+	return path.Join(s.basePath, "locks", fmt.Sprintf("%s.json", name))
+}
+
+func (s *SFTPStorage) chunkPath(hash string) string {
+	return path.Join(s.basePath, "chunks", hash)
+}
+
+func (s *SFTPStorage) ListBackups(limit int, prefix string) ([]string, error) {
+	var out []string
+	err := s.withClient(func(client *sftp.Client) error {
+		files, err := client.ReadDir(s.indexPath(""))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		var names []string
+		for _, f := range files {
+			name := f.Name()
+			if f.IsDir() || !strings.HasSuffix(name, ".yaml.gz") || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			names = append(names, strings.TrimSuffix(name, ".yaml.gz"))
+		}
+		sort.Strings(names)
+
+		if len(names) > limit {
+			names = names[:limit]
+		}
+		out = names
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *SFTPStorage) OpenBackupIndex(name string) (io.ReadCloser, error) {
+	objectPath := s.indexPath(name)
+	zlog.Debug("Trying to open backup index", zap.String("name", name), zap.String("path", objectPath))
+
+	reader, err := s.openFile(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewGZipReadCloser(reader)
+}
+
+func (s *SFTPStorage) WriteBackupIndex(name string, content []byte) error {
+	return s.writeFile(s.indexPath(name), content)
+}
+
+func (s *SFTPStorage) OpenBackupMeta(name string) (io.ReadCloser, error) {
+	reader, err := s.openFile(s.metaPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return NewGZipReadCloser(reader)
+}
+
+func (s *SFTPStorage) WriteBackupMeta(name string, content []byte) error {
+	return s.writeFile(s.metaPath(name), content)
+}
+
+func (s *SFTPStorage) OpenRef(name string) (io.ReadCloser, error) {
+	reader, err := s.openFile(s.refPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return NewGZipReadCloser(reader)
+}
+
+// WriteRef replaces the ref atomically, through a temporary file.
+func (s *SFTPStorage) WriteRef(name string, content []byte) error {
+	return s.writeFile(s.refPath(name), content)
+}
+
+func (s *SFTPStorage) ListLocks() ([]string, error) {
+	var out []string
+	err := s.withClient(func(client *sftp.Client) error {
+		files, err := client.ReadDir(path.Join(s.basePath, "locks"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, f := range files {
+			if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+				out = append(out, strings.TrimSuffix(f.Name(), ".json"))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *SFTPStorage) OpenLock(name string) (io.ReadCloser, error) {
+	reader, err := s.openFile(s.lockPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return NewGZipReadCloser(reader)
+}
+
+func (s *SFTPStorage) WriteLock(name string, content []byte) error {
+	return s.writeFile(s.lockPath(name), content)
+}
+
+func (s *SFTPStorage) DeleteLock(name string) error {
+	return s.withClient(func(client *sftp.Client) error {
+		return client.Remove(s.lockPath(name))
+	})
+}
+
+func (s *SFTPStorage) OpenChunk(hash string) (io.ReadCloser, error) {
+	reader, err := s.openFile(s.chunkPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	return NewGZipReadCloser(reader)
+}
+
+func (s *SFTPStorage) WriteChunk(hash string, content []byte) error {
+	return s.writeFile(s.chunkPath(hash), content)
+}
+
+func (s *SFTPStorage) ChunkExists(hash string) (bool, error) {
+	var exists bool
+	err := s.withClient(func(client *sftp.Client) error {
+		_, err := client.Stat(s.chunkPath(hash))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		exists = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func (s *SFTPStorage) openFile(filePath string) (io.ReadCloser, error) {
+	var content []byte
+	err := s.withClient(func(client *sftp.Client) error {
+		f, err := client.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		content, err = ioutil.ReadAll(f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// writeFile gzips `content` to a temporary file next to `filePath`,
+// then renames it in place, so readers never see a partial file.
+func (s *SFTPStorage) writeFile(filePath string, content []byte) error {
+	compressed, err := gzipBytes(content)
+	if err != nil {
+		return err
+	}
+
+	return s.withClient(func(client *sftp.Client) error {
+		dir := path.Dir(filePath)
+		if err := client.MkdirAll(dir); err != nil {
+			return fmt.Errorf("creating directory %q: %w", dir, err)
+		}
+
+		tmpPath := path.Join(dir, fmt.Sprintf(".%s.tmp-%s", path.Base(filePath), randomSuffix()))
+		f, err := client.Create(tmpPath)
+		if err != nil {
+			return fmt.Errorf("creating %q: %w", tmpPath, err)
+		}
+
+		_, err = io.Copy(f, bytes.NewReader(compressed))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			client.Remove(tmpPath)
+			return fmt.Errorf("writing %q: %w", tmpPath, err)
+		}
+
+		if err := client.PosixRename(tmpPath, filePath); err != nil {
+			// Servers without the `posix-rename@openssh.com` extension
+			// refuse to rename over an existing file: it is moved aside,
+			// and only removed once replaced.
+			if err := s.replaceFile(client, tmpPath, filePath); err != nil {
+				client.Remove(tmpPath)
+				return fmt.Errorf("renaming %q: %w", tmpPath, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// replaceFile renames `tmpPath` to `filePath` with plain renames. The
+// existing file is kept until the new one is in place, and put back when
+// the rename fails.
+func (s *SFTPStorage) replaceFile(client *sftp.Client, tmpPath, filePath string) error {
+	oldPath := fmt.Sprintf("%s.old-%s", tmpPath, randomSuffix())
+	if err := client.Rename(filePath, oldPath); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		oldPath = ""
+	}
+
+	if err := client.Rename(tmpPath, filePath); err != nil {
+		if oldPath != "" {
+			client.Rename(oldPath, filePath)
+		}
+		return err
+	}
+
+	if oldPath != "" {
+		client.Remove(oldPath)
+	}
+	return nil
+}
+
+// withClient runs `f` with the shared SFTP client, connecting first if
+// needed. When the connection was lost, it reconnects and tries once more.
+//
+// Operations taking longer than the timeout are left running: their
+// requests can't be interrupted without closing the connection under
+// the requests of others. The connection is no longer given to new
+// operations, in case it hangs. So `f` must only write to variables read
+// once withClient succeeded.
+func (s *SFTPStorage) withClient(f func(client *sftp.Client) error) error {
+	for attempt := 0; ; attempt++ {
+		conn, err := s.acquire()
+		if err != nil {
+			return err
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			err := f(conn.client)
+			s.release(conn)
+			done <- err
+		}()
+
+		ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+		select {
+		case err = <-done:
+			cancel()
+		case <-ctx.Done():
+			expired := ctx.Err()
+			cancel()
+			zlog.Warn("sftp operation interrupted, next ones use a new connection", zap.String("addr", s.addr), zap.Error(expired))
+			s.markBroken(conn)
+			return fmt.Errorf("sftp on %q: %w", s.addr, expired)
+		}
+		if err == nil || attempt > 0 || !isSFTPConnectionLost(err) {
+			return err
+		}
+
+		zlog.Info("sftp connection lost, reconnecting", zap.String("addr", s.addr), zap.Error(err))
+		s.markBroken(conn)
+	}
+}
+
+// acquire returns the shared connection, connecting first if needed. It
+// must be released once used.
+func (s *SFTPStorage) acquire() (*sftpConn, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		sshClient, err := ssh.Dial("tcp", s.addr, s.config)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to %q: %s", s.addr, err)
+		}
+
+		client, err := sftp.NewClient(sshClient)
+		if err != nil {
+			sshClient.Close()
+			return nil, fmt.Errorf("starting sftp session: %s", err)
+		}
+		s.conn = &sftpConn{sshClient: sshClient, client: client}
+	}
+
+	s.conn.users++
+	return s.conn, nil
+}
+
+func (s *SFTPStorage) release(conn *sftpConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	conn.users--
+	if conn.broken && conn.users == 0 {
+		conn.close()
+	}
+}
+
+// markBroken replaces `conn` with a new connection for the next
+// operations, unless someone else already did, and closes it once
+// unused.
+func (s *SFTPStorage) markBroken(conn *sftpConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == conn {
+		s.conn = nil
+	}
+	if conn.broken {
+		return
+	}
+	conn.broken = true
+	if conn.users == 0 {
+		conn.close()
+	}
+}
+
+// Close closes the shared SSH connection, once the operations using it
+// are done.
+func (s *SFTPStorage) Close() error {
+	s.lock.Lock()
+	conn := s.conn
+	s.lock.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	s.markBroken(conn)
+	return nil
+}
+
+// isSFTPConnectionLost reports whether `err` comes from the transport
+// rather than from the remote server answering the request: the session
+// ended (EOF), or the network connection failed. Requests that couldn't
+// be sent are only reported by message, as pkg/sftp doesn't wrap their
+// cause.
+func isSFTPConnectionLost(err error) bool {
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		return status.Code == uint32(sftp.ErrSSHFxConnectionLost) || status.Code == uint32(sftp.ErrSSHFxNoConnection)
+	}
+	if strings.HasPrefix(err.Error(), "failed to send packet") {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, sftp.ErrSSHFxNoConnection) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
+
+func randomSuffix() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return fmt.Sprintf("%x", b)
+}
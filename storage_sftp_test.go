@@ -0,0 +1,299 @@
+package pitreos
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestSFTPStorage_WriteBackupIndex_ListBackups(t *testing.T) {
+	storage, root := newTestSFTPStorage(t)
+
+	for _, name := range []string{"b2", "b1", "b3"} {
+		require.NoError(t, storage.WriteBackupIndex(name, []byte(name)))
+	}
+
+	out, err := storage.ListBackups(2, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1", "b2"}, out)
+
+	rc, err := storage.OpenBackupIndex("b3")
+	require.NoError(t, err)
+	cnt, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, []byte("b3"), cnt)
+
+	// Same layout as a local `file://` store
+	local, err := NewDStoreStorage(context.Background(), "file://"+root)
+	require.NoError(t, err)
+	out, err = local.ListBackups(10, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1", "b2", "b3"}, out)
+}
+
+func TestSFTPStorage_WriteChunk_ChunkExists_OpenChunk(t *testing.T) {
+	storage, root := newTestSFTPStorage(t)
+
+	exists, err := storage.ChunkExists("hash.1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, storage.WriteChunk("hash.1", []byte{1, 2, 3}))
+	require.NoError(t, storage.WriteChunk("hash.1", []byte{1, 2, 3}))
+
+	exists, err = storage.ChunkExists("hash.1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	rc, err := storage.OpenChunk("hash.1")
+	require.NoError(t, err)
+	cnt, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, []byte{1, 2, 3}, cnt)
+
+	// No temporary files left behind
+	files, err := ioutil.ReadDir(filepath.Join(root, "chunks"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "hash.1", files[0].Name())
+}
+
+func TestSFTPStorage_Reconnect(t *testing.T) {
+	storage, _ := newTestSFTPStorage(t)
+
+	require.NoError(t, storage.WriteChunk("hash.1", []byte{1, 2, 3}))
+
+	// Drop the connection underneath the storage
+	storage.conn.sshClient.Close()
+
+	exists, err := storage.ChunkExists("hash.1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestSFTPStorage_Timeout(t *testing.T) {
+	storage, _ := newTestSFTPStorage(t)
+
+	storage.SetTimeout(time.Nanosecond)
+	err := storage.WriteChunk("hash.1", []byte{1, 2, 3})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+
+	storage.SetTimeout(time.Minute)
+	require.NoError(t, storage.WriteChunk("hash.1", []byte{1, 2, 3}))
+}
+
+func TestSFTPStorage_BrokenConnectionKeptWhileUsed(t *testing.T) {
+	storage, _ := newTestSFTPStorage(t)
+	require.NoError(t, storage.WriteChunk("hash.1", []byte{1, 2, 3}))
+
+	// Like an operation still running when another one timed out
+	conn, err := storage.acquire()
+	require.NoError(t, err)
+	storage.markBroken(conn)
+
+	_, err = conn.client.Stat(storage.chunkPath("hash.1"))
+	require.NoError(t, err)
+
+	// New operations use a new connection
+	exists, err := storage.ChunkExists("hash.1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.NotEqual(t, conn, storage.conn)
+
+	storage.release(conn)
+	_, err = conn.client.Stat(storage.chunkPath("hash.1"))
+	assert.Error(t, err)
+}
+
+func TestSFTPStorage_ReplaceFile(t *testing.T) {
+	storage, _ := newTestSFTPStorage(t)
+	conn, err := storage.acquire()
+	require.NoError(t, err)
+	defer storage.release(conn)
+	client := conn.client
+
+	root := storage.basePath
+	require.NoError(t, os.MkdirAll(root, 0755))
+	target := filepath.Join(root, "ref")
+	require.NoError(t, ioutil.WriteFile(target, []byte("old"), 0644))
+	require.NoError(t, ioutil.WriteFile(target+".tmp", []byte("new"), 0644))
+	require.NoError(t, storage.replaceFile(client, target+".tmp", target))
+
+	cnt, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), cnt)
+
+	// The existing file is kept when the new one can't be renamed
+	assert.Error(t, storage.replaceFile(client, target+".missing", target))
+	cnt, err = ioutil.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), cnt)
+
+	files, err := ioutil.ReadDir(root)
+	require.NoError(t, err)
+	for _, f := range files {
+		assert.NotContains(t, f.Name(), ".old-")
+	}
+}
+
+func TestIsSFTPConnectionLost(t *testing.T) {
+	assert.True(t, isSFTPConnectionLost(io.EOF))
+	assert.True(t, isSFTPConnectionLost(fmt.Errorf("stat: %w", io.ErrUnexpectedEOF)))
+	assert.True(t, isSFTPConnectionLost(&net.OpError{Op: "read", Err: syscall.ECONNRESET}))
+	assert.True(t, isSFTPConnectionLost(fmt.Errorf("failed to send packet: EOF")))
+
+	assert.False(t, isSFTPConnectionLost(os.ErrNotExist))
+	assert.False(t, isSFTPConnectionLost(&os.PathError{Op: "open", Path: "a", Err: os.ErrPermission}))
+	assert.False(t, isSFTPConnectionLost(fmt.Errorf("sftp: \"Failure\" (SSH_FX_FAILURE)")))
+}
+
+func TestSFTPStorage_ConcurrentWrites(t *testing.T) {
+	storage, _ := newTestSFTPStorage(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- storage.WriteChunk(fmt.Sprintf("hash.%d", i), []byte{byte(i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func newTestSFTPStorage(t *testing.T) (*SFTPStorage, string) {
+	dir, err := ioutil.TempDir("", "pitreos-sftp")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	hostSigner := newTestSSHSigner(t, "")
+	clientKeyFile := filepath.Join(dir, "id_ecdsa")
+	clientSigner := newTestSSHSigner(t, clientKeyFile)
+
+	addr := startTestSFTPServer(t, hostSigner, clientSigner.PublicKey())
+
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{addr}, hostSigner.PublicKey())
+	require.NoError(t, ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+	root := filepath.Join(dir, "backups")
+	storage, err := NewSFTPStorage(context.Background(), fmt.Sprintf("sftp://pitreos@%s%s?key=%s&known_hosts=%s", addr, root, clientKeyFile, knownHostsFile))
+	require.NoError(t, err)
+	t.Cleanup(func() { storage.Close() })
+
+	return storage, root
+}
+
+func newTestSSHSigner(t *testing.T, writeTo string) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	cnt := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	if writeTo != "" {
+		require.NoError(t, ioutil.WriteFile(writeTo, cnt, 0600))
+	}
+
+	signer, err := ssh.ParsePrivateKey(cnt)
+	require.NoError(t, err)
+	return signer
+}
+
+// startTestSFTPServer runs an in-process SSH server serving the local
+// filesystem over the `sftp` subsystem, accepting only `authorizedKey`.
+func startTestSFTPServer(t *testing.T, hostSigner ssh.Signer, authorizedKey ssh.PublicKey) string {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unauthorized key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(conn, config)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				// Payload is a length-prefixed string
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}(requests)
+
+		go func() {
+			defer channel.Close()
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			if err := server.Serve(); err != nil && err != io.EOF {
+				return
+			}
+		}()
+	}
+}
@@ -2,6 +2,7 @@ package pitreos
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -79,3 +80,19 @@ func TestNewDStoreStorage_WriteChunk_ChunkExists_OpenChunk(t *testing.T) {
 	require.Equal(t, 3, l)
 	require.Equal(t, []byte{1, 2, 3, 0, 0, 0, 0, 0}, b)
 }
+
+func TestDStoreStorage_OpenMissingObjects(t *testing.T) {
+	storage := newTestLocalStorage(t)
+
+	_, err := storage.OpenRef("prod@latest")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = storage.OpenLock("prod")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = storage.OpenBackupMeta("2025-01-01-00-00-00--prod")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+
+	require.NoError(t, storage.WriteRef("prod@latest", []byte("backup\n")))
+	content, err := readAllAndClose(storage.OpenRef("prod@latest"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("backup\n"), content)
+}
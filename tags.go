@@ -0,0 +1,112 @@
+package pitreos
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TagSummary describes the backups of a tag.
+type TagSummary struct {
+	Tag        string    `json:"tag"`
+	Backups    int       `json:"backups"`
+	Latest     string    `json:"latest"`
+	LatestDate time.Time `json:"latest_date"`
+}
+
+// backupHasTag reports whether `name` is the name of a backup with
+// exactly `tag`.
+func backupHasTag(name, tag string) bool {
+	_, backupTag, err := ParseBackupName(name)
+	return err == nil && backupTag == tag
+}
+
+func filterBackupsByTag(names []string, tag string) (out []string) {
+	for _, name := range names {
+		if backupHasTag(name, tag) {
+			out = append(out, name)
+		}
+	}
+	return
+}
+
+// ListTags returns the tags of all backups, sorted by name, read from
+// backup names only.
+func (p *PITR) ListTags() ([]*TagSummary, error) {
+	list, err := p.storage.ListBackups(math.MaxInt32, "")
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]*TagSummary)
+	for _, name := range list {
+		date, tag, err := ParseBackupName(name)
+		if err != nil {
+			zlog.Debug("skipping backup", zap.String("name", name), zap.Error(err))
+			continue
+		}
+
+		summary := tags[tag]
+		if summary == nil {
+			summary = &TagSummary{Tag: tag}
+			tags[tag] = summary
+		}
+		summary.Backups++
+		if !date.Before(summary.LatestDate) {
+			summary.Latest = name
+			summary.LatestDate = date
+		}
+	}
+
+	out := make([]*TagSummary, 0, len(tags))
+	for _, summary := range tags {
+		out = append(out, summary)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Tag < out[j].Tag })
+	return out, nil
+}
+
+// AliasBackup makes a backup also available under `tag`, by writing a
+// copy of its index named with the same date and `tag`. Chunks are
+// shared, not copied. It returns the name of the new backup.
+func (p *PITR) AliasBackup(backupName, tag string) (string, error) {
+	if err := validateTag(tag); err != nil {
+		return "", err
+	}
+
+	date, _, err := ParseBackupName(backupName)
+	if err != nil {
+		return "", err
+	}
+
+	aliasName := makeBackupName(date, tag)
+	existing, err := p.storage.ListBackups(1, aliasName)
+	if err != nil {
+		return "", err
+	}
+	if len(existing) != 0 && existing[0] == aliasName {
+		return "", fmt.Errorf("backup %q already exists", aliasName)
+	}
+
+	bm, err := p.downloadBackupIndex(backupName)
+	if err != nil {
+		return "", err
+	}
+	bm.Tag = tag
+
+	if err := p.uploadBackupIndexYamlFile(aliasName, bm); err != nil {
+		return "", fmt.Errorf("upload backup index: %s", err)
+	}
+	return aliasName, nil
+}
+
+func validateTag(tag string) error {
+	if tag == "" || strings.ContainsAny(tag, "/\\@ \t\n") {
+		return fmt.Errorf("invalid tag %q", tag)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package pitreos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTaggedBackups(t *testing.T, tags map[int]string) (*PITR, *DStoreStorage) {
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+
+	for d, tag := range tags {
+		date := time.Date(2025, 1, d, 0, 0, 0, 0, time.UTC)
+		bi := &BackupIndex{Date: date, Tag: tag, Meta: map[string]interface{}{"day": d}}
+		require.NoError(t, pitr.uploadBackupIndexYamlFile(makeBackupName(date, tag), bi))
+	}
+	return pitr, storage
+}
+
+func TestPITR_GetLatestBackup_ExactTag(t *testing.T) {
+	pitr, _ := newTestTaggedBackups(t, map[int]string{1: "dev", 2: "john_dev", 3: "dev-old"})
+
+	name, err := pitr.GetLatestBackup("dev")
+	require.NoError(t, err)
+	assert.Equal(t, "2025-01-01-00-00-00--dev", name)
+
+	_, err = pitr.GetLatestBackup("john")
+	assert.Error(t, err)
+}
+
+func TestPITR_ListBackups_Tag(t *testing.T) {
+	pitr, _ := newTestTaggedBackups(t, map[int]string{1: "dev", 2: "john_dev", 3: "dev", 4: "dev"})
+
+	list, err := pitr.ListTaggedBackups(2, 1, "", "dev", false)
+	require.NoError(t, err)
+	assert.Equal(t, []*ListableBackup{{Name: "2025-01-03-00-00-00--dev"}, {Name: "2025-01-04-00-00-00--dev"}}, list)
+
+	list, err = pitr.ListTaggedBackups(10, 0, "2025-01-0", "john_dev", false)
+	require.NoError(t, err)
+	assert.Equal(t, []*ListableBackup{{Name: "2025-01-02-00-00-00--john_dev"}}, list)
+}
+
+func TestPITR_ListTags(t *testing.T) {
+	pitr, storage := newTestTaggedBackups(t, map[int]string{1: "dev", 2: "prod", 3: "dev"})
+	require.NoError(t, storage.WriteBackupIndex("not-a-backup-name", nil))
+
+	tags, err := pitr.ListTags()
+	require.NoError(t, err)
+	assert.Equal(t, []*TagSummary{
+		{Tag: "dev", Backups: 2, Latest: "2025-01-03-00-00-00--dev", LatestDate: time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{Tag: "prod", Backups: 1, Latest: "2025-01-02-00-00-00--prod", LatestDate: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)},
+	}, tags)
+}
+
+func TestPITR_AliasBackup(t *testing.T) {
+	source := newTestSourceDir(t, map[string][]byte{"a": testContent(3000, 1)})
+
+	storage := newTestLocalStorage(t)
+	pitr := New(1, 2, time.Minute, storage)
+	require.NoError(t, pitr.GenerateBackup(source, "dev", map[string]interface{}{"blocknum": 10}, AllFileFilter))
+
+	backupName, err := pitr.GetLatestBackup("dev")
+	require.NoError(t, err)
+
+	aliasName, err := pitr.AliasBackup(backupName, "prod")
+	require.NoError(t, err)
+	assert.Equal(t, backupName[:len(backupName)-len("dev")]+"prod", aliasName)
+
+	latest, err := pitr.GetLatestBackup("prod")
+	require.NoError(t, err)
+	assert.Equal(t, aliasName, latest)
+
+	meta, err := pitr.GetBackupMeta(aliasName)
+	require.NoError(t, err)
+	assert.Equal(t, "prod", meta.Tag)
+	assert.Equal(t, float64(10), meta.Meta["blocknum"])
+
+	original, err := pitr.downloadBackupIndex(backupName)
+	require.NoError(t, err)
+	alias, err := pitr.downloadBackupIndex(aliasName)
+	require.NoError(t, err)
+	assert.Equal(t, original.Files, alias.Files)
+
+	_, err = pitr.AliasBackup(backupName, "prod")
+	assert.Error(t, err)
+	_, err = pitr.AliasBackup(backupName, "a/b")
+	assert.Error(t, err)
+}
@@ -2,6 +2,7 @@ package pitreos
 
 import (
 	"fmt"
+	"os"
 	"time"
 )
 
@@ -12,13 +13,28 @@ type BackupIndex struct {
 	Meta      map[string]interface{} `json:"meta"`
 	Files     []*FileIndex           `json:"files"`
 	ChunkSize int64                  `json:"chunk_size"`
+	Roots     []Root                 `json:"roots,omitempty"`
 }
 
 type FileIndex struct {
 	FileName  string      `json:"filename"`
+	Root      string      `json:"root,omitempty"`
 	Date      time.Time   `json:"date"`
+	ModTime   *time.Time  `json:"mtime,omitempty"`
+	Mode      os.FileMode `json:"mode,omitempty"`
 	TotalSize int64       `json:"size"`
 	Chunks    []*ChunkDef `json:"chunks"`
+
+	// Inconsistent is set on files that kept changing while being backed
+	// up: their chunks may mix old and new data.
+	Inconsistent bool `json:"inconsistent,omitempty"`
+
+	// Appendonly is set on files backed up as append-only.
+	Appendonly *AppendonlyCheck `json:"appendonly,omitempty"`
+
+	// notSnapshotted is set, while backing up with SnapshotAuto, on files
+	// that couldn't be cloned.
+	notSnapshotted bool
 }
 
 type ChunkDef struct {
@@ -29,8 +45,8 @@ type ChunkDef struct {
 }
 
 type ListableBackup struct {
-	Name string
-	Meta map[string]interface{}
+	Name string                 `json:"name"`
+	Meta map[string]interface{} `json:"meta,omitempty"`
 }
 
 func (backup *BackupIndex) ComputeFileEstimatedDiskSize(filename string) (uint64, error) {
@@ -55,7 +71,7 @@ func (backupIndex *BackupIndex) FindFilesMatching(filter Filter) ([]*FileIndex,
 	var matchingFiles []*FileIndex
 
 	for _, file := range backupIndex.Files {
-		if filter.Match(file.FileName) {
+		if matchFile(filter, file.FileName, file.Attributes()) {
 			matchingFiles = append(matchingFiles, file)
 		}
 	}
@@ -63,6 +79,15 @@ func (backupIndex *BackupIndex) FindFilesMatching(filter Filter) ([]*FileIndex,
 	return matchingFiles, nil
 }
 
+func (backup *BackupIndex) hasRoot(name string) bool {
+	for _, root := range backup.Roots {
+		if root.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (backup *BackupIndex) findFileIndex(filename string) (*FileIndex, error) {
 	for _, file := range backup.Files {
 		if file.FileName == filename {